@@ -0,0 +1,167 @@
+package applepay
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+type (
+	// Amount is an exact transaction amount, in minor units of its currency.
+	// It is decoded from a JSON number without loss of precision.
+	Amount struct {
+		// value is the canonical decimal form of the amount, without
+		// exponent nor superfluous zeros, empty for 0
+		value string
+	}
+)
+
+const (
+	// maxAmountExponent bounds the exponent of parsed numbers
+	maxAmountExponent = 64
+)
+
+var (
+	// amountRegexp matches JSON numbers
+	amountRegexp = regexp.MustCompile(`^(-?)(0|[1-9][0-9]*)(?:\.([0-9]+))?(?:[eE]([+-]?[0-9]+))?$`)
+)
+
+// NewAmount returns the amount of minorUnits
+func NewAmount(minorUnits int64) Amount {
+	if minorUnits == 0 {
+		return Amount{}
+	}
+	return Amount{value: strconv.FormatInt(minorUnits, 10)}
+}
+
+// ParseAmount parses a number of minor units in the JSON syntax, e.g. "1099"
+func ParseAmount(s string) (Amount, error) {
+	matches := amountRegexp.FindStringSubmatch(s)
+	if matches == nil {
+		return Amount{}, errors.Errorf("invalid amount %q", s)
+	}
+	exponent := 0
+	if matches[4] != "" {
+		var err error
+		exponent, err = strconv.Atoi(matches[4])
+		if err != nil || exponent > maxAmountExponent || exponent < -maxAmountExponent {
+			return Amount{}, errors.Errorf("invalid amount exponent in %q", s)
+		}
+	}
+
+	integer, fraction := matches[2], matches[3]
+	return Amount{value: canonicalDecimal(
+		matches[1] == "-",
+		integer+fraction,
+		len(integer)+exponent,
+	)}, nil
+}
+
+// MinorUnits returns the amount as an integer number of minor units
+func (a Amount) MinorUnits() (int64, error) {
+	if a.value == "" {
+		return 0, nil
+	}
+	if strings.Contains(a.value, ".") {
+		return 0, errors.Errorf("amount %s is not a whole number of minor units", a.value)
+	}
+	minorUnits, err := strconv.ParseInt(a.value, 10, 64)
+	if err != nil {
+		return 0, errors.Errorf("amount %s is out of range", a.value)
+	}
+	return minorUnits, nil
+}
+
+// Format returns the amount in major units of c, with at least as many
+// decimals as the exponent of c, e.g. "10.99" for 1099 in EUR
+func (a Amount) Format(c Currency) string {
+	negative, integer, fraction := a.split()
+	formatted := canonicalDecimal(
+		negative,
+		integer+fraction,
+		len(integer)-c.Exponent,
+	)
+	if formatted == "" {
+		formatted = "0"
+	}
+
+	decimals := 0
+	if i := strings.IndexByte(formatted, '.'); i >= 0 {
+		decimals = len(formatted) - i - 1
+	}
+	if decimals < c.Exponent {
+		if decimals == 0 {
+			formatted += "."
+		}
+		formatted += strings.Repeat("0", c.Exponent-decimals)
+	}
+	return formatted
+}
+
+// String returns the amount in minor units
+func (a Amount) String() string {
+	if a.value == "" {
+		return "0"
+	}
+	return a.value
+}
+
+// MarshalJSON encodes the amount as a JSON number
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// UnmarshalJSON decodes the amount from a JSON number
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	parsed, err := ParseAmount(string(data))
+	if err != nil {
+		return err
+	}
+	*a = parsed
+	return nil
+}
+
+// split returns the sign, integer and fraction digits of the amount
+func (a Amount) split() (negative bool, integer, fraction string) {
+	value := a.value
+	if strings.HasPrefix(value, "-") {
+		negative, value = true, value[1:]
+	}
+	integer, fraction, _ = strings.Cut(value, ".")
+	return negative, integer, fraction
+}
+
+// canonicalDecimal returns the canonical form of the number made of digits,
+// with the decimal point after the first point digits. point may be out of
+// the digits.
+func canonicalDecimal(negative bool, digits string, point int) string {
+	if point < 0 {
+		digits = strings.Repeat("0", -point) + digits
+		point = 0
+	}
+	if point > len(digits) {
+		digits += strings.Repeat("0", point-len(digits))
+	}
+
+	integer := strings.TrimLeft(digits[:point], "0")
+	fraction := strings.TrimRight(digits[point:], "0")
+	if integer == "" && fraction == "" {
+		return ""
+	}
+	if integer == "" {
+		integer = "0"
+	}
+	s := integer
+	if fraction != "" {
+		s += "." + fraction
+	}
+	if negative {
+		s = "-" + s
+	}
+	return s
+}
@@ -0,0 +1,126 @@
+package applepay
+
+import (
+	"encoding/json"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestParseAmount(t *testing.T) {
+	Convey("JSON numbers are parsed exactly", t, func() {
+		for _, test := range []struct {
+			number string
+			amount string
+		}{
+			{"1099", "1099"},
+			{"0", "0"},
+			{"-0", "0"},
+			{"0.1", "0.1"},
+			{"10.50", "10.5"},
+			{"-25", "-25"},
+			{"1e3", "1000"},
+			{"1.5E+2", "150"},
+			{"15e-1", "1.5"},
+			{"100e-2", "1"},
+			{"123456789012345678901234567890", "123456789012345678901234567890"},
+		} {
+			a, err := ParseAmount(test.number)
+			So(err, ShouldBeNil)
+			So(a.String(), ShouldEqual, test.amount)
+		}
+	})
+
+	Convey("Equal amounts have the same representation", t, func() {
+		a, _ := ParseAmount("1.099e3")
+
+		So(a, ShouldResemble, NewAmount(1099))
+		So(Amount{}, ShouldResemble, NewAmount(0))
+	})
+
+	Convey("Invalid numbers are rejected", t, func() {
+		for _, number := range []string{"", "01", "1.", ".5", "+1", "\"1\"", "1e", "0x10", "NaN", "1e1000"} {
+			_, err := ParseAmount(number)
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
+
+func TestAmountMinorUnits(t *testing.T) {
+	Convey("Whole amounts give their minor units", t, func() {
+		a, _ := ParseAmount("1099")
+		minor, err := a.MinorUnits()
+
+		So(err, ShouldBeNil)
+		So(minor, ShouldEqual, 1099)
+
+		minor, err = Amount{}.MinorUnits()
+		So(err, ShouldBeNil)
+		So(minor, ShouldEqual, 0)
+	})
+
+	Convey("Fractional amounts are rejected", t, func() {
+		a, _ := ParseAmount("10.99")
+		_, err := a.MinorUnits()
+
+		So(err.Error(), ShouldEqual, "amount 10.99 is not a whole number of minor units")
+	})
+
+	Convey("Amounts out of range are rejected", t, func() {
+		a, _ := ParseAmount("9223372036854775808")
+		_, err := a.MinorUnits()
+
+		So(err.Error(), ShouldEqual, "amount 9223372036854775808 is out of range")
+	})
+}
+
+func TestAmountFormat(t *testing.T) {
+	eur, _ := LookupCurrency("EUR")
+	jpy, _ := LookupCurrency("JPY")
+
+	Convey("Amounts are formatted in major units", t, func() {
+		So(NewAmount(1099).Format(eur), ShouldEqual, "10.99")
+		So(NewAmount(10).Format(eur), ShouldEqual, "0.10")
+		So(NewAmount(-1).Format(eur), ShouldEqual, "-0.01")
+		So(NewAmount(0).Format(eur), ShouldEqual, "0.00")
+		So(NewAmount(1099).Format(jpy), ShouldEqual, "1099")
+	})
+
+	Convey("Fractions of minor units are kept", t, func() {
+		a, _ := ParseAmount("10.5")
+
+		So(a.Format(eur), ShouldEqual, "0.105")
+		So(a.Format(jpy), ShouldEqual, "10.5")
+	})
+}
+
+func TestAmountJSON(t *testing.T) {
+	Convey("Amounts are decoded from JSON numbers", t, func() {
+		token := &Token{}
+		err := json.Unmarshal([]byte(`{"currencyCode":"978","transactionAmount":10.10}`), token)
+
+		So(err, ShouldBeNil)
+		So(token.TransactionAmount.String(), ShouldEqual, "10.1")
+	})
+
+	Convey("Amounts are encoded as JSON numbers", t, func() {
+		encoded, err := json.Marshal(struct{ Amount Amount }{NewAmount(1099)})
+
+		So(err, ShouldBeNil)
+		So(string(encoded), ShouldEqual, `{"Amount":1099}`)
+	})
+
+	Convey("Null amounts are ignored", t, func() {
+		a := NewAmount(1)
+
+		So(json.Unmarshal([]byte("null"), &a), ShouldBeNil)
+		So(a, ShouldResemble, NewAmount(1))
+	})
+
+	Convey("Other JSON values are rejected", t, func() {
+		var a Amount
+
+		So(json.Unmarshal([]byte(`"10"`), &a), ShouldNotBeNil)
+		So(json.Unmarshal([]byte(`true`), &a), ShouldNotBeNil)
+	})
+}
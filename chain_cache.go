@@ -0,0 +1,144 @@
+package applepay
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"crypto/x509"
+	"sync"
+	"time"
+)
+
+type (
+	// ChainCache holds the certificate chains already verified, as Apple
+	// signs many tokens with the same certificates. It is safe for concurrent
+	// use.
+	ChainCache struct {
+		size int
+
+		mu      sync.Mutex
+		entries map[chainKey]*list.Element
+		// lru orders the entries from the most to the least recently used
+		lru *list.List
+	}
+
+	// chainKey identifies a chain verified with a policy
+	chainKey struct {
+		leaf, inter       [sha256.Size]byte
+		roots             *x509.CertPool
+		leafOID, interOID string
+	}
+
+	// chainEntry is a verified chain, valid from notBefore to notAfter
+	chainEntry struct {
+		key       chainKey
+		chain     []*x509.Certificate
+		notBefore time.Time
+		notAfter  time.Time
+	}
+)
+
+const (
+	// defaultChainCacheSize is the size of the cache of the default policy
+	defaultChainCacheSize = 64
+)
+
+// defaultChainCache is the cache of DefaultVerificationPolicy
+var defaultChainCache = NewChainCache(defaultChainCacheSize)
+
+// NewChainCache creates a cache holding up to size chains
+func NewChainCache(size int) *ChainCache {
+	if size < 1 {
+		size = 1
+	}
+	return &ChainCache{
+		size:    size,
+		entries: make(map[chainKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Len returns the number of chains in the cache
+func (c *ChainCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// newChainKey returns the key of the chain of leaf and inter verified by p
+// against roots
+func (p VerificationPolicy) newChainKey(roots *x509.CertPool,
+	inter, leaf *x509.Certificate) chainKey {
+
+	return chainKey{
+		leaf:     sha256.Sum256(leaf.Raw),
+		inter:    sha256.Sum256(inter.Raw),
+		roots:    roots,
+		leafOID:  p.LeafCertificateOID.String(),
+		interOID: p.IntermediateCertificateOID.String(),
+	}
+}
+
+// get returns the chain of key if it is valid at signingTime. Chains no
+// longer valid at now are removed.
+func (c *ChainCache) get(key chainKey, signingTime,
+	now time.Time) ([]*x509.Certificate, bool) {
+
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*chainEntry)
+	if now.After(entry.notAfter) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+	if signingTime.Before(entry.notBefore) || signingTime.After(entry.notAfter) {
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return entry.chain, true
+}
+
+// add stores the verified chain of key, until the first expiration of its
+// certificates. The least recently used chain is evicted if the cache is
+// full.
+func (c *ChainCache) add(key chainKey, chain []*x509.Certificate) {
+	if c == nil || len(chain) == 0 {
+		return
+	}
+	entry := &chainEntry{
+		key:       key,
+		chain:     chain,
+		notBefore: chain[0].NotBefore,
+		notAfter:  chain[0].NotAfter,
+	}
+	for _, cert := range chain[1:] {
+		if cert.NotBefore.After(entry.notBefore) {
+			entry.notBefore = cert.NotBefore
+		}
+		if cert.NotAfter.Before(entry.notAfter) {
+			entry.notAfter = cert.NotAfter
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	for c.lru.Len() >= c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*chainEntry).key)
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+}
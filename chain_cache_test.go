@@ -0,0 +1,150 @@
+package applepay
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mozilla.org/pkcs7"
+)
+
+// testTokenChain returns the leaf and intermediate certificates of
+// tests/token.json
+func testTokenChain() (leaf, inter *x509.Certificate) {
+	tokenJSON, _ := os.ReadFile("tests/token.json")
+	token := &PKPaymentToken{}
+	json.Unmarshal(tokenJSON, token)
+	p7, _ := pkcs7.Parse(token.PaymentData.Signature)
+	return p7.Certificates[0], p7.Certificates[1]
+}
+
+func TestChainCache(t *testing.T) {
+	leaf, inter := testTokenChain()
+	roots := AppleRoots()
+	signingTime := testTokenSigningTime
+
+	Convey("Verified chains are cached", t, func() {
+		policy := DefaultVerificationPolicy()
+		policy.Now = clockAt(signingTime.Add(time.Minute))
+		policy.ChainCache = NewChainCache(2)
+
+		_, err := policy.verifyCertificates(roots, inter, leaf, signingTime)
+		So(err, ShouldBeNil)
+		So(policy.ChainCache.Len(), ShouldEqual, 1)
+
+		chain, ok := policy.ChainCache.get(policy.newChainKey(roots, inter, leaf), signingTime, policy.Now())
+		So(ok, ShouldBeTrue)
+		So(chain, ShouldHaveLength, 3)
+		So(chain[0], ShouldEqual, leaf)
+	})
+
+	Convey("Cached chains are not verified again", t, func() {
+		policy := DefaultVerificationPolicy()
+		policy.Now = clockAt(signingTime.Add(time.Minute))
+		policy.ChainCache = NewChainCache(2)
+		untrusted := x509.NewCertPool()
+		policy.ChainCache.add(policy.newChainKey(untrusted, inter, leaf), []*x509.Certificate{leaf, inter})
+
+		chain, err := policy.verifyCertificates(untrusted, inter, leaf, signingTime)
+		So(err, ShouldBeNil)
+		So(chain, ShouldHaveLength, 2)
+	})
+
+	Convey("Chains are cached per roots and marker OIDs", t, func() {
+		policy := DefaultVerificationPolicy()
+		other := policy
+		other.LeafCertificateOID = interCertificateOID
+
+		So(policy.newChainKey(roots, inter, leaf), ShouldNotResemble, policy.newChainKey(AppleRoots(), inter, leaf))
+		So(policy.newChainKey(roots, inter, leaf), ShouldNotResemble, other.newChainKey(roots, inter, leaf))
+	})
+
+	Convey("Chains expire with their certificates", t, func() {
+		cache := NewChainCache(2)
+		key := DefaultVerificationPolicy().newChainKey(roots, inter, leaf)
+		cache.add(key, []*x509.Certificate{leaf, inter})
+
+		_, ok := cache.get(key, leaf.NotAfter.Add(time.Second), signingTime)
+		So(ok, ShouldBeFalse)
+		So(cache.Len(), ShouldEqual, 1)
+
+		_, ok = cache.get(key, signingTime, leaf.NotAfter.Add(time.Second))
+		So(ok, ShouldBeFalse)
+		So(cache.Len(), ShouldEqual, 0)
+	})
+
+	Convey("The least recently used chains are evicted", t, func() {
+		otherLeaf, otherInter, _, _ := newSigningChain()
+		cache := NewChainCache(1)
+		key := DefaultVerificationPolicy().newChainKey(roots, inter, leaf)
+		otherKey := DefaultVerificationPolicy().newChainKey(roots, otherInter, otherLeaf)
+		cache.add(key, []*x509.Certificate{leaf, inter})
+		cache.add(otherKey, []*x509.Certificate{otherLeaf, otherInter})
+
+		_, ok := cache.get(key, signingTime, signingTime)
+		So(ok, ShouldBeFalse)
+		So(cache.Len(), ShouldEqual, 1)
+	})
+
+	Convey("Caches can be used concurrently", t, func() {
+		policy := DefaultVerificationPolicy()
+		policy.Now = clockAt(signingTime.Add(time.Minute))
+		policy.ChainCache = NewChainCache(2)
+
+		errs := make(chan error, 16)
+		wg := sync.WaitGroup{}
+		for i := 0; i < cap(errs); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := policy.verifyCertificates(roots, inter, leaf, signingTime)
+				errs <- err
+			}()
+		}
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			So(err, ShouldBeNil)
+		}
+		So(policy.ChainCache.Len(), ShouldEqual, 1)
+	})
+}
+
+func BenchmarkVerifySignature(b *testing.B) {
+	tokenJSON, _ := os.ReadFile("tests/token.json")
+	token := &PKPaymentToken{}
+	json.Unmarshal(tokenJSON, token)
+	token.SetTransactionTime(testTokenSigningTime.Add(time.Minute))
+
+	run := func(b *testing.B, policy VerificationPolicy) {
+		policy.Now = clockAt(testTokenSigningTime.Add(time.Minute))
+		b.SetParallelism(8)
+		b.ReportAllocs()
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if err := token.verifySignature(context.Background(), policy); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+
+	b.Run("uncached", func(b *testing.B) {
+		policy := DefaultVerificationPolicy()
+		policy.ChainCache = nil
+		run(b, policy)
+	})
+
+	b.Run("cached", func(b *testing.B) {
+		policy := DefaultVerificationPolicy()
+		policy.ChainCache = NewChainCache(defaultChainCacheSize)
+		run(b, policy)
+	})
+}
@@ -0,0 +1,120 @@
+package applepay
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type (
+	// CircuitBreaker fails the session requests fast while a gateway host is
+	// down: after threshold consecutive failures, requests to the host are
+	// rejected for a cooldown period, then a single request probes whether
+	// the host is back. It is safe for concurrent use, and can be shared by
+	// merchants.
+	CircuitBreaker struct {
+		threshold int
+		cooldown  time.Duration
+		// now returns the current time, time.Now if nil
+		now func() time.Time
+
+		mu    sync.Mutex
+		hosts map[string]*circuit
+	}
+
+	// circuit is the state of a host having failed
+	circuit struct {
+		failures int
+		// openUntil is the end of the cooldown of an open circuit
+		openUntil time.Time
+		// probing is set while a request probes an open circuit
+		probing bool
+	}
+)
+
+// NewCircuitBreaker creates a circuit breaker opening after threshold
+// consecutive failures, for cooldown
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &CircuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		hosts:     make(map[string]*circuit),
+	}
+}
+
+// MerchantCircuitBreaker sets the circuit breaker of session requests
+func MerchantCircuitBreaker(b *CircuitBreaker) func(*Merchant) error {
+	return func(m *Merchant) error {
+		if b == nil {
+			return newError(
+				CodeInvalidConfiguration,
+				errors.New("nil circuit breaker"),
+			)
+		}
+		m.circuitBreaker = b
+		return nil
+	}
+}
+
+// clock returns the current time
+func (b *CircuitBreaker) clock() time.Time {
+	if b.now == nil {
+		return time.Now()
+	}
+	return b.now()
+}
+
+// allow checks whether a request can be sent to host. Allowed requests must
+// be followed by a call to done.
+func (b *CircuitBreaker) allow(host string) error {
+	now := b.clock()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.hosts[host]
+	if !ok || c.failures < b.threshold {
+		return nil
+	}
+	if now.Before(c.openUntil) || c.probing {
+		return newError(CodeGatewayUnavailable, errors.Errorf(
+			"%s is unavailable after %d consecutive failures",
+			host, c.failures,
+		))
+	}
+	c.probing = true
+	return nil
+}
+
+// done records the outcome of a request to host: failed if the gateway
+// failed, or unknown if the request was interrupted by the caller
+func (b *CircuitBreaker) done(host string, failed, unknown bool) {
+	now := b.clock()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.hosts[host]
+	switch {
+	case unknown:
+		if ok {
+			c.probing = false
+		}
+	case !failed:
+		delete(b.hosts, host)
+	default:
+		if !ok {
+			c = &circuit{}
+			b.hosts[host] = c
+		}
+		c.failures++
+		c.probing = false
+		if c.failures >= b.threshold {
+			c.openUntil = now.Add(b.cooldown)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package applepay
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	host := "apple-pay-gateway.apple.com"
+	newBreaker := func() *CircuitBreaker {
+		b := NewCircuitBreaker(2, time.Minute)
+		b.now = func() time.Time { return now }
+		return b
+	}
+
+	Convey("Circuits open after consecutive failures", t, func() {
+		b := newBreaker()
+
+		So(b.allow(host), ShouldBeNil)
+		b.done(host, true, false)
+		So(b.allow(host), ShouldBeNil)
+		b.done(host, true, false)
+
+		err := b.allow(host)
+		So(errors.Is(err, ErrGatewayUnavailable), ShouldBeTrue)
+		So(err.Error(), ShouldEqual, "apple-pay-gateway.apple.com is unavailable after 2 consecutive failures")
+
+		Convey("for each host", func() {
+			So(b.allow("cn-apple-pay-gateway.apple.com"), ShouldBeNil)
+		})
+	})
+
+	Convey("Successes reset the failures", t, func() {
+		b := newBreaker()
+
+		b.done(host, true, false)
+		b.done(host, false, false)
+		b.done(host, true, false)
+
+		So(b.allow(host), ShouldBeNil)
+	})
+
+	Convey("A single request probes the host after the cooldown", t, func() {
+		b := newBreaker()
+		b.done(host, true, false)
+		b.done(host, true, false)
+		b.now = func() time.Time { return now.Add(time.Minute) }
+
+		So(b.allow(host), ShouldBeNil)
+		So(errors.Is(b.allow(host), ErrGatewayUnavailable), ShouldBeTrue)
+
+		Convey("closing the circuit if it succeeds", func() {
+			b.done(host, false, false)
+
+			So(b.allow(host), ShouldBeNil)
+			So(b.allow(host), ShouldBeNil)
+		})
+
+		Convey("opening it again if it fails", func() {
+			b.done(host, true, false)
+
+			So(errors.Is(b.allow(host), ErrGatewayUnavailable), ShouldBeTrue)
+		})
+
+		Convey("letting another request probe if it was interrupted", func() {
+			b.done(host, false, true)
+
+			So(b.allow(host), ShouldBeNil)
+		})
+	})
+
+	Convey("Merchants fail fast while the gateway is down", t, func() {
+		merchantID := "merchant.com.processout.test"
+		key, _ := rsa.GenerateKey(rand.Reader, 2048)
+		calls := 0
+		m, _ := New(
+			merchantID,
+			MerchantCertificate(testCertificate(merchantID, key)),
+			MerchantRoundTripper(sessionRoundTripper(&calls, http.StatusBadRequest, http.StatusServiceUnavailable)),
+			MerchantCircuitBreaker(NewCircuitBreaker(1, time.Minute)),
+		)
+		sessionURL := "https://apple-pay-gateway.apple.com/paymentservices/paymentSession"
+
+		// Rejected requests do not open the circuit
+		_, err := m.StartSession(sessionURL)
+		So(errors.Is(err, ErrSessionRejected), ShouldBeTrue)
+		_, err = m.StartSession(sessionURL)
+		So(errors.Is(err, ErrSessionRejected), ShouldBeTrue)
+
+		_, err = m.StartSession(sessionURL)
+		So(errors.Is(err, ErrGatewayUnavailable), ShouldBeTrue)
+		So(calls, ShouldEqual, 2)
+	})
+
+	Convey("Nil circuit breakers are rejected", t, func() {
+		_, err := New("merchant.com.processout.test", MerchantCircuitBreaker(nil))
+
+		So(errors.Is(err, ErrInvalidConfiguration), ShouldBeTrue)
+	})
+}
@@ -0,0 +1,94 @@
+package applepay
+
+import (
+	"math"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLookupCurrency(t *testing.T) {
+	Convey("Currencies are found by alphabetic and numeric code", t, func() {
+		eur, ok := LookupCurrency("EUR")
+		So(ok, ShouldBeTrue)
+		So(eur, ShouldResemble, Currency{Alpha: "EUR", Numeric: "978", Exponent: 2})
+
+		byNumeric, ok := LookupCurrency("978")
+		So(ok, ShouldBeTrue)
+		So(byNumeric, ShouldResemble, eur)
+
+		lower, ok := LookupCurrency("eur")
+		So(ok, ShouldBeTrue)
+		So(lower, ShouldResemble, eur)
+	})
+
+	Convey("Unknown currencies are not found", t, func() {
+		_, ok := LookupCurrency("XYZ")
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("Codes are unique", t, func() {
+		So(currenciesByCode, ShouldHaveLength, 2*len(currencies))
+	})
+
+	Convey("The table cannot be modified", t, func() {
+		Currencies()[0].Exponent = 5
+
+		So(Currencies()[0].Exponent, ShouldEqual, 2)
+	})
+
+	Convey("Tokens give their currency", t, func() {
+		c, ok := Token{CurrencyCode: "392"}.Currency()
+
+		So(ok, ShouldBeTrue)
+		So(c.String(), ShouldEqual, "JPY")
+		So(c.Exponent, ShouldEqual, 0)
+	})
+}
+
+func TestCurrencyMinorUnits(t *testing.T) {
+	eur, _ := LookupCurrency("EUR")
+	jpy, _ := LookupCurrency("JPY")
+	kwd, _ := LookupCurrency("KWD")
+
+	Convey("Amounts are converted with the exponent of the currency", t, func() {
+		for _, test := range []struct {
+			currency Currency
+			amount   string
+			minor    int64
+		}{
+			{eur, "10.99", 1099},
+			{eur, "10.9", 1090},
+			{eur, "10", 1000},
+			{eur, "0.01", 1},
+			{eur, "10.990", 1099},
+			{jpy, "500", 500},
+			{jpy, "500.00", 500},
+			{kwd, "1.234", 1234},
+		} {
+			minor, err := test.currency.MinorUnits(test.amount)
+			So(err, ShouldBeNil)
+			So(minor, ShouldEqual, test.minor)
+		}
+	})
+
+	Convey("Invalid amounts are rejected", t, func() {
+		for _, amount := range []string{"", ".5", "10.999", "-1", "1e3", "1,00", "99999999999999999999"} {
+			_, err := eur.MinorUnits(amount)
+			So(err, ShouldNotBeNil)
+		}
+		_, err := jpy.MinorUnits("1.5")
+		So(err.Error(), ShouldEqual, `invalid JPY amount "1.5"`)
+	})
+
+	Convey("Minor units are formatted as major units", t, func() {
+		So(eur.Format(1099), ShouldEqual, "10.99")
+		So(eur.Format(5), ShouldEqual, "0.05")
+		So(eur.Format(0), ShouldEqual, "0.00")
+		So(eur.Format(-150), ShouldEqual, "-1.50")
+		So(jpy.Format(500), ShouldEqual, "500")
+		So(jpy.Format(0), ShouldEqual, "0")
+		So(kwd.Format(1234), ShouldEqual, "1.234")
+		So(eur.Format(math.MinInt64), ShouldEqual, "-92233720368547758.08")
+	})
+}
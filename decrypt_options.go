@@ -0,0 +1,164 @@
+package applepay
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+
+	"github.com/pkg/errors"
+)
+
+type (
+	// DecryptOption adds a check to DecryptToken, on the authenticated token
+	DecryptOption func(*decryptOptions) error
+
+	// decryptOptions are the checks of a DecryptToken call
+	decryptOptions struct {
+		// applicationDataHash is the expected Header.ApplicationData,
+		// unchecked if nil
+		applicationDataHash []byte
+		// order is the expected amount of the token, unchecked if nil
+		order *expectedOrder
+	}
+
+	// expectedOrder is the order a token must pay for
+	expectedOrder struct {
+		reference string
+		currency  Currency
+		// amount is in minor units of currency
+		amount int64
+	}
+)
+
+// newDecryptOptions applies options
+func newDecryptOptions(options []DecryptOption) (*decryptOptions, error) {
+	o := &decryptOptions{}
+	for _, option := range options {
+		if err := option(o); err != nil {
+			return nil, withDefaultCode(CodeInvalidConfiguration, err)
+		}
+	}
+	return o, nil
+}
+
+// ApplicationData returns the base64-encoded applicationData of a payment
+// request binding payload, e.g. an order ID, to the token. Its hash is then
+// part of the signed header of the token.
+func ApplicationData(payload []byte) string {
+	return base64.StdEncoding.EncodeToString(payload)
+}
+
+// ApplicationDataHash returns the hex-encoded SHA-256 hash of payload, as set
+// in Header.ApplicationData by Apple
+func ApplicationDataHash(payload []byte) string {
+	hash := sha256.Sum256(payload)
+	return hex.EncodeToString(hash[:])
+}
+
+// ExpectedApplicationData rejects the tokens not created for payload, the
+// applicationData given to the payment request
+func ExpectedApplicationData(payload []byte) DecryptOption {
+	return func(o *decryptOptions) error {
+		if len(payload) == 0 {
+			return errors.New("empty application data")
+		}
+		hash := sha256.Sum256(payload)
+		o.applicationDataHash = hash[:]
+		return nil
+	}
+}
+
+// ExpectedOrder rejects the tokens whose amount or currency differs from the
+// order's. amount is a decimal number of major units, e.g. "10.99", and
+// currency an ISO 4217 alphabetic or numeric code. reference identifies the
+// order in the errors.
+func ExpectedOrder(amount, currency, reference string) DecryptOption {
+	return func(o *decryptOptions) error {
+		c, ok := LookupCurrency(currency)
+		if !ok {
+			return errors.Errorf("unknown currency %s", currency)
+		}
+		minor, err := c.MinorUnits(amount)
+		if err != nil {
+			return err
+		}
+		o.order = &expectedOrder{
+			reference: reference,
+			currency:  c,
+			amount:    minor,
+		}
+		return nil
+	}
+}
+
+// verify applies the checks to t, whose signature was verified
+func (o decryptOptions) verify(t *PKPaymentToken) error {
+	if o.applicationDataHash != nil {
+		if err := o.verifyApplicationData(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyApplicationData checks that the application data hash of the header
+// is the expected one
+func (o decryptOptions) verifyApplicationData(t *PKPaymentToken) error {
+	if t.PaymentData.Header.ApplicationData == "" {
+		return newError(
+			CodeApplicationDataMismatch,
+			errors.New("the token has no application data"),
+		)
+	}
+	hash, err := hex.DecodeString(t.PaymentData.Header.ApplicationData)
+	if err != nil {
+		return newError(
+			CodeMalformedToken,
+			errors.Wrap(err, "error decoding the application data"),
+		)
+	}
+	if subtle.ConstantTimeCompare(hash, o.applicationDataHash) != 1 {
+		return newError(
+			CodeApplicationDataMismatch,
+			errors.New("the token was created for other application data"),
+		)
+	}
+	return nil
+}
+
+// verifyToken applies the checks to the decrypted token
+func (o decryptOptions) verifyToken(token *Token) error {
+	if o.order != nil {
+		if err := o.order.verify(token); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verify checks that the token pays the amount of the order, in its currency
+func (order expectedOrder) verify(token *Token) error {
+	actual, err := token.TransactionAmount.MinorUnits()
+	if err != nil {
+		return newError(CodeMalformedToken, errors.Wrap(err, "invalid transaction amount"))
+	}
+
+	c, ok := token.Currency()
+	if ok && c == order.currency && actual == order.amount {
+		return nil
+	}
+
+	mismatch := &AmountMismatchError{
+		Reference:        order.reference,
+		ExpectedAmount:   order.currency.Format(order.amount),
+		ExpectedCurrency: order.currency.Alpha,
+		ActualAmount:     token.TransactionAmount.String(),
+		ActualCurrency:   token.CurrencyCode,
+	}
+	if ok {
+		mismatch.ActualAmount = token.TransactionAmount.Format(c)
+		mismatch.ActualCurrency = c.Alpha
+	}
+	return mismatch
+}
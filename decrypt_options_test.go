@@ -0,0 +1,166 @@
+package applepay
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestApplicationData(t *testing.T) {
+	Convey("Payloads are encoded for payment requests", t, func() {
+		So(ApplicationData([]byte("order-1234")), ShouldEqual, "b3JkZXItMTIzNA==")
+	})
+
+	Convey("Hashes are encoded as in token headers", t, func() {
+		So(ApplicationDataHash([]byte("order-1234")), ShouldEqual, "71983129e5088fcbbb2be5a2e186253aa3ee915c173f42553285baf7100b0059")
+	})
+}
+
+func TestExpectedApplicationData(t *testing.T) {
+	token := &PKPaymentToken{}
+	token.PaymentData.Header.ApplicationData = ApplicationDataHash([]byte("order-1234"))
+
+	Convey("Tokens created for the payload are accepted", t, func() {
+		o, err := newDecryptOptions([]DecryptOption{ExpectedApplicationData([]byte("order-1234"))})
+
+		So(err, ShouldBeNil)
+		So(o.verify(token), ShouldBeNil)
+	})
+
+	Convey("Tokens created for other payloads are rejected", t, func() {
+		o, _ := newDecryptOptions([]DecryptOption{ExpectedApplicationData([]byte("order-5678"))})
+
+		err := o.verify(token)
+
+		So(errors.Is(err, ErrApplicationDataMismatch), ShouldBeTrue)
+	})
+
+	Convey("Tokens without application data are rejected", t, func() {
+		o, _ := newDecryptOptions([]DecryptOption{ExpectedApplicationData([]byte("order-1234"))})
+
+		err := o.verify(&PKPaymentToken{})
+
+		So(err.Error(), ShouldEqual, "the token has no application data")
+		So(errors.Is(err, ErrApplicationDataMismatch), ShouldBeTrue)
+	})
+
+	Convey("Malformed application data are rejected", t, func() {
+		o, _ := newDecryptOptions([]DecryptOption{ExpectedApplicationData([]byte("order-1234"))})
+		malformed := &PKPaymentToken{}
+		malformed.PaymentData.Header.ApplicationData = "not hex"
+
+		So(errors.Is(o.verify(malformed), ErrMalformedToken), ShouldBeTrue)
+	})
+
+	Convey("Empty payloads are rejected", t, func() {
+		_, err := newDecryptOptions([]DecryptOption{ExpectedApplicationData(nil)})
+
+		So(errors.Is(err, ErrInvalidConfiguration), ShouldBeTrue)
+	})
+
+	Convey("Tokens are checked after their signature", t, func() {
+		tokenJSON, _ := os.ReadFile("tests/token.json")
+		signed := &PKPaymentToken{}
+		json.Unmarshal(tokenJSON, signed)
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		m, _ := New(
+			"merchant.com.processout.test",
+			ProcessingCertificate(testCertificate("merchant.com.processout.test", key)),
+		)
+
+		_, err := m.DecryptToken(signed, ExpectedApplicationData([]byte("order-1234")))
+		So(errors.Is(err, ErrApplicationDataMismatch), ShouldBeTrue)
+
+		// Changing the header invalidates the signature
+		signed.PaymentData.Header.ApplicationData = ApplicationDataHash([]byte("order-1234"))
+		_, err = m.DecryptToken(signed, ExpectedApplicationData([]byte("order-1234")))
+		So(errors.Is(err, ErrInvalidSignature), ShouldBeTrue)
+	})
+}
+
+func TestExpectedOrder(t *testing.T) {
+	Convey("Tokens paying the order are accepted", t, func() {
+		o, err := newDecryptOptions([]DecryptOption{ExpectedOrder("10.99", "EUR", "order-1234")})
+
+		So(err, ShouldBeNil)
+		So(o.verifyToken(&Token{CurrencyCode: "978", TransactionAmount: NewAmount(1099)}), ShouldBeNil)
+	})
+
+	Convey("Currencies can be given by numeric code", t, func() {
+		o, _ := newDecryptOptions([]DecryptOption{ExpectedOrder("500", "392", "order-1234")})
+
+		So(o.verifyToken(&Token{CurrencyCode: "392", TransactionAmount: NewAmount(500)}), ShouldBeNil)
+	})
+
+	Convey("Tokens with another amount are rejected with both values", t, func() {
+		o, _ := newDecryptOptions([]DecryptOption{ExpectedOrder("10.99", "EUR", "order-1234")})
+
+		err := o.verifyToken(&Token{CurrencyCode: "978", TransactionAmount: NewAmount(999)})
+
+		So(errors.Is(err, ErrAmountMismatch), ShouldBeTrue)
+		So(ErrorCodeOf(err), ShouldEqual, CodeAmountMismatch)
+		var mismatch *AmountMismatchError
+		So(errors.As(err, &mismatch), ShouldBeTrue)
+		So(mismatch, ShouldResemble, &AmountMismatchError{
+			Reference:        "order-1234",
+			ExpectedAmount:   "10.99",
+			ExpectedCurrency: "EUR",
+			ActualAmount:     "9.99",
+			ActualCurrency:   "EUR",
+		})
+		So(err.Error(), ShouldEqual, "order order-1234: expected 10.99 EUR, got 9.99 EUR")
+	})
+
+	Convey("Tokens with another currency are rejected", t, func() {
+		o, _ := newDecryptOptions([]DecryptOption{ExpectedOrder("10.99", "EUR", "order-1234")})
+
+		err := o.verifyToken(&Token{CurrencyCode: "840", TransactionAmount: NewAmount(1099)})
+		So(err.Error(), ShouldEqual, "order order-1234: expected 10.99 EUR, got 10.99 USD")
+
+		err = o.verifyToken(&Token{CurrencyCode: "999", TransactionAmount: NewAmount(1099)})
+		So(err.Error(), ShouldEqual, "order order-1234: expected 10.99 EUR, got 1099 999")
+	})
+
+	Convey("Amounts are compared in minor units of the currency", t, func() {
+		o, _ := newDecryptOptions([]DecryptOption{ExpectedOrder("1", "KWD", "order-1234")})
+
+		So(o.verifyToken(&Token{CurrencyCode: "414", TransactionAmount: NewAmount(1000)}), ShouldBeNil)
+		So(errors.Is(o.verifyToken(&Token{CurrencyCode: "414", TransactionAmount: NewAmount(100)}), ErrAmountMismatch), ShouldBeTrue)
+	})
+
+	Convey("Fractional amounts of minor units are rejected", t, func() {
+		o, _ := newDecryptOptions([]DecryptOption{ExpectedOrder("10.99", "EUR", "order-1234")})
+
+		fractional, _ := ParseAmount("10.99")
+
+		err := o.verifyToken(&Token{CurrencyCode: "978", TransactionAmount: fractional})
+
+		So(errors.Is(err, ErrMalformedToken), ShouldBeTrue)
+	})
+
+	Convey("Invalid orders are rejected", t, func() {
+		_, err := newDecryptOptions([]DecryptOption{ExpectedOrder("10.99", "XYZ", "order-1234")})
+		So(errors.Is(err, ErrInvalidConfiguration), ShouldBeTrue)
+
+		_, err = newDecryptOptions([]DecryptOption{ExpectedOrder("10.999", "EUR", "order-1234")})
+		So(errors.Is(err, ErrInvalidConfiguration), ShouldBeTrue)
+	})
+
+	Convey("Invalid orders are rejected before decryption", t, func() {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		m, _ := New(
+			"merchant.com.processout.test",
+			ProcessingCertificate(testCertificate("merchant.com.processout.test", key)),
+		)
+
+		_, err := m.DecryptOrderResponse(&Response{}, "10.99", "XYZ", "order-1234")
+
+		So(errors.Is(err, ErrInvalidConfiguration), ShouldBeTrue)
+	})
+}
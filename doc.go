@@ -15,9 +15,22 @@ Sample usage:
  // Create a new session
  sessionPayload, err := ap.Session("https://apple-pay-gateway.apple.com/paymentservices/startSession")
 
+ // Create a new session for Apple Pay in messages
+ sessionPayload, err := ap.Session(
+	 "https://apple-pay-gateway.apple.com/paymentservices/paymentSession",
+	 applepay.SessionInitiative(applepay.InitiativeMessaging, "https://store.processout.com/messages"),
+ )
+
  // Decrypt a token
  token, err := ap.DecryptResponse(res)
 
+ // Decrypt a token created for an order, whose ID was given to the payment
+ // request as applicationData with applepay.ApplicationData([]byte(orderID))
+ token, err := ap.DecryptResponse(res, applepay.ExpectedApplicationData([]byte(orderID)))
+
+ // Decrypt a token, checking that it pays 10.99 EUR for the order
+ token, err := ap.DecryptOrderResponse(res, "10.99", "EUR", orderID)
+
 A working example can be found in applepay/app.go. It requires a registered domain and valid certificates to work.
 */
 package applepay
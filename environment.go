@@ -0,0 +1,143 @@
+package applepay
+
+import (
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
+type (
+	// Environment is an Apple Pay environment, selecting the gateways the
+	// merchant talks to
+	Environment struct {
+		// Name identifies the environment, e.g. in logs
+		Name string
+		// SessionHosts are the hosts session requests can be sent to. Hosts
+		// without port are reached on port 443.
+		SessionHosts []string
+		// RegistrationURL is the endpoint of the Apple Pay Web Merchant
+		// Registration API registering merchant domains
+		RegistrationURL string
+		// UnregistrationURL is the endpoint of the Apple Pay Web Merchant
+		// Registration API unregistering merchant domains
+		UnregistrationURL string
+	}
+)
+
+const (
+	// EnvironmentProduction is the name of ProductionEnvironment
+	EnvironmentProduction = "production"
+	// EnvironmentSandbox is the name of SandboxEnvironment
+	EnvironmentSandbox = "sandbox"
+)
+
+// ProductionEnvironment returns the production environment of Apple Pay,
+// used by default. Its session hosts are the ones published by Apple.
+func ProductionEnvironment() Environment {
+	return Environment{
+		Name: EnvironmentProduction,
+		SessionHosts: []string{
+			"apple-pay-gateway.apple.com",
+			"apple-pay-gateway-nc-pod1.apple.com",
+			"apple-pay-gateway-nc-pod2.apple.com",
+			"apple-pay-gateway-nc-pod3.apple.com",
+			"apple-pay-gateway-nc-pod4.apple.com",
+			"apple-pay-gateway-nc-pod5.apple.com",
+			"apple-pay-gateway-pr-pod1.apple.com",
+			"apple-pay-gateway-pr-pod2.apple.com",
+			"apple-pay-gateway-pr-pod3.apple.com",
+			"apple-pay-gateway-pr-pod4.apple.com",
+			"apple-pay-gateway-pr-pod5.apple.com",
+			"cn-apple-pay-gateway.apple.com",
+			"cn-apple-pay-gateway-sh-pod1.apple.com",
+			"cn-apple-pay-gateway-sh-pod2.apple.com",
+			"cn-apple-pay-gateway-sh-pod3.apple.com",
+			"cn-apple-pay-gateway-tj-pod1.apple.com",
+			"cn-apple-pay-gateway-tj-pod2.apple.com",
+			"cn-apple-pay-gateway-tj-pod3.apple.com",
+		},
+		RegistrationURL:   "https://apple-pay-gateway.apple.com/paymentservices/registerMerchant",
+		UnregistrationURL: "https://apple-pay-gateway.apple.com/paymentservices/unregisterMerchant",
+	}
+}
+
+// SandboxEnvironment returns the sandbox environment of Apple Pay, for tests
+// with sandbox accounts
+func SandboxEnvironment() Environment {
+	return Environment{
+		Name: EnvironmentSandbox,
+		SessionHosts: []string{
+			"apple-pay-gateway-cert.apple.com",
+			"cn-apple-pay-gateway-cert.apple.com",
+		},
+		RegistrationURL:   "https://apple-pay-gateway-cert.apple.com/paymentservices/registerMerchant",
+		UnregistrationURL: "https://apple-pay-gateway-cert.apple.com/paymentservices/unregisterMerchant",
+	}
+}
+
+// MerchantEnvironment sets the environment of the merchant, e.g.
+// SandboxEnvironment() or a custom environment pointing at a local stand-in
+// of Apple in tests
+func MerchantEnvironment(env Environment) func(*Merchant) error {
+	return func(m *Merchant) error {
+		if env.Name == "" {
+			return newError(
+				CodeInvalidConfiguration,
+				errors.New("the environment has no name"),
+			)
+		}
+		if len(env.SessionHosts) == 0 {
+			return newError(
+				CodeInvalidConfiguration,
+				errors.Errorf("the %s environment has no session host", env.Name),
+			)
+		}
+		env.SessionHosts = append([]string(nil), env.SessionHosts...)
+		m.env = &env
+		return nil
+	}
+}
+
+// Environment returns the environment of the merchant
+func (m Merchant) Environment() Environment {
+	if m.env == nil {
+		return ProductionEnvironment()
+	}
+	env := *m.env
+	env.SessionHosts = append([]string(nil), env.SessionHosts...)
+	return env
+}
+
+// String returns the name of the environment
+func (e Environment) String() string {
+	return e.Name
+}
+
+// checkSessionURL validates the request URL sent by the client to check that
+// it belongs to a session host of the environment
+func (e Environment) checkSessionURL(location string) error {
+	u, err := url.Parse(location)
+	if err != nil {
+		return errors.Wrap(err, "error parsing the URL")
+	}
+	if !e.isSessionHost(u) {
+		return errors.Errorf("invalid host for the %s environment", e.Name)
+	}
+	if u.Scheme != "https" {
+		return errors.New("unsupported protocol")
+	}
+	return nil
+}
+
+// isSessionHost tells whether the host of u is a session host
+func (e Environment) isSessionHost(u *url.URL) bool {
+	for _, host := range e.SessionHosts {
+		if u.Host == host {
+			return true
+		}
+		if u.Hostname() == host && (u.Port() == "" || u.Port() == "443") {
+			return true
+		}
+	}
+	return false
+}
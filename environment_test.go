@@ -0,0 +1,151 @@
+package applepay
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net/http"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCheckSessionURL(t *testing.T) {
+	production := ProductionEnvironment()
+	sandbox := SandboxEnvironment()
+
+	Convey("Invalid urls", t, func() {
+		Convey("An known invalid URL does not work", func() {
+			So(production.checkSessionURL("%gh&%ij"), ShouldNotBeNil)
+		})
+
+		Convey(`"not a url" does not work`, func() {
+			So(production.checkSessionURL("not a url"), ShouldNotBeNil)
+		})
+	})
+
+	Convey("Wrong domain", t, func() {
+		Convey("example.com does not work", func() {
+			So(production.checkSessionURL("httos://example.com"), ShouldNotBeNil)
+		})
+
+		Convey("apple.com does not work", func() {
+			So(production.checkSessionURL("https://apple.com"), ShouldNotBeNil)
+		})
+
+		Convey("attacking attempt should not work", func() {
+			So(production.checkSessionURL("https://attacker.com/cn-apple-pay-gateway.apple.com"), ShouldNotBeNil)
+		})
+
+		Convey("attacking attempt 2 should not work", func() {
+			So(production.checkSessionURL("https://attacker.com?cn-apple-pay-gateway.apple.com"), ShouldNotBeNil)
+		})
+
+		Convey("unpublished gateways do not work", func() {
+			So(production.checkSessionURL("https://apple-pay-gateway-evil.apple.com"), ShouldNotBeNil)
+		})
+
+		Convey("other ports do not work", func() {
+			So(production.checkSessionURL("https://apple-pay-gateway.apple.com:8443"), ShouldNotBeNil)
+		})
+
+		Convey("sandbox gateways do not work in production", func() {
+			err := production.checkSessionURL("https://apple-pay-gateway-cert.apple.com")
+			So(err.Error(), ShouldEqual, "invalid host for the production environment")
+		})
+
+		Convey("production gateways do not work in the sandbox", func() {
+			So(sandbox.checkSessionURL("https://apple-pay-gateway.apple.com"), ShouldNotBeNil)
+		})
+	})
+
+	Convey("Wrong scheme", t, func() {
+		Convey("HTTP does not work", func() {
+			So(production.checkSessionURL("http://apple-pay-gateway.apple.com"), ShouldNotBeNil)
+		})
+	})
+
+	Convey("Valid cases", t, func() {
+		Convey("Right domain with right scheme works", func() {
+			So(production.checkSessionURL("https://apple-pay-gateway.apple.com"), ShouldBeNil)
+		})
+
+		Convey("China specific domain works", func() {
+			So(production.checkSessionURL("https://cn-apple-pay-gateway.apple.com"), ShouldBeNil)
+		})
+
+		Convey("Pod gateways work", func() {
+			So(production.checkSessionURL("https://apple-pay-gateway-nc-pod3.apple.com"), ShouldBeNil)
+		})
+
+		Convey("Sandbox gateways work in the sandbox", func() {
+			So(sandbox.checkSessionURL("https://apple-pay-gateway-cert.apple.com"), ShouldBeNil)
+		})
+
+		Convey("Function accepts any path and the default port", func() {
+			So(production.checkSessionURL("https://apple-pay-gateway.apple.com:443/test"), ShouldBeNil)
+		})
+	})
+}
+
+func TestMerchantEnvironment(t *testing.T) {
+	Convey("Merchants are in production by default", t, func() {
+		m, _ := New("merchant.com.processout.test")
+
+		So(m.Environment().String(), ShouldEqual, EnvironmentProduction)
+		So(m.Environment(), ShouldResemble, ProductionEnvironment())
+	})
+
+	Convey("The environment can be set", t, func() {
+		m, err := New("merchant.com.processout.test", MerchantEnvironment(SandboxEnvironment()))
+
+		So(err, ShouldBeNil)
+		So(m.Environment().Name, ShouldEqual, EnvironmentSandbox)
+		So(m.Environment().RegistrationURL, ShouldEqual, "https://apple-pay-gateway-cert.apple.com/paymentservices/registerMerchant")
+	})
+
+	Convey("The hosts of the environment cannot be modified", t, func() {
+		hosts := []string{"127.0.0.1:8443"}
+		m, _ := New("merchant.com.processout.test", MerchantEnvironment(Environment{
+			Name:         "local",
+			SessionHosts: hosts,
+		}))
+
+		hosts[0] = "example.com"
+		m.Environment().SessionHosts[0] = "example.com"
+
+		So(m.Environment().SessionHosts, ShouldResemble, []string{"127.0.0.1:8443"})
+	})
+
+	Convey("Invalid environments are rejected", t, func() {
+		for _, env := range []Environment{
+			{SessionHosts: []string{"127.0.0.1:8443"}},
+			{Name: "local"},
+		} {
+			_, err := New("merchant.com.processout.test", MerchantEnvironment(env))
+			So(errors.Is(err, ErrInvalidConfiguration), ShouldBeTrue)
+		}
+	})
+
+	Convey("Custom environments allow local stand-ins of Apple", t, func() {
+		merchantID := "merchant.com.processout.test"
+		key, _ := rsa.GenerateKey(rand.Reader, 2048)
+		calls := 0
+		m, _ := New(
+			merchantID,
+			MerchantCertificate(testCertificate(merchantID, key)),
+			MerchantEnvironment(Environment{
+				Name:         "local",
+				SessionHosts: []string{"127.0.0.1:8443"},
+			}),
+			MerchantRoundTripper(sessionRoundTripper(&calls, http.StatusBadRequest)),
+		)
+
+		_, err := m.StartSession("https://127.0.0.1:8443/paymentSession")
+		So(errors.Is(err, ErrSessionRejected), ShouldBeTrue)
+
+		_, err = m.StartSession("https://apple-pay-gateway.apple.com/paymentservices/paymentSession")
+		So(errors.Is(err, ErrInvalidSessionURL), ShouldBeTrue)
+		So(calls, ShouldEqual, 1)
+	})
+}
@@ -0,0 +1,245 @@
+package applepay
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type (
+	// ErrorCode is a stable, machine-readable identifier of a failure, e.g.
+	// to be mapped to HTTP responses
+	ErrorCode string
+
+	// Error is a failure of the package. It matches the sentinel error of its
+	// code with errors.Is, and its cause can be unwrapped.
+	Error struct {
+		Code ErrorCode
+		Err  error
+	}
+
+	// SigningTimeError is returned when a token was signed outside of the
+	// transaction time window, which may be a replayed token
+	SigningTimeError struct {
+		SigningTime     time.Time
+		TransactionTime time.Time
+		Window          time.Duration
+	}
+
+	// SessionError is returned when Apple rejects a session request
+	SessionError struct {
+		// StatusCode is the HTTP status of Apple's response
+		StatusCode int
+		// StatusMessage is the reason given by Apple, if any
+		StatusMessage string
+	}
+
+	// AmountMismatchError is returned for tokens whose amount or currency is
+	// not the one of the order. Amounts are formatted in major units.
+	AmountMismatchError struct {
+		Reference        string
+		ExpectedAmount   string
+		ExpectedCurrency string
+		ActualAmount     string
+		ActualCurrency   string
+	}
+)
+
+const (
+	// CodeInvalidConfiguration is returned for invalid merchant or registry
+	// settings
+	CodeInvalidConfiguration ErrorCode = "invalid_configuration"
+	// CodeInvalidCertificate is returned for merchant or processing
+	// certificates that cannot be used: unreadable, expired, issued for
+	// another merchant ID or not matching their key
+	CodeInvalidCertificate ErrorCode = "invalid_certificate"
+	// CodeMissingCertificate is returned when the certificate required by an
+	// operation was not set
+	CodeMissingCertificate ErrorCode = "missing_certificate"
+	// CodeMalformedToken is returned for tokens with missing or unparsable
+	// fields
+	CodeMalformedToken ErrorCode = "malformed_token"
+	// CodeUnsupportedVersion is returned for tokens of an unknown version
+	CodeUnsupportedVersion ErrorCode = "unsupported_version"
+	// CodeInvalidSignature is returned for tokens whose signature does not
+	// match their content
+	CodeInvalidSignature ErrorCode = "invalid_signature"
+	// CodeUntrustedChain is returned for tokens not signed by Apple
+	CodeUntrustedChain ErrorCode = "untrusted_chain"
+	// CodeCertificateRevoked is returned for tokens signed with a revoked
+	// certificate
+	CodeCertificateRevoked ErrorCode = "certificate_revoked"
+	// CodeRevocationUnavailable is returned when the revocation status of the
+	// signing certificates cannot be retrieved in hard-fail mode
+	CodeRevocationUnavailable ErrorCode = "revocation_unavailable"
+	// CodeSigningTimeOutOfWindow is returned for tokens signed outside of the
+	// transaction time window
+	CodeSigningTimeOutOfWindow ErrorCode = "signing_time_out_of_window"
+	// CodeApplicationDataMismatch is returned for tokens created for another
+	// order, according to their application data
+	CodeApplicationDataMismatch ErrorCode = "application_data_mismatch"
+	// CodeAmountMismatch is returned for tokens whose amount or currency is
+	// not the one of the order
+	CodeAmountMismatch ErrorCode = "amount_mismatch"
+	// CodeReplayedToken is returned for tokens already decrypted
+	CodeReplayedToken ErrorCode = "replayed_token"
+	// CodeReplayStore is returned when the replay store cannot be used
+	CodeReplayStore ErrorCode = "replay_store_error"
+	// CodeKeyMismatch is returned for tokens encrypted for another processing
+	// key
+	CodeKeyMismatch ErrorCode = "key_mismatch"
+	// CodeDecryptionFailed is returned when the token cannot be decrypted
+	// with the processing key
+	CodeDecryptionFailed ErrorCode = "decryption_failed"
+	// CodeInvalidSessionURL is returned for session URLs not belonging to
+	// Apple
+	CodeInvalidSessionURL ErrorCode = "invalid_session_url"
+	// CodeGateway is returned when the Apple Pay gateway cannot be reached
+	CodeGateway ErrorCode = "gateway_error"
+	// CodeGatewayUnavailable is returned without contacting the Apple Pay
+	// gateway after it failed repeatedly, see CircuitBreaker
+	CodeGatewayUnavailable ErrorCode = "gateway_unavailable"
+	// CodeSessionRejected is returned when Apple answers a session request
+	// with an error status
+	CodeSessionRejected ErrorCode = "session_rejected"
+	// CodeInvalidSession is returned for sessions returned by Apple that
+	// cannot be used: unparsable, incomplete or expired
+	CodeInvalidSession ErrorCode = "invalid_session"
+)
+
+var (
+	// Sentinel errors of each code, to be used with errors.Is
+
+	ErrInvalidConfiguration    = &Error{Code: CodeInvalidConfiguration}
+	ErrInvalidCertificate      = &Error{Code: CodeInvalidCertificate}
+	ErrMissingCertificate      = &Error{Code: CodeMissingCertificate}
+	ErrMalformedToken          = &Error{Code: CodeMalformedToken}
+	ErrUnsupportedVersion      = &Error{Code: CodeUnsupportedVersion}
+	ErrInvalidSignature        = &Error{Code: CodeInvalidSignature}
+	ErrUntrustedChain          = &Error{Code: CodeUntrustedChain}
+	ErrCertificateRevoked      = &Error{Code: CodeCertificateRevoked}
+	ErrRevocationUnavailable   = &Error{Code: CodeRevocationUnavailable}
+	ErrSigningTimeOutOfWindow  = &Error{Code: CodeSigningTimeOutOfWindow}
+	ErrApplicationDataMismatch = &Error{Code: CodeApplicationDataMismatch}
+	ErrAmountMismatch          = &Error{Code: CodeAmountMismatch}
+	ErrReplayedToken           = &Error{Code: CodeReplayedToken}
+	ErrReplayStore             = &Error{Code: CodeReplayStore}
+	ErrKeyMismatch             = &Error{Code: CodeKeyMismatch}
+	ErrDecryptionFailed        = &Error{Code: CodeDecryptionFailed}
+	ErrInvalidSessionURL       = &Error{Code: CodeInvalidSessionURL}
+	ErrGateway                 = &Error{Code: CodeGateway}
+	ErrGatewayUnavailable      = &Error{Code: CodeGatewayUnavailable}
+	ErrSessionRejected         = &Error{Code: CodeSessionRejected}
+	ErrInvalidSession          = &Error{Code: CodeInvalidSession}
+)
+
+// newError attaches a code to err
+func newError(code ErrorCode, err error) error {
+	return &Error{Code: code, Err: err}
+}
+
+// withDefaultCode attaches a code to err if it has none yet, e.g. for errors
+// returned by options or schemes of other packages. It returns nil if err is
+// nil.
+func withDefaultCode(code ErrorCode, err error) error {
+	if err == nil || ErrorCodeOf(err) != "" {
+		return err
+	}
+	return newError(code, err)
+}
+
+// ErrorCodeOf returns the code of the first error of err's chain having one,
+// or an empty code
+func ErrorCodeOf(err error) ErrorCode {
+	var coded interface {
+		ErrorCode() ErrorCode
+	}
+	if errors.As(err, &coded) {
+		return coded.ErrorCode()
+	}
+	return ""
+}
+
+// Error implements error
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return string(e.Code)
+	}
+	return e.Err.Error()
+}
+
+// Unwrap returns the cause of the error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is matches the sentinel error of the same code
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Err == nil && t.Code == e.Code
+}
+
+// ErrorCode returns the code of the error
+func (e *Error) ErrorCode() ErrorCode {
+	return e.Code
+}
+
+// Error implements error
+func (e *SigningTimeError) Error() string {
+	delta := e.TransactionTime.Sub(e.SigningTime)
+	if delta < 0 {
+		return "the transaction occured before the signing (" +
+			delta.String() + " difference)"
+	}
+	return "the transaction occured after the allowed time window (" +
+		delta.String() + ")"
+}
+
+// Is matches ErrSigningTimeOutOfWindow
+func (e *SigningTimeError) Is(target error) bool {
+	return target == ErrSigningTimeOutOfWindow
+}
+
+// ErrorCode returns CodeSigningTimeOutOfWindow
+func (e *SigningTimeError) ErrorCode() ErrorCode {
+	return CodeSigningTimeOutOfWindow
+}
+
+// Error implements error
+func (e *AmountMismatchError) Error() string {
+	return "order " + e.Reference + ": expected " +
+		e.ExpectedAmount + " " + e.ExpectedCurrency + ", got " +
+		e.ActualAmount + " " + e.ActualCurrency
+}
+
+// Is matches ErrAmountMismatch
+func (e *AmountMismatchError) Is(target error) bool {
+	return target == ErrAmountMismatch
+}
+
+// ErrorCode returns CodeAmountMismatch
+func (e *AmountMismatchError) ErrorCode() ErrorCode {
+	return CodeAmountMismatch
+}
+
+// Error implements error
+func (e *SessionError) Error() string {
+	message := e.StatusMessage
+	if message == "" {
+		message = http.StatusText(e.StatusCode)
+	}
+	return "Apple rejected the session request with status " +
+		strconv.Itoa(e.StatusCode) + ": " + message
+}
+
+// Is matches ErrSessionRejected
+func (e *SessionError) Is(target error) bool {
+	return target == ErrSessionRejected
+}
+
+// ErrorCode returns CodeSessionRejected
+func (e *SessionError) ErrorCode() ErrorCode {
+	return CodeSessionRejected
+}
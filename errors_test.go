@@ -0,0 +1,107 @@
+package applepay
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	pkgerrors "github.com/pkg/errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mozilla.org/pkcs7"
+)
+
+func TestError(t *testing.T) {
+	Convey("Errors match the sentinel of their code", t, func() {
+		err := pkgerrors.Wrap(
+			newError(CodeKeyMismatch, pkgerrors.New("no key")),
+			"error decrypting",
+		)
+
+		So(errors.Is(err, ErrKeyMismatch), ShouldBeTrue)
+		So(errors.Is(err, ErrDecryptionFailed), ShouldBeFalse)
+		So(err.Error(), ShouldEqual, "error decrypting: no key")
+	})
+
+	Convey("Errors can be unwrapped", t, func() {
+		cause := pkgerrors.New("no key")
+		err := pkgerrors.Wrap(newError(CodeKeyMismatch, cause), "error decrypting")
+
+		var e *Error
+		So(errors.As(err, &e), ShouldBeTrue)
+		So(e.Code, ShouldEqual, CodeKeyMismatch)
+		So(errors.Is(err, cause), ShouldBeTrue)
+	})
+
+	Convey("Sentinels are named after their code", t, func() {
+		So(ErrGateway.Error(), ShouldEqual, "gateway_error")
+	})
+}
+
+func TestErrorCodeOf(t *testing.T) {
+	Convey("The first code of the chain is returned", t, func() {
+		err := newError(
+			CodeInvalidConfiguration,
+			newError(CodeInvalidCertificate, pkgerrors.New("expired")),
+		)
+
+		So(ErrorCodeOf(err), ShouldEqual, CodeInvalidConfiguration)
+	})
+
+	Convey("Errors without a code have an empty code", t, func() {
+		So(ErrorCodeOf(pkgerrors.New("error")), ShouldEqual, "")
+		So(ErrorCodeOf(nil), ShouldEqual, "")
+	})
+
+	Convey("Default codes do not replace existing ones", t, func() {
+		err := withDefaultCode(
+			CodeDecryptionFailed,
+			newError(CodeMalformedToken, pkgerrors.New("empty key")),
+		)
+
+		So(ErrorCodeOf(err), ShouldEqual, CodeMalformedToken)
+		So(ErrorCodeOf(withDefaultCode(CodeDecryptionFailed, pkgerrors.New("error"))), ShouldEqual, CodeDecryptionFailed)
+	})
+}
+
+func TestSigningTimeError(t *testing.T) {
+
+	Convey("Transactions after the window are reported", t, func() {
+		var err error = &SigningTimeError{
+			SigningTime:     testTokenSigningTime,
+			TransactionTime: testTokenSigningTime.Add(time.Hour),
+			Window:          5 * time.Minute,
+		}
+
+		So(err.Error(), ShouldEqual, "the transaction occured after the allowed time window (1h0m0s)")
+		So(errors.Is(err, ErrSigningTimeOutOfWindow), ShouldBeTrue)
+		So(ErrorCodeOf(err), ShouldEqual, CodeSigningTimeOutOfWindow)
+	})
+
+	Convey("Transactions before the signing are reported", t, func() {
+		err := &SigningTimeError{
+			SigningTime:     testTokenSigningTime,
+			TransactionTime: testTokenSigningTime.Add(-time.Minute),
+			Window:          5 * time.Minute,
+		}
+
+		So(err.Error(), ShouldEqual, "the transaction occured before the signing (-1m0s difference)")
+	})
+
+	Convey("Tokens signed outside of the window are rejected", t, func() {
+		policy := DefaultVerificationPolicy()
+		policy.PastWindow = 5 * time.Minute
+		tokenJSON, _ := os.ReadFile("tests/token.json")
+		token := &PKPaymentToken{}
+		json.Unmarshal(tokenJSON, token)
+		token.SetTransactionTime(time.Now())
+		p7, _ := pkcs7.Parse(token.PaymentData.Signature)
+
+		err := token.verifySigningTime(p7, policy)
+
+		var e *SigningTimeError
+		So(errors.As(err, &e), ShouldBeTrue)
+		So(e.SigningTime.Equal(testTokenSigningTime), ShouldBeTrue)
+	})
+}
@@ -16,12 +16,19 @@ var (
 )
 
 func init() {
+	// Production by default, APPLEPAY_ENVIRONMENT=sandbox for sandbox
+	// accounts
+	env := applepay.ProductionEnvironment()
+	if os.Getenv("APPLEPAY_ENVIRONMENT") == applepay.EnvironmentSandbox {
+		env = applepay.SandboxEnvironment()
+	}
+
 	var err error
-	applepay.AppleRootCertificatePath = "AppleRootCA-G3.crt"
 	ap, err = applepay.New(
 		"merchant.com.processout.test",
 		applepay.MerchantDisplayName("ProcessOut Development Store"),
 		applepay.MerchantDomainName("applepay.processout.com"),
+		applepay.MerchantEnvironment(env),
 		applepay.MerchantCertificateLocation(
 			"certs/cert-merchant.crt",
 			"certs/cert-merchant-key.pem",
@@ -34,7 +41,7 @@ func init() {
 	if err != nil {
 		panic(err)
 	}
-	log.Println("Apple Pay test app starting")
+	log.Printf("Apple Pay test app starting in the %s environment", ap.Environment())
 }
 
 func main() {
@@ -59,7 +66,7 @@ func getApplePaySession(c *gin.Context) {
 		return
 	}
 
-	payload, err := ap.Session(r.URL)
+	payload, err := ap.SessionContext(c.Request.Context(), r.URL)
 	if err != nil {
 		log.Println(err)
 		c.Status(http.StatusInternalServerError)
@@ -82,6 +89,8 @@ func processApplePayResponse(c *gin.Context) {
 	// public key:
 	// h, err := r.Token.PublicKeyHash()
 
+	// Use ap.DecryptOrderResponse(r, amount, currency, orderID) instead to
+	// check that the token pays the order
 	token, err := ap.DecryptResponse(r)
 	if err != nil {
 		log.Println(err)
@@ -91,6 +100,5 @@ func processApplePayResponse(c *gin.Context) {
 
 	fmt.Println("Token received!")
 	spew.Dump(token)
-	// TODO: check price…
 	c.Status(http.StatusOK)
 }
@@ -0,0 +1,4 @@
+// Package sqlitetest tests applepay.SQLReplayStore with SQLite. It is a
+// separate module so that the cgo SQLite driver is not a dependency of
+// applepay.
+package sqlitetest
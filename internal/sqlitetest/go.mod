@@ -0,0 +1,22 @@
+module github.com/processout/applepay/internal/sqlitetest
+
+go 1.21
+
+require (
+	github.com/mattn/go-sqlite3 v1.14.22
+	github.com/processout/applepay v0.0.0
+	github.com/smartystreets/goconvey v1.6.4
+)
+
+require (
+	github.com/gopherjs/gopherjs v0.0.0-20181017120253-0766667cb4d1 // indirect
+	github.com/jtolds/gls v4.20.0+incompatible // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/sirupsen/logrus v1.8.1 // indirect
+	github.com/smartystreets/assertions v0.0.0-20180927180507-b2de0cb4f26d // indirect
+	go.mozilla.org/pkcs7 v0.0.0-20210826202110-33d05740a352 // indirect
+	golang.org/x/crypto v0.0.0-20210817164053-32db794688a5 // indirect
+	golang.org/x/sys v0.0.0-20210909193231-528a39cd75f3 // indirect
+)
+
+replace github.com/processout/applepay => ../..
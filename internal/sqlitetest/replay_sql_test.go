@@ -0,0 +1,101 @@
+package sqlitetest
+
+import (
+	"database/sql"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/processout/applepay"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// newSQLiteReplayStore creates a store in a new SQLite database
+func newSQLiteReplayStore(t *testing.T) (*applepay.SQLReplayStore, *sql.DB) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "replay.db"))
+	So(err, ShouldBeNil)
+	// SQLite does not support concurrent writers
+	db.SetMaxOpenConns(1)
+	store, err := applepay.NewSQLReplayStore(db, "applepay_transactions", nil)
+	So(err, ShouldBeNil)
+	So(store.CreateTable(), ShouldBeNil)
+	return store, db
+}
+
+func TestSQLReplayStore(t *testing.T) {
+	// SQL stores have a precision of a second
+	now := time.Now().Truncate(time.Second)
+
+	Convey("Transactions are only accepted once", t, func() {
+		store, _ := newSQLiteReplayStore(t)
+
+		fresh, err := store.CheckAndSet("transaction", now, now.Add(time.Minute))
+		So(err, ShouldBeNil)
+		So(fresh, ShouldBeTrue)
+
+		fresh, err = store.CheckAndSet("transaction", now.Add(time.Second), now.Add(time.Minute))
+		So(err, ShouldBeNil)
+		So(fresh, ShouldBeFalse)
+
+		fresh, err = store.CheckAndSet("other", now, now.Add(time.Minute))
+		So(err, ShouldBeNil)
+		So(fresh, ShouldBeTrue)
+	})
+
+	Convey("Expired transactions are accepted again", t, func() {
+		store, _ := newSQLiteReplayStore(t)
+		store.CheckAndSet("expiring", now, now.Add(time.Minute))
+
+		fresh, err := store.CheckAndSet("expiring", now.Add(time.Minute), now.Add(2*time.Minute))
+
+		So(err, ShouldBeNil)
+		So(fresh, ShouldBeTrue)
+	})
+
+	Convey("Concurrent submissions are only accepted once", t, func() {
+		store, _ := newSQLiteReplayStore(t)
+		accepted := int32(0)
+		wg := sync.WaitGroup{}
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if fresh, err := store.CheckAndSet("concurrent", now, now.Add(time.Minute)); err == nil && fresh {
+					atomic.AddInt32(&accepted, 1)
+				}
+			}()
+		}
+		wg.Wait()
+
+		So(accepted, ShouldEqual, 1)
+	})
+
+	Convey("Tables are created once", t, func() {
+		store, _ := newSQLiteReplayStore(t)
+
+		So(store.CreateTable(), ShouldBeNil)
+	})
+
+	Convey("Expired transactions are purged", t, func() {
+		store, _ := newSQLiteReplayStore(t)
+		store.CheckAndSet("expired", now, now.Add(time.Minute))
+		store.CheckAndSet("valid", now, now.Add(time.Hour))
+
+		n, err := store.Purge(now.Add(time.Minute))
+
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 1)
+	})
+
+	Convey("Database errors are reported", t, func() {
+		store, db := newSQLiteReplayStore(t)
+		db.Close()
+
+		_, err := store.CheckAndSet("transaction", now, now.Add(time.Minute))
+
+		So(err, ShouldNotBeNil)
+	})
+}
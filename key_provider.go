@@ -0,0 +1,73 @@
+package applepay
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+type (
+	// KeyProvider performs the operations requiring the private key of a
+	// Payment Processing Certificate, so that the key itself may be kept
+	// outside of the process memory, e.g. in a KMS or an HSM
+	KeyProvider interface {
+		// Decrypt unwraps the symmetric key of RSA_v1 tokens, using
+		// RSA-OAEP with the options given by the caller
+		crypto.Decrypter
+
+		// ECDH computes the shared secret between the private key and the
+		// ephemeral P-256 public key of EC_v1 tokens. The secret is the
+		// 32-byte X coordinate of the shared point, leading zeros included.
+		ECDH(pub *ecdh.PublicKey) ([]byte, error)
+	}
+
+	// MemoryKeyProvider is a KeyProvider using a private key held in memory
+	MemoryKeyProvider struct {
+		key crypto.Signer
+		// ecdhKey is the crypto/ecdh form of EC keys
+		ecdhKey *ecdh.PrivateKey
+	}
+)
+
+// NewMemoryKeyProvider creates a KeyProvider from an ECDSA or RSA private key
+func NewMemoryKeyProvider(key crypto.PrivateKey) (*MemoryKeyProvider, error) {
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		ecdhKey, err := k.ECDH()
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid EC processing key")
+		}
+		return &MemoryKeyProvider{key: k, ecdhKey: ecdhKey}, nil
+	case *rsa.PrivateKey:
+		return &MemoryKeyProvider{key: k}, nil
+	}
+	return nil, errors.New("unsupported processing key type")
+}
+
+// Public implements crypto.Decrypter
+func (p *MemoryKeyProvider) Public() crypto.PublicKey {
+	return p.key.Public()
+}
+
+// Decrypt implements crypto.Decrypter
+func (p *MemoryKeyProvider) Decrypt(rand io.Reader, ciphertext []byte,
+	opts crypto.DecrypterOpts) ([]byte, error) {
+
+	priv, ok := p.key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("processing key is not RSA")
+	}
+	return priv.Decrypt(rand, ciphertext, opts)
+}
+
+// ECDH implements KeyProvider
+func (p *MemoryKeyProvider) ECDH(pub *ecdh.PublicKey) ([]byte, error) {
+	if p.ecdhKey == nil {
+		return nil, errors.New("non-elliptic processing private key")
+	}
+	return ecdheSharedSecret(pub, p.ecdhKey)
+}
@@ -0,0 +1,137 @@
+package applepay
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// countingKeyProvider is a KeyProvider counting the ECDH operations, standing
+// for an external key store
+type countingKeyProvider struct {
+	*MemoryKeyProvider
+	ecdhCalls int
+}
+
+func (p *countingKeyProvider) ECDH(pub *ecdh.PublicKey) ([]byte, error) {
+	p.ecdhCalls++
+	return p.MemoryKeyProvider.ECDH(pub)
+}
+
+func TestNewMemoryKeyProvider(t *testing.T) {
+	Convey("Unsupported keys are rejected", t, func() {
+		p, err := NewMemoryKeyProvider("not a key")
+
+		Convey("p should be nil", func() {
+			So(p, ShouldBeNil)
+		})
+
+		Convey("err should be correct", func() {
+			So(err.Error(), ShouldEqual, "unsupported processing key type")
+		})
+	})
+
+	Convey("EC keys compute ECDH shared secrets", t, func() {
+		priv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		ephemeral, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		p, _ := NewMemoryKeyProvider(priv)
+
+		ephemeralPub, _ := ephemeral.PublicKey.ECDH()
+		privPub, _ := priv.PublicKey.ECDH()
+
+		secret, err := p.ECDH(ephemeralPub)
+		expected, _ := NewMemoryKeyProvider(ephemeral)
+		expectedSecret, _ := expected.ECDH(privPub)
+
+		Convey("secret should be correct", func() {
+			So(secret, ShouldHaveLength, 32)
+			So(secret, ShouldResemble, expectedSecret)
+		})
+
+		Convey("err should be nil", func() {
+			So(err, ShouldBeNil)
+		})
+
+		Convey("RSA decryption is not supported", func() {
+			_, err := p.Decrypt(rand.Reader, []byte("ciphertext"), nil)
+			So(err.Error(), ShouldEqual, "processing key is not RSA")
+		})
+	})
+
+	Convey("RSA keys unwrap OAEP-encrypted keys", t, func() {
+		priv, _ := rsa.GenerateKey(rand.Reader, 2048)
+		p, _ := NewMemoryKeyProvider(priv)
+		ciphertext, _ := rsa.EncryptOAEP(sha256.New(), rand.Reader, &priv.PublicKey, []byte("symmetric key"), nil)
+
+		plaintext, err := p.Decrypt(rand.Reader, ciphertext, &rsa.OAEPOptions{Hash: crypto.SHA256})
+
+		Convey("plaintext should be correct", func() {
+			So(string(plaintext), ShouldEqual, "symmetric key")
+		})
+
+		Convey("err should be nil", func() {
+			So(err, ShouldBeNil)
+		})
+
+		Convey("ECDH is not supported", func() {
+			ephemeral, _ := ecdh.P256().GenerateKey(rand.Reader)
+			_, err := p.ECDH(ephemeral.PublicKey())
+			So(err.Error(), ShouldEqual, "non-elliptic processing private key")
+		})
+	})
+}
+
+func TestProcessingKeyProvider(t *testing.T) {
+	merchantID := "merchant.com.processout.test"
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	cert := testCertificate(merchantID, key)
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+
+	Convey("Providers must hold the certificate's key", t, func() {
+		otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		provider, _ := NewMemoryKeyProvider(otherKey)
+
+		m, err := New(merchantID, ProcessingKeyProvider(leaf, provider))
+
+		Convey("m should be nil", func() {
+			So(m, ShouldBeNil)
+		})
+
+		Convey("err should be correct", func() {
+			So(err.Error(), ShouldEqual, "the key provider does not match the certificate")
+		})
+	})
+
+	Convey("External providers are used to compute encryption keys", t, func() {
+		memoryProvider, _ := NewMemoryKeyProvider(key)
+		provider := &countingKeyProvider{MemoryKeyProvider: memoryProvider}
+		m, err := New(merchantID, ProcessingKeyProvider(leaf, provider))
+		So(err, ShouldBeNil)
+
+		ephemeral, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		token := &PKPaymentToken{}
+		token.PaymentData.Header.EphemeralPublicKey, _ = x509.MarshalPKIXPublicKey(&ephemeral.PublicKey)
+		token.PaymentData.Header.PublicKeyHash, _ = publicKeyHash(cert)
+
+		processingKey, err := m.keys().processingKey(token)
+		So(err, ShouldBeNil)
+		encryptionKey, err := computeEncryptionKey(processingKey, token, m.identifierHash())
+
+		Convey("the provider should be used", func() {
+			So(provider.ecdhCalls, ShouldEqual, 1)
+		})
+
+		Convey("the encryption key should be computed", func() {
+			So(encryptionKey, ShouldHaveLength, 32)
+			So(err, ShouldBeNil)
+		})
+	})
+}
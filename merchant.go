@@ -2,10 +2,15 @@ package applepay
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"net/http"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -17,14 +22,56 @@ type (
 		displayName string
 		domainName  string
 
+		// verificationPolicy is used to verify tokens, the default policy if
+		// nil
+		verificationPolicy *VerificationPolicy
+		// requestTimeout is the timeout of session requests, requestTimeout
+		// if zero
+		requestTimeout time.Duration
+		// replayStore records the transactions decrypted, replays are not
+		// checked if nil
+		replayStore ReplayStore
+		// env is the environment of the merchant, production if nil
+		env *Environment
+		// retryPolicy retries the session requests, which are sent once if
+		// zero
+		retryPolicy RetryPolicy
+		// circuitBreaker stops the session requests to failing gateways, if
+		// not nil
+		circuitBreaker *CircuitBreaker
+		// transportConfig configures transport
+		transportConfig transportConfig
+		// transport sends the requests made to Apple, shared by all the
+		// calls to reuse connections
+		transport http.RoundTripper
+
+		// Certificates, holding a *keyPairs swapped atomically on reload
+		keyPairs *atomic.Value
+		// certificateOptions are the options loading certificates used to
+		// create the merchant, applied again on reload
+		certificateOptions []func(*Merchant) error
+		// loadingCertificates is set while a certificate option is applied
+		loadingCertificates bool
+		// certificateFiles lists the files the certificates are loaded from
+		certificateFiles []string
+	}
+
+	// keyPairs holds the certificates of a merchant. It is never modified
+	// once stored, so that all calls see a consistent set of certificates.
+	keyPairs struct {
 		// Merchant Identity Certificate
 		merchantCertificate *tls.Certificate
-		// Payment Processing Certificate
-		processingCertificate *tls.Certificate
+		// Payment Processing Certificates' keys, indexed by the SHA-256 hash
+		// of their public key
+		processingKeys map[string]KeyProvider
 	}
 )
 
 var (
+	// keysGeneration counts the certificate changes of all the merchants, so
+	// that registries only look for reloads after one happened
+	keysGeneration uint64
+
 	// merchantIDHashOID is the ASN.1 object identifier of Apple's extension
 	// for merchant ID hash in merchant/processing certificates
 	merchantIDHashOID = mustParseASN1ObjectIdentifier(
@@ -35,19 +82,75 @@ var (
 // New creates an instance of Merchant using the given configuration
 func New(merchantID string, options ...func(*Merchant) error) (*Merchant, error) {
 	if !strings.HasPrefix(merchantID, "merchant.") {
-		return nil, errors.New("merchant ID should start with `merchant.`")
+		return nil, newError(
+			CodeInvalidConfiguration,
+			errors.New("merchant ID should start with `merchant.`"),
+		)
 	}
 
-	m := &Merchant{identifier: merchantID}
+	m := &Merchant{
+		identifier: merchantID,
+		keyPairs:   &atomic.Value{},
+	}
 	for _, option := range options {
 		err := option(m)
 		if err != nil {
-			return nil, err
+			return nil, withDefaultCode(CodeInvalidConfiguration, err)
 		}
 	}
+	m.transport = m.newTransport()
 	return m, nil
 }
 
+// keys returns the current certificates of the merchant
+func (m Merchant) keys() *keyPairs {
+	if m.keyPairs == nil {
+		return &keyPairs{}
+	}
+	kp, _ := m.keyPairs.Load().(*keyPairs)
+	if kp == nil {
+		return &keyPairs{}
+	}
+	return kp
+}
+
+// storeKeys replaces the certificates of the merchant. Idle connections to
+// Apple are closed, as they are authenticated with the previous merchant
+// certificate.
+func (m *Merchant) storeKeys(kp *keyPairs) {
+	if m.keyPairs == nil {
+		m.keyPairs = &atomic.Value{}
+	}
+	m.keyPairs.Store(kp)
+	atomic.AddUint64(&keysGeneration, 1)
+
+	if t, ok := m.transport.(interface{ CloseIdleConnections() }); ok {
+		t.CloseIdleConnections()
+	}
+}
+
+// updateKeys stores a copy of the merchant's certificates modified by update
+func (m *Merchant) updateKeys(update func(*keyPairs)) {
+	current := m.keys()
+	kp := &keyPairs{
+		merchantCertificate: current.merchantCertificate,
+		processingKeys: make(
+			map[string]KeyProvider,
+			len(current.processingKeys),
+		),
+	}
+	for keyHash, key := range current.processingKeys {
+		kp.processingKeys[keyHash] = key
+	}
+	update(kp)
+	m.storeKeys(kp)
+}
+
+// Identifier returns the merchant ID
+func (m Merchant) Identifier() string {
+	return m.identifier
+}
+
 // identifierHash hashes m.config.MerchantIdentifier with SHA-256
 func (m *Merchant) identifierHash() []byte {
 	h := sha256.New()
@@ -69,47 +172,188 @@ func MerchantDomainName(domainName string) func(*Merchant) error {
 	}
 }
 
-func MerchantCertificate(cert tls.Certificate) func(*Merchant) error {
+// MerchantRequestTimeout sets the timeout of the requests made to Apple,
+// 30 seconds by default. Retried session requests are bounded by it as a
+// whole, unless their context has a deadline.
+func MerchantRequestTimeout(timeout time.Duration) func(*Merchant) error {
 	return func(m *Merchant) error {
+		if timeout <= 0 {
+			return newError(
+				CodeInvalidConfiguration,
+				errors.New("the request timeout should be positive"),
+			)
+		}
+		m.requestTimeout = timeout
+		return nil
+	}
+}
+
+func MerchantCertificate(cert tls.Certificate) func(*Merchant) error {
+	return CertificateOption(func(m *Merchant) error {
 		// Check that the certificate is RSA
 		if _, ok := cert.PrivateKey.(*rsa.PrivateKey); !ok {
-			return errors.New("merchant key should be RSA")
+			return newError(
+				CodeInvalidCertificate,
+				errors.New("merchant key should be RSA"),
+			)
 		}
+		return m.setMerchantCertificate(cert)
+	})
+}
+
+// MerchantCertificateSigner sets a Merchant Identity Certificate whose private
+// key operations are done by signer, e.g. for keys stored in a KMS. chain
+// starts with the merchant certificate. The signer's public key must be RSA;
+// it must support PSS signatures to be used with TLS 1.3.
+func MerchantCertificateSigner(chain []*x509.Certificate,
+	signer crypto.Signer) func(*Merchant) error {
 
-		if err := checkValidity(cert); err != nil {
-			return errors.Wrap(err, "invalid certificate")
+	return CertificateOption(func(m *Merchant) error {
+		if len(chain) == 0 {
+			return newError(
+				CodeInvalidConfiguration,
+				errors.New("empty certificate chain"),
+			)
+		}
+		if signer == nil {
+			return newError(CodeInvalidConfiguration, errors.New("nil signer"))
 		}
 
-		// Verify merchant ID
-		hash, err := extractMerchantHash(cert)
-		if err != nil {
-			return errors.Wrap(err, "error reading the certificate")
+		// Check that the signer holds the RSA key of the certificate
+		pub, ok := signer.Public().(*rsa.PublicKey)
+		if !ok {
+			return newError(
+				CodeInvalidCertificate,
+				errors.New("merchant key should be RSA"),
+			)
 		}
-		if !bytes.Equal(hash, m.identifierHash()) {
-			return errors.New("invalid merchant certificate or merchant ID")
+		if !pub.Equal(chain[0].PublicKey) {
+			return newError(
+				CodeInvalidCertificate,
+				errors.New("the signer does not match the certificate"),
+			)
 		}
-		m.merchantCertificate = &cert
-		return nil
+
+		cert := tls.Certificate{PrivateKey: signer, Leaf: chain[0]}
+		for _, c := range chain {
+			cert.Certificate = append(cert.Certificate, c.Raw)
+		}
+		return m.setMerchantCertificate(cert)
+	})
+}
+
+// setMerchantCertificate checks the Merchant Identity Certificate and sets it
+func (m *Merchant) setMerchantCertificate(cert tls.Certificate) error {
+	if err := checkValidity(cert); err != nil {
+		return newError(
+			CodeInvalidCertificate,
+			errors.Wrap(err, "invalid certificate"),
+		)
 	}
+
+	// Verify merchant ID
+	hash, err := extractMerchantHash(cert)
+	if err != nil {
+		return newError(
+			CodeInvalidCertificate,
+			errors.Wrap(err, "error reading the certificate"),
+		)
+	}
+	if !bytes.Equal(hash, m.identifierHash()) {
+		return newError(
+			CodeInvalidCertificate,
+			errors.New("invalid merchant certificate or merchant ID"),
+		)
+	}
+	m.updateKeys(func(kp *keyPairs) {
+		kp.merchantCertificate = &cert
+	})
+	return nil
 }
 
+// ProcessingCertificate adds a Payment Processing Certificate to the merchant.
+// It can be used several times, e.g. while rotating certificates: tokens are
+// then decrypted with the certificate matching their public key hash.
 func ProcessingCertificate(cert tls.Certificate) func(*Merchant) error {
-	return func(m *Merchant) error {
-		if err := checkValidity(cert); err != nil {
-			return errors.Wrap(err, "invalid certificate")
+	return CertificateOption(func(m *Merchant) error {
+		leaf, err := parseLeaf(cert)
+		if err != nil {
+			return newError(
+				CodeInvalidCertificate,
+				errors.Wrap(err, "invalid certificate"),
+			)
+		}
+		provider, err := NewMemoryKeyProvider(cert.PrivateKey)
+		if err != nil {
+			return newError(
+				CodeInvalidCertificate,
+				errors.Wrap(err, "invalid processing key"),
+			)
+		}
+		return ProcessingKeyProvider(leaf, provider)(m)
+	})
+}
+
+// ProcessingKeyProvider adds a Payment Processing Certificate whose private key
+// operations are done by provider. Like ProcessingCertificate, it can be used
+// several times.
+func ProcessingKeyProvider(cert *x509.Certificate,
+	provider KeyProvider) func(*Merchant) error {
+
+	return CertificateOption(func(m *Merchant) error {
+		if cert == nil {
+			return newError(CodeInvalidConfiguration, errors.New("nil certificate"))
+		}
+		if provider == nil {
+			return newError(CodeInvalidConfiguration, errors.New("nil key provider"))
+		}
+
+		// Check that the provider holds the certificate's key
+		pub, ok := provider.Public().(interface {
+			Equal(crypto.PublicKey) bool
+		})
+		if !ok || !pub.Equal(cert.PublicKey) {
+			return newError(
+				CodeInvalidCertificate,
+				errors.New("the key provider does not match the certificate"),
+			)
+		}
+
+		chain := tls.Certificate{Certificate: [][]byte{cert.Raw}}
+		if err := checkValidity(chain); err != nil {
+			return newError(
+				CodeInvalidCertificate,
+				errors.Wrap(err, "invalid certificate"),
+			)
 		}
 
 		// Verify merchant ID
-		hash, err := extractMerchantHash(cert)
+		hash, err := extractMerchantHash(chain)
 		if err != nil {
-			return errors.Wrap(err, "error reading the certificate")
+			return newError(
+				CodeInvalidCertificate,
+				errors.Wrap(err, "error reading the certificate"),
+			)
 		}
 		if !bytes.Equal(hash, m.identifierHash()) {
-			return errors.New("invalid processing certificate or merchant ID")
+			return newError(
+				CodeInvalidCertificate,
+				errors.New("invalid processing certificate or merchant ID"),
+			)
+		}
+
+		keyHash, err := publicKeyHash(chain)
+		if err != nil {
+			return newError(
+				CodeInvalidCertificate,
+				errors.Wrap(err, "error hashing the public key"),
+			)
 		}
-		m.processingCertificate = &cert
+		m.updateKeys(func(kp *keyPairs) {
+			kp.processingKeys[string(keyHash)] = provider
+		})
 		return nil
-	}
+	})
 }
 
 func MerchantCertificateLocation(certLocation,
@@ -128,11 +372,15 @@ func loadCertificate(certLocation, keyLocation string,
 	callback func(tls.Certificate) func(*Merchant) error) func(
 	*Merchant) error {
 
-	return func(m *Merchant) error {
+	return CertificateOption(func(m *Merchant) error {
+		m.certificateFiles = append(m.certificateFiles, certLocation, keyLocation)
 		cert, err := tls.LoadX509KeyPair(certLocation, keyLocation)
 		if err != nil {
-			return errors.Wrap(err, "error loading the certificate")
+			return newError(
+				CodeInvalidCertificate,
+				errors.Wrap(err, "error loading the certificate"),
+			)
 		}
 		return callback(cert)(m)
-	}
+	})
 }
@@ -0,0 +1,121 @@
+package applepay
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type (
+	// MerchantSession is the session returned by Apple, to be given as is
+	// to completeMerchantValidation
+	MerchantSession struct {
+		// EpochTimestamp is the creation time of the session, in milliseconds
+		EpochTimestamp int64 `json:"epochTimestamp"`
+		// ExpiresAt is the expiration time of the session, in milliseconds
+		ExpiresAt                 int64  `json:"expiresAt"`
+		MerchantSessionIdentifier string `json:"merchantSessionIdentifier"`
+		Nonce                     string `json:"nonce"`
+		MerchantIdentifier        string `json:"merchantIdentifier"`
+		DisplayName               string `json:"displayName"`
+		Signature                 string `json:"signature"`
+
+		// Raw is the body of Apple's response
+		Raw []byte `json:"-"`
+	}
+
+	// sessionErrorResponse is the body of Apple's error responses
+	sessionErrorResponse struct {
+		StatusMessage string `json:"statusMessage"`
+	}
+)
+
+const (
+	// maxSessionResponseSize bounds the size of the responses of Apple
+	maxSessionResponseSize = 1 << 20
+)
+
+// CreatedAt returns the creation time of the session
+func (s MerchantSession) CreatedAt() time.Time {
+	return time.UnixMilli(s.EpochTimestamp)
+}
+
+// Expiry returns the expiration time of the session
+func (s MerchantSession) Expiry() time.Time {
+	return time.UnixMilli(s.ExpiresAt)
+}
+
+// parseSessionResponse reads the merchant session of res, or the error
+// returned by Apple. The session must not be expired at now.
+func parseSessionResponse(res *http.Response, now time.Time) (*MerchantSession, error) {
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxSessionResponseSize+1))
+	if err != nil {
+		return nil, newError(
+			CodeGateway,
+			errors.Wrap(err, "error reading the response"),
+		)
+	}
+	if len(body) > maxSessionResponseSize {
+		return nil, newError(
+			CodeInvalidSession,
+			errors.New("the session response is too large"),
+		)
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		errorResponse := sessionErrorResponse{}
+		json.Unmarshal(body, &errorResponse)
+		return nil, &SessionError{
+			StatusCode:    res.StatusCode,
+			StatusMessage: errorResponse.StatusMessage,
+		}
+	}
+
+	session := &MerchantSession{}
+	if err := json.Unmarshal(body, session); err != nil {
+		return nil, newError(
+			CodeInvalidSession,
+			errors.Wrap(err, "error parsing the session"),
+		)
+	}
+	session.Raw = body
+	if err := session.check(now); err != nil {
+		return nil, newError(CodeInvalidSession, err)
+	}
+	return session, nil
+}
+
+// check runs sanity checks on the session
+func (s MerchantSession) check(now time.Time) error {
+	var missing []string
+	for _, field := range []struct{ name, value string }{
+		{"merchantSessionIdentifier", s.MerchantSessionIdentifier},
+		{"nonce", s.Nonce},
+		{"signature", s.Signature},
+	} {
+		if field.value == "" {
+			missing = append(missing, field.name)
+		}
+	}
+	if len(missing) > 0 {
+		return errors.Errorf("the session has no %s", strings.Join(missing, ", "))
+	}
+
+	if s.ExpiresAt <= s.EpochTimestamp {
+		return errors.Errorf(
+			"the session expires at %s, before its creation at %s",
+			s.Expiry().UTC(), s.CreatedAt().UTC(),
+		)
+	}
+	if !s.Expiry().After(now) {
+		return errors.Errorf("the session expired at %s", s.Expiry().UTC())
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package applepay
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// sessionResponse returns a response of Apple with status and body
+func sessionResponse(status int, body string) *http.Response {
+	rec := httptest.NewRecorder()
+	rec.WriteHeader(status)
+	rec.WriteString(body)
+	return rec.Result()
+}
+
+func TestParseSessionResponse(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	validSession := `{"epochTimestamp":1700000000000,"expiresAt":1700003600000,"merchantSessionIdentifier":"SSH1","nonce":"abcd","merchantIdentifier":"58D2","displayName":"Store","signature":"3080","operationalAnalyticsIdentifier":"Store:58D2","retries":0}`
+
+	Convey("Sessions are parsed", t, func() {
+		session, err := parseSessionResponse(sessionResponse(http.StatusOK, validSession), now)
+
+		So(err, ShouldBeNil)
+		So(session, ShouldResemble, &MerchantSession{
+			EpochTimestamp:            1700000000000,
+			ExpiresAt:                 1700003600000,
+			MerchantSessionIdentifier: "SSH1",
+			Nonce:                     "abcd",
+			MerchantIdentifier:        "58D2",
+			DisplayName:               "Store",
+			Signature:                 "3080",
+			Raw:                       []byte(validSession),
+		})
+		So(session.CreatedAt().Equal(now), ShouldBeTrue)
+		So(session.Expiry().Equal(now.Add(time.Hour)), ShouldBeTrue)
+	})
+
+	Convey("Error statuses are returned with Apple's message", t, func() {
+		_, err := parseSessionResponse(sessionResponse(
+			http.StatusBadRequest,
+			`{"statusMessage":"Payment Services Exception merchantId=58D2 not registered for domain=example.com","statusCode":"400"}`,
+		), now)
+
+		So(errors.Is(err, ErrSessionRejected), ShouldBeTrue)
+		var sessionErr *SessionError
+		So(errors.As(err, &sessionErr), ShouldBeTrue)
+		So(sessionErr.StatusCode, ShouldEqual, http.StatusBadRequest)
+		So(sessionErr.StatusMessage, ShouldEqual, "Payment Services Exception merchantId=58D2 not registered for domain=example.com")
+		So(err.Error(), ShouldEqual, "Apple rejected the session request with status 400: Payment Services Exception merchantId=58D2 not registered for domain=example.com")
+	})
+
+	Convey("Error statuses without message use the status text", t, func() {
+		_, err := parseSessionResponse(sessionResponse(http.StatusServiceUnavailable, "<html></html>"), now)
+
+		So(err.Error(), ShouldEqual, "Apple rejected the session request with status 503: Service Unavailable")
+	})
+
+	Convey("Invalid sessions are rejected", t, func() {
+		for body, message := range map[string]string{
+			"not json": "error parsing the session",
+			`{"epochTimestamp":1700000000000,"expiresAt":1700003600000}`:                                                                      "the session has no merchantSessionIdentifier, nonce, signature",
+			`{"epochTimestamp":1700000000000,"expiresAt":1700000000000,"merchantSessionIdentifier":"SSH1","nonce":"abcd","signature":"3080"}`: "the session expires at 2023-11-14 22:13:20 +0000 UTC, before its creation at 2023-11-14 22:13:20 +0000 UTC",
+			`{"epochTimestamp":1600000000000,"expiresAt":1600003600000,"merchantSessionIdentifier":"SSH1","nonce":"abcd","signature":"3080"}`: "the session expired at 2020-09-13 13:26:40 +0000 UTC",
+		} {
+			_, err := parseSessionResponse(sessionResponse(http.StatusOK, body), now)
+
+			So(errors.Is(err, ErrInvalidSession), ShouldBeTrue)
+			So(err.Error(), ShouldStartWith, message)
+		}
+	})
+
+	Convey("Large responses are rejected", t, func() {
+		large := make([]byte, maxSessionResponseSize+1)
+		_, err := parseSessionResponse(sessionResponse(http.StatusOK, string(large)), now)
+
+		So(errors.Is(err, ErrInvalidSession), ShouldBeTrue)
+	})
+}
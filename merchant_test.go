@@ -1,10 +1,25 @@
 package applepay
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"sync/atomic"
 	"testing"
-
-	"crypto/tls"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -19,6 +34,7 @@ func TestNew(t *testing.T) {
 
 		Convey("err should be correct", func() {
 			So(err.Error(), ShouldStartWith, "merchant ID should start with")
+			So(errors.Is(err, ErrInvalidConfiguration), ShouldBeTrue)
 		})
 	})
 
@@ -123,6 +139,7 @@ func TestMerchantCertificates(t *testing.T) {
 
 		Convey("err should be correct", func() {
 			So(err.Error(), ShouldStartWith, "invalid merchant certificate or merchant ID")
+			So(errors.Is(err, ErrInvalidCertificate), ShouldBeTrue)
 		})
 	})
 
@@ -138,7 +155,7 @@ func TestMerchantCertificates(t *testing.T) {
 		})
 
 		Convey("merchantCertificate should not be empty", func() {
-			So(m.merchantCertificate, ShouldNotResemble, tls.Certificate{})
+			So(m.keys().merchantCertificate, ShouldNotBeNil)
 		})
 	})
 }
@@ -176,7 +193,177 @@ func TestProcessingCertificates(t *testing.T) {
 		})
 
 		Convey("merchantCertificate should not be empty", func() {
-			So(m.merchantCertificate, ShouldNotResemble, tls.Certificate{})
+			So(m.keys().merchantCertificate, ShouldNotBeNil)
+		})
+	})
+}
+
+// testCertificate generates a certificate for the given merchant ID, as Apple
+// would sign it, using key
+func testCertificate(merchantID string, key crypto.Signer) tls.Certificate {
+	merchantIDHash := sha256.Sum256([]byte(merchantID))
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(0),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtraExtensions: []pkix.Extension{
+			{
+				Id:    merchantIDHashOID,
+				Value: []byte("@." + hex.EncodeToString(merchantIDHash[:])),
+			},
+		},
+	}
+	cert, _ := x509.CreateCertificate(rand.Reader, tpl, tpl, key.Public(), key)
+	return tls.Certificate{Certificate: [][]byte{cert}, PrivateKey: key}
+}
+
+func TestProcessingCertificateKeyring(t *testing.T) {
+	merchantID := "merchant.com.processout.test"
+	key1, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	key2, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	cert1 := testCertificate(merchantID, key1)
+	cert2 := testCertificate(merchantID, key2)
+
+	Convey("Several processing certificates can be used at once", t, func() {
+		m, err := New(
+			merchantID,
+			ProcessingCertificate(cert1),
+			ProcessingCertificate(cert2),
+		)
+
+		Convey("err should be nil", func() {
+			So(err, ShouldBeNil)
+		})
+
+		Convey("certificates are indexed by public key hash", func() {
+			hash1, _ := publicKeyHash(cert1)
+			hash2, _ := publicKeyHash(cert2)
+
+			So(m.keys().processingKeys, ShouldHaveLength, 2)
+			So(m.keys().processingKeys[string(hash1)].Public(), ShouldResemble, key1.Public())
+			So(m.keys().processingKeys[string(hash2)].Public(), ShouldResemble, key2.Public())
+		})
+	})
+
+	Convey("The certificate matching the token is selected", t, func() {
+		m, _ := New(
+			merchantID,
+			ProcessingCertificate(cert1),
+			ProcessingCertificate(cert2),
+		)
+		hash2, _ := publicKeyHash(cert2)
+		token := &PKPaymentToken{}
+		token.PaymentData.Header.PublicKeyHash = hash2
+
+		key, err := m.keys().processingKey(token)
+
+		Convey("key should be correct", func() {
+			So(key.Public(), ShouldResemble, key2.Public())
+		})
+
+		Convey("err should be nil", func() {
+			So(err, ShouldBeNil)
+		})
+	})
+
+	Convey("Tokens for unknown keys are rejected", t, func() {
+		m, _ := New(merchantID, ProcessingCertificate(cert1))
+		token := &PKPaymentToken{}
+		token.PaymentData.Header.PublicKeyHash = []byte("unknown")
+
+		key, err := m.keys().processingKey(token)
+
+		Convey("key should be nil", func() {
+			So(key, ShouldBeNil)
+		})
+
+		Convey("err should be correct", func() {
+			So(err.Error(), ShouldStartWith, "no processing certificate matches the public key hash")
+		})
+	})
+}
+
+// countingSigner is a crypto.Signer counting signatures, standing for a key
+// stored in a KMS
+type countingSigner struct {
+	crypto.Signer
+	calls int32
+}
+
+func (s *countingSigner) Sign(rand io.Reader, digest []byte,
+	opts crypto.SignerOpts) ([]byte, error) {
+
+	atomic.AddInt32(&s.calls, 1)
+	return s.Signer.Sign(rand, digest, opts)
+}
+
+func TestMerchantCertificateSigner(t *testing.T) {
+	merchantID := "merchant.com.processout.test"
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	cert := testCertificate(merchantID, key)
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+
+	Convey("Non-RSA signers are rejected", t, func() {
+		ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		err := MerchantCertificateSigner(
+			[]*x509.Certificate{leaf},
+			ecKey,
+		)(&Merchant{identifier: merchantID})
+
+		So(err.Error(), ShouldEqual, "merchant key should be RSA")
+	})
+
+	Convey("Signers must hold the certificate's key", t, func() {
+		otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+		err := MerchantCertificateSigner(
+			[]*x509.Certificate{leaf},
+			otherKey,
+		)(&Merchant{identifier: merchantID})
+
+		So(err.Error(), ShouldEqual, "the signer does not match the certificate")
+		So(errors.Is(err, ErrInvalidCertificate), ShouldBeTrue)
+	})
+
+	Convey("Merchant ID must be correct", t, func() {
+		err := MerchantCertificateSigner(
+			[]*x509.Certificate{leaf},
+			&countingSigner{Signer: key},
+		)(&Merchant{identifier: "merchant.com.processout.test.incorrect"})
+
+		So(err.Error(), ShouldEqual, "invalid merchant certificate or merchant ID")
+		So(errors.Is(err, ErrInvalidCertificate), ShouldBeTrue)
+	})
+
+	Convey("The signer authenticates session requests", t, func() {
+		signer := &countingSigner{Signer: key}
+		m, err := New(
+			merchantID,
+			MerchantCertificateSigner([]*x509.Certificate{leaf}, signer),
+		)
+		So(err, ShouldBeNil)
+
+		server := httptest.NewUnstartedServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("{}"))
+			},
+		))
+		server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+		server.StartTLS()
+		defer server.Close()
+
+		cl := m.authenticatedClient()
+		roots := x509.NewCertPool()
+		roots.AddCert(server.Certificate())
+		cl.Transport.(*http.Transport).TLSClientConfig.RootCAs = roots
+		res, err := cl.Get(server.URL)
+
+		Convey("the request should succeed", func() {
+			So(err, ShouldBeNil)
+			So(res.StatusCode, ShouldEqual, http.StatusOK)
+		})
+
+		Convey("the signer should be used", func() {
+			So(atomic.LoadInt32(&signer.calls), ShouldBeGreaterThan, 0)
 		})
 	})
 }
@@ -0,0 +1,300 @@
+/*
+Package pkcs11 keeps Apple Pay processing keys in a PKCS#11 token, such as an
+HSM, so that they never enter the process memory.
+
+The EC_v1 key agreement (CKM_ECDH1_DERIVE) and the RSA_v1 key unwrapping
+(CKM_RSA_PKCS_OAEP) are done inside the token.
+
+Sample usage:
+
+	module, err := pkcs11.Open(pkcs11.Config{
+		Module:     "/usr/lib/softhsm/libsofthsm2.so",
+		TokenLabel: "applepay",
+		PIN:        "1234",
+	})
+	defer module.Close()
+
+	ap, err := applepay.New(
+		"merchant.com.processout.test",
+		pkcs11.ProcessingCertificateLocation(module, "cert-processing.crt", "processing-key"),
+	)
+*/
+package pkcs11
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	p11 "github.com/miekg/pkcs11"
+	"github.com/pkg/errors"
+	"github.com/processout/applepay"
+)
+
+type (
+	// Config describes how to reach the token holding the processing keys
+	Config struct {
+		// Module is the path to the PKCS#11 library
+		Module string
+		// TokenLabel is the label of the token holding the keys
+		TokenLabel string
+		// PIN is the user PIN of the token
+		PIN string
+	}
+
+	// Module is an open session on a PKCS#11 token
+	Module struct {
+		ctx     *p11.Ctx
+		session p11.SessionHandle
+		// mu serializes the operations, as sessions cannot be used
+		// concurrently
+		mu sync.Mutex
+	}
+
+	// Key is a private key stored in a PKCS#11 token. It implements
+	// applepay.KeyProvider.
+	Key struct {
+		module *Module
+		handle p11.ObjectHandle
+		public crypto.PublicKey
+	}
+)
+
+// Open loads the PKCS#11 library and logs into the token
+func Open(config Config) (*Module, error) {
+	ctx := p11.New(config.Module)
+	if ctx == nil {
+		return nil, errors.Errorf("error loading the module %s", config.Module)
+	}
+
+	err := ctx.Initialize()
+	if err != nil && err != p11.Error(p11.CKR_CRYPTOKI_ALREADY_INITIALIZED) {
+		ctx.Destroy()
+		return nil, errors.Wrap(err, "error initializing the module")
+	}
+
+	slot, err := findSlot(ctx, config.TokenLabel)
+	if err != nil {
+		ctx.Destroy()
+		return nil, err
+	}
+	session, err := ctx.OpenSession(slot, p11.CKF_SERIAL_SESSION)
+	if err != nil {
+		ctx.Destroy()
+		return nil, errors.Wrap(err, "error opening the session")
+	}
+	err = ctx.Login(session, p11.CKU_USER, config.PIN)
+	if err != nil && err != p11.Error(p11.CKR_USER_ALREADY_LOGGED_IN) {
+		ctx.CloseSession(session)
+		ctx.Destroy()
+		return nil, errors.Wrap(err, "error logging in")
+	}
+
+	return &Module{ctx: ctx, session: session}, nil
+}
+
+// findSlot returns the slot of the token with the given label
+func findSlot(ctx *p11.Ctx, tokenLabel string) (uint, error) {
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return 0, errors.Wrap(err, "error listing the slots")
+	}
+	for _, slot := range slots {
+		info, err := ctx.GetTokenInfo(slot)
+		if err != nil {
+			return 0, errors.Wrap(err, "error reading the token information")
+		}
+		if info.Label == tokenLabel {
+			return slot, nil
+		}
+	}
+	return 0, errors.Errorf("token %s not found", tokenLabel)
+}
+
+// Close logs out of the token and unloads the library
+func (m *Module) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.ctx.Logout(m.session)
+	if err := m.ctx.CloseSession(m.session); err != nil {
+		return errors.Wrap(err, "error closing the session")
+	}
+	if err := m.ctx.Finalize(); err != nil {
+		return errors.Wrap(err, "error finalizing the module")
+	}
+	m.ctx.Destroy()
+	return nil
+}
+
+// Key returns the private key with the given label. Its public key, usually
+// taken from the processing certificate, is required by applepay.KeyProvider.
+func (m *Module) Key(label string, public crypto.PublicKey) (*Key, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	template := []*p11.Attribute{
+		p11.NewAttribute(p11.CKA_CLASS, p11.CKO_PRIVATE_KEY),
+		p11.NewAttribute(p11.CKA_LABEL, label),
+	}
+	if err := m.ctx.FindObjectsInit(m.session, template); err != nil {
+		return nil, errors.Wrap(err, "error searching the key")
+	}
+	handles, _, err := m.ctx.FindObjects(m.session, 2)
+	m.ctx.FindObjectsFinal(m.session)
+	if err != nil {
+		return nil, errors.Wrap(err, "error searching the key")
+	}
+	if len(handles) != 1 {
+		return nil, errors.Errorf("expected 1 key labeled %s, found %d",
+			label, len(handles))
+	}
+
+	return &Key{module: m, handle: handles[0], public: public}, nil
+}
+
+// Public implements crypto.Decrypter
+func (k *Key) Public() crypto.PublicKey {
+	return k.public
+}
+
+// Decrypt implements crypto.Decrypter. Only RSA-OAEP with SHA-256 and no
+// label, as used by RSA_v1 tokens, is supported.
+func (k *Key) Decrypt(rand io.Reader, ciphertext []byte,
+	opts crypto.DecrypterOpts) ([]byte, error) {
+
+	oaep, ok := opts.(*rsa.OAEPOptions)
+	if !ok || oaep.Hash != crypto.SHA256 || len(oaep.Label) > 0 {
+		return nil, errors.New("only RSA-OAEP with SHA-256 is supported")
+	}
+	if _, ok := k.public.(*rsa.PublicKey); !ok {
+		return nil, errors.New("processing key is not RSA")
+	}
+
+	k.module.mu.Lock()
+	defer k.module.mu.Unlock()
+
+	mechanism := p11.NewMechanism(p11.CKM_RSA_PKCS_OAEP, p11.NewOAEPParams(
+		p11.CKM_SHA256,
+		p11.CKG_MGF1_SHA256,
+		p11.CKZ_DATA_SPECIFIED,
+		nil,
+	))
+	err := k.module.ctx.DecryptInit(
+		k.module.session,
+		[]*p11.Mechanism{mechanism},
+		k.handle,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "error initializing the decryption")
+	}
+	plaintext, err := k.module.ctx.Decrypt(k.module.session, ciphertext)
+	if err != nil {
+		return nil, errors.Wrap(err, "error decrypting")
+	}
+	return plaintext, nil
+}
+
+// ECDH implements applepay.KeyProvider
+func (k *Key) ECDH(pub *ecdh.PublicKey) ([]byte, error) {
+	if _, ok := k.public.(*ecdsa.PublicKey); !ok {
+		return nil, errors.New("non-elliptic processing private key")
+	}
+	if pub.Curve() != ecdh.P256() {
+		return nil, errors.New("ephemeral public key is not P-256")
+	}
+
+	k.module.mu.Lock()
+	defer k.module.mu.Unlock()
+
+	// The shared secret is derived as a temporary, extractable secret key
+	mechanism := p11.NewMechanism(
+		p11.CKM_ECDH1_DERIVE,
+		p11.NewECDH1DeriveParams(
+			p11.CKD_NULL,
+			nil,
+			pub.Bytes(),
+		),
+	)
+	template := []*p11.Attribute{
+		p11.NewAttribute(p11.CKA_CLASS, p11.CKO_SECRET_KEY),
+		p11.NewAttribute(p11.CKA_KEY_TYPE, p11.CKK_GENERIC_SECRET),
+		p11.NewAttribute(p11.CKA_VALUE_LEN, 32),
+		p11.NewAttribute(p11.CKA_TOKEN, false),
+		p11.NewAttribute(p11.CKA_SENSITIVE, false),
+		p11.NewAttribute(p11.CKA_EXTRACTABLE, true),
+	}
+	secretHandle, err := k.module.ctx.DeriveKey(
+		k.module.session,
+		[]*p11.Mechanism{mechanism},
+		k.handle,
+		template,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "error deriving the shared secret")
+	}
+	defer k.module.ctx.DestroyObject(k.module.session, secretHandle)
+
+	attributes, err := k.module.ctx.GetAttributeValue(
+		k.module.session,
+		secretHandle,
+		[]*p11.Attribute{p11.NewAttribute(p11.CKA_VALUE, nil)},
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading the shared secret")
+	}
+	if len(attributes[0].Value) != 32 {
+		return nil, errors.Errorf("invalid shared secret length %d",
+			len(attributes[0].Value))
+	}
+	return attributes[0].Value, nil
+}
+
+// ProcessingCertificate adds a Payment Processing Certificate whose private key
+// is the one with the given label in the module
+func ProcessingCertificate(module *Module, cert *x509.Certificate,
+	keyLabel string) func(*applepay.Merchant) error {
+
+	return func(m *applepay.Merchant) error {
+		if cert == nil {
+			return errors.New("nil certificate")
+		}
+		key, err := module.Key(keyLabel, cert.PublicKey)
+		if err != nil {
+			return errors.Wrap(err, "error loading the processing key")
+		}
+		return applepay.ProcessingKeyProvider(cert, key)(m)
+	}
+}
+
+// ProcessingCertificateLocation is the same as ProcessingCertificate, with a
+// certificate loaded from a PEM file, reloaded by
+// Merchant.WatchCertificates when it changes
+func ProcessingCertificateLocation(module *Module, certLocation,
+	keyLabel string) func(*applepay.Merchant) error {
+
+	return applepay.CertificateOption(func(m *applepay.Merchant) error {
+		if err := applepay.WatchFile(certLocation)(m); err != nil {
+			return err
+		}
+		certPEM, err := ioutil.ReadFile(certLocation)
+		if err != nil {
+			return errors.Wrap(err, "error loading the certificate")
+		}
+		block, _ := pem.Decode(certPEM)
+		if block == nil {
+			return errors.New("error decoding the certificate")
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return errors.Wrap(err, "error parsing the certificate")
+		}
+		return ProcessingCertificate(module, cert, keyLabel)(m)
+	})
+}
@@ -0,0 +1,369 @@
+package pkcs11
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	p11 "github.com/miekg/pkcs11"
+	"github.com/processout/applepay"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mozilla.org/pkcs7"
+)
+
+// These tests run against SoftHSM2. They are skipped when the library is not
+// found; its location can be set with the SOFTHSM2_LIB environment variable.
+
+const (
+	testTokenLabel = "applepay"
+	testPIN        = "1234"
+	testMerchantID = "merchant.com.processout.test"
+)
+
+var (
+	// p256OID is the DER-encoded OID of the P-256 curve
+	p256OID = []byte{0x06, 0x08, 0x2a, 0x86, 0x48, 0xce, 0x3d, 0x03, 0x01, 0x07}
+	// merchantIDHashOID is Apple's extension for merchant ID hashes
+	merchantIDHashOID = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 32}
+)
+
+// setupSoftHSM creates a SoftHSM2 token holding an EC and an RSA key pair
+// labeled "ec" and "rsa", and returns the module configuration with their
+// public keys
+func setupSoftHSM(t *testing.T) (Config, *ecdsa.PublicKey, *rsa.PublicKey) {
+	lib := os.Getenv("SOFTHSM2_LIB")
+	if lib == "" {
+		lib = "/usr/lib/softhsm/libsofthsm2.so"
+	}
+	if _, err := os.Stat(lib); err != nil {
+		t.Skip("SoftHSM2 not found")
+	}
+
+	dir := t.TempDir()
+	tokenDir := filepath.Join(dir, "tokens")
+	os.Mkdir(tokenDir, 0700)
+	confLocation := filepath.Join(dir, "softhsm2.conf")
+	os.WriteFile(
+		confLocation,
+		[]byte("directories.tokendir = "+tokenDir+"\nobjectstore.backend = file\n"),
+		0600,
+	)
+	os.Setenv("SOFTHSM2_CONF", confLocation)
+
+	ctx := p11.New(lib)
+	if ctx == nil {
+		t.Fatal("error loading SoftHSM2")
+	}
+	defer ctx.Destroy()
+	must := func(err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	must(ctx.Initialize())
+	defer ctx.Finalize()
+
+	slots, err := ctx.GetSlotList(false)
+	must(err)
+	must(ctx.InitToken(slots[0], testPIN, testTokenLabel))
+	// SoftHSM2 moves initialized tokens to a new slot
+	slot, err := findSlot(ctx, testTokenLabel)
+	must(err)
+
+	session, err := ctx.OpenSession(slot, p11.CKF_SERIAL_SESSION|p11.CKF_RW_SESSION)
+	must(err)
+	defer ctx.CloseSession(session)
+	must(ctx.Login(session, p11.CKU_SO, testPIN))
+	must(ctx.InitPIN(session, testPIN))
+	must(ctx.Logout(session))
+	must(ctx.Login(session, p11.CKU_USER, testPIN))
+	defer ctx.Logout(session)
+
+	// EC key pair
+	ecPub, _, err := ctx.GenerateKeyPair(
+		session,
+		[]*p11.Mechanism{p11.NewMechanism(p11.CKM_EC_KEY_PAIR_GEN, nil)},
+		[]*p11.Attribute{
+			p11.NewAttribute(p11.CKA_TOKEN, true),
+			p11.NewAttribute(p11.CKA_EC_PARAMS, p256OID),
+			p11.NewAttribute(p11.CKA_LABEL, "ec"),
+		},
+		[]*p11.Attribute{
+			p11.NewAttribute(p11.CKA_TOKEN, true),
+			p11.NewAttribute(p11.CKA_PRIVATE, true),
+			p11.NewAttribute(p11.CKA_SENSITIVE, true),
+			p11.NewAttribute(p11.CKA_DERIVE, true),
+			p11.NewAttribute(p11.CKA_LABEL, "ec"),
+		},
+	)
+	must(err)
+	attributes, err := ctx.GetAttributeValue(session, ecPub, []*p11.Attribute{
+		p11.NewAttribute(p11.CKA_EC_POINT, nil),
+	})
+	must(err)
+	var point []byte
+	_, err = asn1.Unmarshal(attributes[0].Value, &point)
+	must(err)
+	x, y := elliptic.Unmarshal(elliptic.P256(), point)
+
+	// RSA key pair
+	rsaPub, _, err := ctx.GenerateKeyPair(
+		session,
+		[]*p11.Mechanism{p11.NewMechanism(p11.CKM_RSA_PKCS_KEY_PAIR_GEN, nil)},
+		[]*p11.Attribute{
+			p11.NewAttribute(p11.CKA_TOKEN, true),
+			p11.NewAttribute(p11.CKA_MODULUS_BITS, 2048),
+			p11.NewAttribute(p11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}),
+			p11.NewAttribute(p11.CKA_LABEL, "rsa"),
+		},
+		[]*p11.Attribute{
+			p11.NewAttribute(p11.CKA_TOKEN, true),
+			p11.NewAttribute(p11.CKA_PRIVATE, true),
+			p11.NewAttribute(p11.CKA_SENSITIVE, true),
+			p11.NewAttribute(p11.CKA_DECRYPT, true),
+			p11.NewAttribute(p11.CKA_LABEL, "rsa"),
+		},
+	)
+	must(err)
+	attributes, err = ctx.GetAttributeValue(session, rsaPub, []*p11.Attribute{
+		p11.NewAttribute(p11.CKA_MODULUS, nil),
+		p11.NewAttribute(p11.CKA_PUBLIC_EXPONENT, nil),
+	})
+	must(err)
+
+	config := Config{Module: lib, TokenLabel: testTokenLabel, PIN: testPIN}
+	return config,
+		&ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y},
+		&rsa.PublicKey{
+			N: new(big.Int).SetBytes(attributes[0].Value),
+			E: int(new(big.Int).SetBytes(attributes[1].Value).Int64()),
+		}
+}
+
+// testCertificate creates a processing certificate for a public key kept in
+// the token
+func testCertificate(pub crypto.PublicKey) *x509.Certificate {
+	issuerKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	merchantIDHash := sha256.Sum256([]byte(testMerchantID))
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtraExtensions: []pkix.Extension{
+			{
+				Id:    merchantIDHashOID,
+				Value: []byte("@." + hex.EncodeToString(merchantIDHash[:])),
+			},
+		},
+	}
+	certBytes, _ := x509.CreateCertificate(rand.Reader, tpl, tpl, pub, issuerKey)
+	cert, _ := x509.ParseCertificate(certBytes)
+	return cert
+}
+
+// testTokenPlaintext is the payment data encrypted in test tokens
+const testTokenPlaintext = `{"applicationPrimaryAccountNumber":"4109370251004320","currencyCode":"840"}`
+
+// newECToken creates an EC_v1 token for the processing certificate cert,
+// whose key is pub
+func newECToken(cert *x509.Certificate, pub *ecdsa.PublicKey) *applepay.PKPaymentToken {
+	processingKey, _ := pub.ECDH()
+	ephemeral, _ := ecdh.P256().GenerateKey(rand.Reader)
+	secret, _ := ephemeral.ECDH(processingKey)
+
+	// Apple's KDF, see deriveEncryptionKey
+	merchantIDHash := sha256.Sum256([]byte(testMerchantID))
+	h := sha256.New()
+	h.Write([]byte{0, 0, 0, 1})
+	h.Write(secret)
+	h.Write([]byte("\x0Did-aes256-GCM"))
+	h.Write([]byte("Apple"))
+	h.Write(merchantIDHash[:])
+
+	token := &applepay.PKPaymentToken{}
+	token.PaymentData.Version = "EC_v1"
+	token.PaymentData.Header.EphemeralPublicKey, _ = x509.MarshalPKIXPublicKey(ephemeral.PublicKey())
+	encryptTestToken(token, cert, h.Sum(nil))
+	return token
+}
+
+// newRSAToken creates an RSA_v1 token for the processing certificate cert,
+// whose key is pub
+func newRSAToken(cert *x509.Certificate, pub *rsa.PublicKey) *applepay.PKPaymentToken {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	token := &applepay.PKPaymentToken{}
+	token.PaymentData.Version = "RSA_v1"
+	token.PaymentData.Header.WrappedKey, _ = rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, key, nil)
+	encryptTestToken(token, cert, key)
+	return token
+}
+
+// encryptTestToken encrypts testTokenPlaintext in token with key, for the
+// processing certificate cert
+func encryptTestToken(token *applepay.PKPaymentToken, cert *x509.Certificate, key []byte) {
+	block, _ := aes.NewCipher(key)
+	aesGCM, _ := cipher.NewGCMWithNonceSize(block, 16)
+	transactionID := make([]byte, 32)
+	rand.Read(transactionID)
+	keyHash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+
+	token.PaymentData.Data = aesGCM.Seal(nil, make([]byte, 16), []byte(testTokenPlaintext), nil)
+	token.PaymentData.Header.PublicKeyHash = keyHash[:]
+	token.PaymentData.Header.TransactionID = hex.EncodeToString(transactionID)
+}
+
+// signTestToken signs token with a new chain whose leaf key is leafKey, and
+// adds the intermediate certificate to the roots of policy
+func signTestToken(token *applepay.PKPaymentToken, leafKey crypto.Signer,
+	policy applepay.VerificationPolicy) {
+
+	interKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	interTpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "inter"},
+		NotAfter:              time.Now().Add(time.Hour),
+		ExtraExtensions:       []pkix.Extension{{Id: policy.IntermediateCertificateOID, Value: []byte{5, 0}}},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	interBytes, _ := x509.CreateCertificate(rand.Reader, interTpl, interTpl, &interKey.PublicKey, interKey)
+	inter, _ := x509.ParseCertificate(interBytes)
+	leafTpl := &x509.Certificate{
+		SerialNumber:    big.NewInt(2),
+		Subject:         pkix.Name{CommonName: "leaf"},
+		NotAfter:        time.Now().Add(time.Hour),
+		ExtraExtensions: []pkix.Extension{{Id: policy.LeafCertificateOID, Value: []byte{5, 0}}},
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+	}
+	leafBytes, _ := x509.CreateCertificate(rand.Reader, leafTpl, inter, leafKey.Public(), interKey)
+	leaf, _ := x509.ParseCertificate(leafBytes)
+
+	// The ephemeral or wrapped key, the data, the transaction ID and the
+	// application data are signed
+	header := token.PaymentData.Header
+	signed := bytes.NewBuffer(nil)
+	signed.Write(header.EphemeralPublicKey)
+	signed.Write(header.WrappedKey)
+	signed.Write(token.PaymentData.Data)
+	transactionID, _ := hex.DecodeString(header.TransactionID)
+	signed.Write(transactionID)
+
+	sd, _ := pkcs7.NewSignedData(signed.Bytes())
+	sd.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	sd.AddSignerChain(leaf, leafKey, []*x509.Certificate{inter}, pkcs7.SignerInfoConfig{})
+	sd.Detach()
+	token.PaymentData.Signature, _ = sd.Finish()
+	policy.Roots.AddCert(inter)
+}
+
+func TestSoftHSM(t *testing.T) {
+	config, ecPub, rsaPub := setupSoftHSM(t)
+	module, err := Open(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer module.Close()
+
+	Convey("Unknown keys are rejected", t, func() {
+		key, err := module.Key("unknown", ecPub)
+
+		So(key, ShouldBeNil)
+		So(err.Error(), ShouldEqual, "expected 1 key labeled unknown, found 0")
+	})
+
+	Convey("ECDH is done in the token", t, func() {
+		key, err := module.Key("ec", ecPub)
+		So(err, ShouldBeNil)
+		ephemeral, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+		ephemeralPub, _ := ephemeral.PublicKey.ECDH()
+		secret, err := key.ECDH(ephemeralPub)
+		expectedX, _ := elliptic.P256().ScalarMult(ecPub.X, ecPub.Y, ephemeral.D.Bytes())
+		expected := expectedX.FillBytes(make([]byte, 32))
+
+		Convey("secret should be correct", func() {
+			So(secret, ShouldResemble, expected)
+		})
+
+		Convey("err should be nil", func() {
+			So(err, ShouldBeNil)
+		})
+	})
+
+	Convey("RSA-OAEP unwrapping is done in the token", t, func() {
+		key, err := module.Key("rsa", rsaPub)
+		So(err, ShouldBeNil)
+		ciphertext, _ := rsa.EncryptOAEP(sha256.New(), rand.Reader, rsaPub, []byte("symmetric key"), nil)
+
+		plaintext, err := key.Decrypt(rand.Reader, ciphertext, &rsa.OAEPOptions{Hash: crypto.SHA256})
+
+		Convey("plaintext should be correct", func() {
+			So(string(plaintext), ShouldEqual, "symmetric key")
+		})
+
+		Convey("err should be nil", func() {
+			So(err, ShouldBeNil)
+		})
+	})
+
+	Convey("Other decryption options are rejected", t, func() {
+		key, _ := module.Key("rsa", rsaPub)
+
+		_, err := key.Decrypt(rand.Reader, []byte("ciphertext"), nil)
+
+		So(err.Error(), ShouldEqual, "only RSA-OAEP with SHA-256 is supported")
+	})
+
+	Convey("Processing certificates use the keys of the token", t, func() {
+		ecCert, rsaCert := testCertificate(ecPub), testCertificate(rsaPub)
+		ecToken, rsaToken := newECToken(ecCert, ecPub), newRSAToken(rsaCert, rsaPub)
+		ecSigner, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		rsaSigner, _ := rsa.GenerateKey(rand.Reader, 2048)
+		policy := applepay.DefaultVerificationPolicy()
+		policy.Roots = x509.NewCertPool()
+		signTestToken(ecToken, ecSigner, policy)
+		signTestToken(rsaToken, rsaSigner, policy)
+
+		m, err := applepay.New(
+			testMerchantID,
+			ProcessingCertificate(module, ecCert, "ec"),
+			ProcessingCertificate(module, rsaCert, "rsa"),
+			applepay.MerchantVerificationPolicy(policy),
+		)
+		So(err, ShouldBeNil)
+
+		Convey("EC_v1 tokens are decrypted with ECDH in the token", func() {
+			token, err := m.DecryptToken(ecToken)
+
+			So(err, ShouldBeNil)
+			So(token.ApplicationPrimaryAccountNumber, ShouldEqual, "4109370251004320")
+			So(token.CurrencyCode, ShouldEqual, "840")
+		})
+
+		Convey("RSA_v1 tokens are decrypted with RSA-OAEP in the token", func() {
+			token, err := m.DecryptToken(rsaToken)
+
+			So(err, ShouldBeNil)
+			So(token.ApplicationPrimaryAccountNumber, ShouldEqual, "4109370251004320")
+			So(token.CurrencyCode, ShouldEqual, "840")
+		})
+	})
+}
@@ -0,0 +1,121 @@
+package applepay
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type (
+	// VerificationPolicy controls how the tokens of a merchant are verified.
+	// It should be created with DefaultVerificationPolicy, then modified.
+	VerificationPolicy struct {
+		// Roots are the trusted root certificates. If nil, the embedded Apple
+		// Root CA - G3 is used.
+		Roots *x509.CertPool
+
+		// PastWindow is how long after its signing a token is accepted
+		PastWindow time.Duration
+		// FutureSkew is how long before its signing a token is accepted, to
+		// allow for clock differences
+		FutureSkew time.Duration
+		// Now returns the time tokens are received at, unless set with
+		// PKPaymentToken.SetTransactionTime
+		Now func() time.Time
+
+		// LeafCertificateOID and IntermediateCertificateOID are the
+		// extensions the signing certificates must contain
+		LeafCertificateOID         asn1.ObjectIdentifier
+		IntermediateCertificateOID asn1.ObjectIdentifier
+
+		// Revocation checks the revocation status of the signing
+		// certificates. Revocations are not checked if nil.
+		Revocation *RevocationChecker
+
+		// ChainCache holds the chains already verified. Chains are verified
+		// for each token if nil.
+		ChainCache *ChainCache
+	}
+)
+
+const (
+	// defaultFutureSkew is the default VerificationPolicy.FutureSkew
+	defaultFutureSkew = time.Second
+)
+
+// DefaultVerificationPolicy returns the policy used by merchants without a
+// MerchantVerificationPolicy option. It uses the current value of the package
+// variable TransactionTimeWindow.
+func DefaultVerificationPolicy() VerificationPolicy {
+	return VerificationPolicy{
+		PastWindow:                 TransactionTimeWindow,
+		FutureSkew:                 defaultFutureSkew,
+		Now:                        time.Now,
+		LeafCertificateOID:         leafCertificateOID,
+		IntermediateCertificateOID: interCertificateOID,
+		ChainCache:                 defaultChainCache,
+	}
+}
+
+// MerchantVerificationPolicy sets the policy used to verify the merchant's
+// tokens. The clock and OIDs default to the ones of DefaultVerificationPolicy
+// if not set. Policies without PastWindow are rejected.
+func MerchantVerificationPolicy(policy VerificationPolicy) func(*Merchant) error {
+	return func(m *Merchant) error {
+		if policy.PastWindow < 0 || policy.FutureSkew < 0 {
+			return newError(
+				CodeInvalidConfiguration,
+				errors.New("negative signing time window"),
+			)
+		}
+		// Every token would be rejected, e.g. with a policy not created
+		// with DefaultVerificationPolicy
+		if policy.PastWindow == 0 {
+			return newError(
+				CodeInvalidConfiguration,
+				errors.New("zero signing time window"),
+			)
+		}
+
+		defaults := DefaultVerificationPolicy()
+		if policy.Now == nil {
+			policy.Now = defaults.Now
+		}
+		if policy.LeafCertificateOID == nil {
+			policy.LeafCertificateOID = defaults.LeafCertificateOID
+		}
+		if policy.IntermediateCertificateOID == nil {
+			policy.IntermediateCertificateOID = defaults.IntermediateCertificateOID
+		}
+		if policy.Roots != nil {
+			// Later changes to the pool must not affect the merchant
+			policy.Roots = policy.Roots.Clone()
+		}
+
+		m.verificationPolicy = &policy
+		return nil
+	}
+}
+
+// policy returns the verification policy of the merchant
+func (m Merchant) policy() VerificationPolicy {
+	if m.verificationPolicy == nil {
+		return DefaultVerificationPolicy()
+	}
+	return *m.verificationPolicy
+}
+
+// roots returns the trusted root certificates of the policy
+func (p VerificationPolicy) roots() (*x509.CertPool, error) {
+	if p.Roots != nil {
+		return p.Roots, nil
+	}
+	if AppleRootCertificatePath == "" {
+		return appleRoots, nil
+	}
+
+	// Deprecated root file
+	return loadDeprecatedRoots(AppleRootCertificatePath)
+}
@@ -0,0 +1,181 @@
+package applepay
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mozilla.org/pkcs7"
+)
+
+// testTokenSigningTime is the signing time of tests/token.json
+var testTokenSigningTime = time.Date(2017, 2, 1, 18, 45, 6, 0, time.UTC)
+
+// testPolicyMerchant creates a merchant using policy
+func testPolicyMerchant(policy VerificationPolicy) *Merchant {
+	m, _ := New(
+		"merchant.com.processout.test",
+		MerchantVerificationPolicy(policy),
+	)
+	return m
+}
+
+// clockAt returns a clock stopped at t
+func clockAt(t time.Time) func() time.Time {
+	return func() time.Time {
+		return t
+	}
+}
+
+func TestMerchantVerificationPolicy(t *testing.T) {
+	Convey("Negative windows are rejected", t, func() {
+		policy := DefaultVerificationPolicy()
+		policy.FutureSkew = -time.Second
+
+		m, err := New("merchant.com.processout.test", MerchantVerificationPolicy(policy))
+
+		So(m, ShouldBeNil)
+		So(errors.Is(err, ErrInvalidConfiguration), ShouldBeTrue)
+	})
+
+	Convey("Policies without past window are rejected", t, func() {
+		m, err := New("merchant.com.processout.test", MerchantVerificationPolicy(VerificationPolicy{
+			Roots: AppleRoots(),
+		}))
+
+		So(m, ShouldBeNil)
+		So(err.Error(), ShouldEqual, "zero signing time window")
+		So(errors.Is(err, ErrInvalidConfiguration), ShouldBeTrue)
+	})
+
+	Convey("Unset fields use the defaults", t, func() {
+		m := testPolicyMerchant(VerificationPolicy{PastWindow: time.Hour})
+		policy := m.policy()
+
+		So(policy.PastWindow, ShouldEqual, time.Hour)
+		So(policy.FutureSkew, ShouldEqual, 0)
+		So(policy.Now, ShouldNotBeNil)
+		So(policy.LeafCertificateOID, ShouldResemble, leafCertificateOID)
+		So(policy.IntermediateCertificateOID, ShouldResemble, interCertificateOID)
+	})
+
+	Convey("Merchants without a policy use the globals", t, func() {
+		m, _ := New("merchant.com.processout.test")
+
+		So(m.policy().PastWindow, ShouldEqual, TransactionTimeWindow)
+		So(m.policy().FutureSkew, ShouldEqual, time.Second)
+	})
+}
+
+func TestPolicySigningTime(t *testing.T) {
+	tokenJSON, _ := os.ReadFile("tests/token.json")
+	token := &PKPaymentToken{}
+	json.Unmarshal(tokenJSON, token)
+	p7, _ := pkcs7.Parse(token.PaymentData.Signature)
+
+	Convey("Merchants use their own windows", t, func() {
+		strict := DefaultVerificationPolicy()
+		strict.PastWindow = time.Minute
+		strict.Now = clockAt(testTokenSigningTime.Add(10 * time.Minute))
+		lenient := strict
+		lenient.PastWindow = time.Hour
+
+		strictErr := token.verifySigningTime(p7, testPolicyMerchant(strict).policy())
+		lenientErr := token.verifySigningTime(p7, testPolicyMerchant(lenient).policy())
+
+		So(errors.Is(strictErr, ErrSigningTimeOutOfWindow), ShouldBeTrue)
+		So(lenientErr, ShouldBeNil)
+	})
+
+	Convey("The future skew is configurable", t, func() {
+		policy := DefaultVerificationPolicy()
+		policy.Now = clockAt(testTokenSigningTime.Add(-30 * time.Second))
+
+		err := token.verifySigningTime(p7, policy)
+		So(errors.Is(err, ErrSigningTimeOutOfWindow), ShouldBeTrue)
+
+		policy.FutureSkew = time.Minute
+		So(token.verifySigningTime(p7, policy), ShouldBeNil)
+	})
+
+	Convey("Transaction times override the clock", t, func() {
+		policy := DefaultVerificationPolicy()
+		policy.PastWindow = time.Minute
+		policy.Now = clockAt(testTokenSigningTime.Add(time.Hour))
+		received := *token
+		received.SetTransactionTime(testTokenSigningTime.Add(time.Second))
+
+		So(received.verifySigningTime(p7, policy), ShouldBeNil)
+	})
+}
+
+func TestPolicyRoots(t *testing.T) {
+	tokenJSON, _ := os.ReadFile("tests/token.json")
+	token := &PKPaymentToken{}
+	json.Unmarshal(tokenJSON, token)
+
+	rootTpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(0),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	rootKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	testRootBytes, _ := x509.CreateCertificate(rand.Reader, rootTpl, rootTpl, &rootKey.PublicKey, rootKey)
+	testRoot, _ := x509.ParseCertificate(testRootBytes)
+
+	Convey("Tokens must chain to the policy's roots", t, func() {
+		policy := DefaultVerificationPolicy()
+		policy.Roots = x509.NewCertPool()
+		policy.Roots.AddCert(testRoot)
+
+		err := token.verifySignature(context.Background(), policy)
+
+		So(errors.Is(err, ErrUntrustedChain), ShouldBeTrue)
+	})
+
+	Convey("Any of the roots may be used", t, func() {
+		policy := DefaultVerificationPolicy()
+		policy.Roots = AppleRoots()
+		policy.Roots.AddCert(testRoot)
+
+		So(token.verifySignature(context.Background(), policy), ShouldBeNil)
+	})
+
+	Convey("Merchants keep a copy of their roots", t, func() {
+		policy := DefaultVerificationPolicy()
+		policy.Roots = x509.NewCertPool()
+		m := testPolicyMerchant(policy)
+		policy.Roots.AddCert(testRoot)
+
+		So(m.policy().Roots.Equal(policy.Roots), ShouldBeFalse)
+	})
+
+	Convey("The embedded root is trusted by default", t, func() {
+		So(token.verifySignature(context.Background(), DefaultVerificationPolicy()), ShouldBeNil)
+	})
+}
+
+func TestMerchantRequestTimeout(t *testing.T) {
+	Convey("Timeouts must be positive", t, func() {
+		m, err := New("merchant.com.processout.test", MerchantRequestTimeout(0))
+
+		So(m, ShouldBeNil)
+		So(err.Error(), ShouldEqual, "the request timeout should be positive")
+	})
+
+	Convey("Session requests use the merchant's timeout", t, func() {
+		m, _ := New("merchant.com.processout.test", MerchantRequestTimeout(time.Second))
+
+		So(m.authenticatedClient().Timeout, ShouldEqual, time.Second)
+	})
+}
@@ -0,0 +1,227 @@
+package applepay
+
+import (
+	"context"
+	"encoding/base64"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+type (
+	// Registry holds many merchants, e.g. for PSPs decrypting tokens on
+	// behalf of several merchant IDs, and routes tokens to the merchant
+	// owning their processing key. It is safe for concurrent use.
+	Registry struct {
+		mu sync.RWMutex
+		// merchants indexed by merchant ID
+		merchants map[string]*Merchant
+		// merchants indexed by the public key hashes of their processing
+		// certificates
+		keyHashes map[string]*Merchant
+		// indexed holds the certificates of each merchant as they were
+		// indexed, to detect reloads
+		indexed map[string]*keyPairs
+		// generation is the keysGeneration of the last refresh
+		generation uint64
+	}
+)
+
+// NewRegistry creates a Registry holding the given merchants
+func NewRegistry(merchants ...*Merchant) (*Registry, error) {
+	r := &Registry{
+		merchants: make(map[string]*Merchant),
+		keyHashes: make(map[string]*Merchant),
+		indexed:   make(map[string]*keyPairs),
+	}
+	for _, m := range merchants {
+		if err := r.Add(m); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Add adds a merchant to the registry. It fails if a merchant with the same ID
+// is already registered.
+func (r *Registry) Add(m *Merchant) error {
+	if m == nil {
+		return newError(CodeInvalidConfiguration, errors.New("nil merchant"))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.merchants[m.identifier]; ok {
+		return newError(
+			CodeInvalidConfiguration,
+			errors.Errorf("merchant %s is already registered", m.identifier),
+		)
+	}
+	return r.put(m)
+}
+
+// Replace adds a merchant to the registry, replacing the merchant with the
+// same ID if there is one
+func (r *Registry) Replace(m *Merchant) error {
+	if m == nil {
+		return newError(CodeInvalidConfiguration, errors.New("nil merchant"))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.put(m)
+}
+
+// Remove removes a merchant from the registry. It returns false if no merchant
+// with this ID was registered.
+func (r *Registry) Remove(merchantID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.merchants[merchantID]; !ok {
+		return false
+	}
+	r.remove(merchantID)
+	return true
+}
+
+// Merchant returns the registered merchant with the given ID
+func (r *Registry) Merchant(merchantID string) (*Merchant, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	m, ok := r.merchants[merchantID]
+	return m, ok
+}
+
+// MerchantForToken returns the merchant owning the processing certificate the
+// token was encrypted for
+func (r *Registry) MerchantForToken(t *PKPaymentToken) (*Merchant, error) {
+	if t == nil {
+		return nil, newError(CodeMalformedToken, errors.New("nil token"))
+	}
+
+	keyHash := t.PaymentData.Header.PublicKeyHash
+	r.mu.RLock()
+	m, ok := r.keyHashes[string(keyHash)]
+	stale := r.generation != atomic.LoadUint64(&keysGeneration)
+	r.mu.RUnlock()
+	if !ok && stale {
+		// The certificates of a merchant may have been reloaded since they
+		// were indexed. Unknown keys are not looked up again until the next
+		// reload, so that they cannot block the registry.
+		r.mu.Lock()
+		r.refresh()
+		m, ok = r.keyHashes[string(keyHash)]
+		r.mu.Unlock()
+	}
+	if !ok {
+		return nil, newError(CodeKeyMismatch, errors.Errorf(
+			"no merchant matches the public key hash %s",
+			base64.StdEncoding.EncodeToString(keyHash),
+		))
+	}
+	return m, nil
+}
+
+// DecryptResponse calls DecryptToken(r.Token, options...)
+func (r *Registry) DecryptResponse(res *Response, options ...DecryptOption) (*Token, error) {
+	return r.DecryptToken(&res.Token, options...)
+}
+
+// DecryptToken decrypts an Apple Pay token with the merchant it was encrypted
+// for
+func (r *Registry) DecryptToken(t *PKPaymentToken, options ...DecryptOption) (*Token, error) {
+	return r.DecryptTokenContext(context.Background(), t, options...)
+}
+
+// DecryptTokenContext decrypts an Apple Pay token with the merchant it was
+// encrypted for, see Merchant.DecryptTokenContext
+func (r *Registry) DecryptTokenContext(ctx context.Context, t *PKPaymentToken,
+	options ...DecryptOption) (*Token, error) {
+
+	m, err := r.MerchantForToken(t)
+	if err != nil {
+		return nil, err
+	}
+	return m.DecryptTokenContext(ctx, t, options...)
+}
+
+// put indexes m, replacing any merchant with the same ID. r.mu must be held
+// for writing.
+func (r *Registry) put(m *Merchant) error {
+	// Processing keys must not be shared with another merchant, otherwise we
+	// could not route tokens
+	kp := m.keys()
+	for keyHash := range kp.processingKeys {
+		other, ok := r.keyHashes[keyHash]
+		if ok && other.identifier != m.identifier {
+			return newError(CodeInvalidConfiguration, errors.Errorf(
+				"processing key already used by merchant %s",
+				other.identifier,
+			))
+		}
+	}
+
+	r.remove(m.identifier)
+	r.merchants[m.identifier] = m
+	r.index(m, kp)
+	return nil
+}
+
+// index routes the processing keys of kp to m. Keys already used by another
+// merchant are left to it. r.mu must be held for writing.
+func (r *Registry) index(m *Merchant, kp *keyPairs) {
+	r.unindex(m)
+	for keyHash := range kp.processingKeys {
+		if _, ok := r.keyHashes[keyHash]; !ok {
+			r.keyHashes[keyHash] = m
+		}
+	}
+	r.indexed[m.identifier] = kp
+}
+
+// unindex removes the routes to m. r.mu must be held for writing.
+func (r *Registry) unindex(m *Merchant) {
+	kp, ok := r.indexed[m.identifier]
+	if !ok {
+		return
+	}
+	for keyHash := range kp.processingKeys {
+		if r.keyHashes[keyHash] == m {
+			delete(r.keyHashes, keyHash)
+		}
+	}
+	delete(r.indexed, m.identifier)
+}
+
+// refresh indexes again the merchants whose certificates were reloaded, unless
+// no certificate changed since the last refresh. r.mu must be held for
+// writing.
+func (r *Registry) refresh() {
+	// Reloads happening during the refresh are caught by the next one
+	generation := atomic.LoadUint64(&keysGeneration)
+	if generation == r.generation {
+		return
+	}
+	for merchantID, m := range r.merchants {
+		if kp := m.keys(); kp != r.indexed[merchantID] {
+			r.index(m, kp)
+		}
+	}
+	r.generation = generation
+}
+
+// remove removes the merchant with the given ID. r.mu must be held for
+// writing.
+func (r *Registry) remove(merchantID string) {
+	m, ok := r.merchants[merchantID]
+	if !ok {
+		return
+	}
+	r.unindex(m)
+	delete(r.merchants, merchantID)
+}
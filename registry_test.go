@@ -0,0 +1,194 @@
+package applepay
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// testMerchant creates a merchant with a freshly generated processing
+// certificate
+func testMerchant(merchantID string) *Merchant {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	m, _ := New(
+		merchantID,
+		ProcessingCertificate(testCertificate(merchantID, key)),
+	)
+	return m
+}
+
+func TestRegistry(t *testing.T) {
+	m1 := testMerchant("merchant.com.processout.test1")
+	m2 := testMerchant("merchant.com.processout.test2")
+
+	Convey("Merchants are registered", t, func() {
+		r, err := NewRegistry(m1, m2)
+
+		Convey("err should be nil", func() {
+			So(err, ShouldBeNil)
+		})
+
+		Convey("merchants can be found by ID", func() {
+			m, ok := r.Merchant("merchant.com.processout.test2")
+			So(ok, ShouldBeTrue)
+			So(m, ShouldEqual, m2)
+		})
+	})
+
+	Convey("Duplicate merchant IDs are rejected", t, func() {
+		r, _ := NewRegistry(m1)
+		err := r.Add(testMerchant("merchant.com.processout.test1"))
+
+		So(err.Error(), ShouldEqual, "merchant merchant.com.processout.test1 is already registered")
+		So(errors.Is(err, ErrInvalidConfiguration), ShouldBeTrue)
+	})
+
+	Convey("Merchants can be replaced", t, func() {
+		r, _ := NewRegistry(m1)
+		m1b := testMerchant("merchant.com.processout.test1")
+		err := r.Replace(m1b)
+
+		Convey("err should be nil", func() {
+			So(err, ShouldBeNil)
+		})
+
+		Convey("the new merchant is used", func() {
+			m, _ := r.Merchant("merchant.com.processout.test1")
+			So(m, ShouldEqual, m1b)
+		})
+
+		Convey("the old processing keys are not routed anymore", func() {
+			for keyHash := range m1.keys().processingKeys {
+				token := &PKPaymentToken{}
+				token.PaymentData.Header.PublicKeyHash = []byte(keyHash)
+				_, err := r.MerchantForToken(token)
+				So(err, ShouldNotBeNil)
+			}
+		})
+	})
+
+	Convey("Processing keys cannot be shared between merchants", t, func() {
+		r, _ := NewRegistry(m1)
+		shared := &Merchant{identifier: "merchant.com.processout.shared"}
+		shared.storeKeys(m1.keys())
+		err := r.Add(shared)
+
+		So(err.Error(), ShouldEqual, "processing key already used by merchant merchant.com.processout.test1")
+		So(errors.Is(err, ErrInvalidConfiguration), ShouldBeTrue)
+	})
+
+	Convey("Merchants can be removed", t, func() {
+		r, _ := NewRegistry(m1, m2)
+
+		So(r.Remove("merchant.com.processout.test1"), ShouldBeTrue)
+		So(r.Remove("merchant.com.processout.test1"), ShouldBeFalse)
+		_, ok := r.Merchant("merchant.com.processout.test1")
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("Tokens are routed by public key hash", t, func() {
+		r, _ := NewRegistry(m1, m2)
+
+		for keyHash := range m2.keys().processingKeys {
+			token := &PKPaymentToken{}
+			token.PaymentData.Header.PublicKeyHash = []byte(keyHash)
+			m, err := r.MerchantForToken(token)
+
+			So(err, ShouldBeNil)
+			So(m, ShouldEqual, m2)
+		}
+	})
+
+	Convey("Reloaded certificates are routed", t, func() {
+		dir := t.TempDir()
+		certLocation := filepath.Join(dir, "cert-processing.crt")
+		keyLocation := filepath.Join(dir, "cert-processing-key.pem")
+		writeTestCertificate("merchant.com.processout.test3", certLocation, keyLocation)
+		m3, _ := New(
+			"merchant.com.processout.test3",
+			ProcessingCertificateLocation(certLocation, keyLocation),
+		)
+		r, _ := NewRegistry(m1, m3)
+
+		newHash := writeTestCertificate("merchant.com.processout.test3", certLocation, keyLocation)
+		m3.ReloadCertificates()
+		token := &PKPaymentToken{}
+		token.PaymentData.Header.PublicKeyHash = newHash
+		m, err := r.MerchantForToken(token)
+
+		So(err, ShouldBeNil)
+		So(m, ShouldEqual, m3)
+	})
+
+	Convey("Tokens for unknown keys are rejected", t, func() {
+		r, _ := NewRegistry(m1, m2)
+		tokenJSON, _ := os.ReadFile("tests/token.json")
+		token := &PKPaymentToken{}
+		json.Unmarshal(tokenJSON, token)
+
+		res, err := r.DecryptResponse(&Response{Token: *token})
+
+		Convey("token is nil", func() {
+			So(res, ShouldBeNil)
+		})
+
+		Convey("err is correct", func() {
+			So(err.Error(), ShouldStartWith, "no merchant matches the public key hash")
+			So(errors.Is(err, ErrKeyMismatch), ShouldBeTrue)
+		})
+	})
+
+	Convey("Unknown keys do not block the registry until a reload", t, func() {
+		r, _ := NewRegistry(m1, m2)
+		token := &PKPaymentToken{}
+		token.PaymentData.Header.PublicKeyHash = []byte("unknown")
+		r.MerchantForToken(token)
+
+		// A refresh would wait for the read lock to be released
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		done := make(chan error, 1)
+		go func() {
+			_, err := r.MerchantForToken(token)
+			done <- err
+		}()
+
+		var err error
+		select {
+		case err = <-done:
+		case <-time.After(time.Second):
+			err = errors.New("the lookup is blocked")
+		}
+		So(errors.Is(err, ErrKeyMismatch), ShouldBeTrue)
+	})
+
+	Convey("The registry can be used concurrently", t, func() {
+		r, _ := NewRegistry()
+		wg := &sync.WaitGroup{}
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				m := testMerchant(fmt.Sprintf("merchant.com.processout.test%d", i))
+				r.Replace(m)
+				r.Merchant(m.identifier)
+				r.MerchantForToken(&PKPaymentToken{})
+				r.Remove(m.identifier)
+			}(i)
+		}
+		wg.Wait()
+
+		So(r.merchants, ShouldBeEmpty)
+		So(r.keyHashes, ShouldBeEmpty)
+	})
+}
@@ -0,0 +1,107 @@
+package applepay
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ReloadCertificates loads the merchant's certificates again, e.g. after they
+// were renewed on the disk, and swaps them atomically: concurrent calls
+// either see the previous or the new certificates, never a mix of both.
+// Only the certificate options given to New are applied again. If any
+// certificate cannot be loaded, the previous ones are kept.
+func (m *Merchant) ReloadCertificates() error {
+	// Apply the options to a scratch merchant, so that a failure has no
+	// effect on m
+	scratch := &Merchant{identifier: m.identifier, loadingCertificates: true}
+	for _, option := range m.certificateOptions {
+		if err := option(scratch); err != nil {
+			return errors.Wrap(
+				withDefaultCode(CodeInvalidConfiguration, err),
+				"error reloading the certificates",
+			)
+		}
+	}
+
+	m.storeKeys(scratch.keys())
+	return nil
+}
+
+// CertificateOption marks option as loading certificates, for options of
+// other packages: ReloadCertificates applies it again, unlike the other
+// options given to New. Certificate options applied by option are not
+// recorded on their own.
+func CertificateOption(option func(*Merchant) error) func(*Merchant) error {
+	return func(m *Merchant) error {
+		if m.loadingCertificates {
+			return option(m)
+		}
+		m.certificateOptions = append(m.certificateOptions, option)
+		m.loadingCertificates = true
+		defer func() { m.loadingCertificates = false }()
+		return option(m)
+	}
+}
+
+// WatchFile adds the file at path to the ones polled by WatchCertificates, for
+// options loading certificates from files by their own means, e.g. with keys
+// held in an HSM
+func WatchFile(path string) func(*Merchant) error {
+	return func(m *Merchant) error {
+		m.certificateFiles = append(m.certificateFiles, path)
+		return nil
+	}
+}
+
+// WatchCertificates polls the certificate files every interval and reloads the
+// certificates when they change, until ctx is done. Reload errors are passed
+// to onError, if not nil, and the previous certificates are kept.
+func (m *Merchant) WatchCertificates(ctx context.Context,
+	interval time.Duration, onError func(error)) {
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		state := m.certificateFilesState()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			newState := m.certificateFilesState()
+			if newState == state {
+				continue
+			}
+			// Only retry once the files change again, e.g. while a new
+			// key pair is being written
+			state = newState
+			if err := m.ReloadCertificates(); err != nil && onError != nil {
+				onError(err)
+			}
+		}
+	}()
+}
+
+// certificateFilesState returns a summary of the size and modification time
+// of the certificate files, which changes when any of them is written
+func (m Merchant) certificateFilesState() string {
+	state := &strings.Builder{}
+	for _, name := range m.certificateFiles {
+		info, err := os.Stat(name)
+		if err != nil {
+			fmt.Fprintf(state, "%s:missing;", name)
+			continue
+		}
+		fmt.Fprintf(state, "%s:%d:%d;", name, info.Size(),
+			info.ModTime().UnixNano())
+	}
+	return state.String()
+}
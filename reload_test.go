@@ -0,0 +1,207 @@
+package applepay
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// writeTestCertificate writes a new processing certificate and its key for
+// merchantID to the given files, and returns the public key hash
+func writeTestCertificate(merchantID, certLocation, keyLocation string) []byte {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	cert := testCertificate(merchantID, key)
+	keyBytes, _ := x509.MarshalECPrivateKey(key)
+
+	os.WriteFile(certLocation, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: cert.Certificate[0],
+	}), 0600)
+	os.WriteFile(keyLocation, pem.EncodeToMemory(&pem.Block{
+		Type:  "EC PRIVATE KEY",
+		Bytes: keyBytes,
+	}), 0600)
+
+	hash, _ := publicKeyHash(cert)
+	return hash
+}
+
+// closingRoundTripper counts the calls to CloseIdleConnections
+type closingRoundTripper struct {
+	http.RoundTripper
+	closes int
+}
+
+func (t *closingRoundTripper) CloseIdleConnections() {
+	t.closes++
+}
+
+func TestReloadCertificates(t *testing.T) {
+	merchantID := "merchant.com.processout.test"
+	dir := t.TempDir()
+	certLocation := filepath.Join(dir, "cert-processing.crt")
+	keyLocation := filepath.Join(dir, "cert-processing-key.pem")
+
+	Convey("Renewed certificates are loaded", t, func() {
+		oldHash := writeTestCertificate(merchantID, certLocation, keyLocation)
+		m, _ := New(merchantID, ProcessingCertificateLocation(certLocation, keyLocation))
+		newHash := writeTestCertificate(merchantID, certLocation, keyLocation)
+
+		err := m.ReloadCertificates()
+
+		Convey("err should be nil", func() {
+			So(err, ShouldBeNil)
+		})
+
+		Convey("the new certificate replaces the old one", func() {
+			So(m.keys().processingKeys, ShouldHaveLength, 1)
+			So(m.keys().processingKeys, ShouldContainKey, string(newHash))
+			So(m.keys().processingKeys, ShouldNotContainKey, string(oldHash))
+		})
+	})
+
+	Convey("Invalid certificates keep the previous ones", t, func() {
+		oldHash := writeTestCertificate(merchantID, certLocation, keyLocation)
+		m, _ := New(merchantID, ProcessingCertificateLocation(certLocation, keyLocation))
+		os.WriteFile(certLocation, []byte("invalid certificate"), 0600)
+
+		err := m.ReloadCertificates()
+
+		Convey("err should be correct", func() {
+			So(err.Error(), ShouldStartWith, "error reloading the certificates")
+		})
+
+		Convey("the previous certificate is kept", func() {
+			So(m.keys().processingKeys, ShouldContainKey, string(oldHash))
+		})
+	})
+
+	Convey("Only the certificate options are applied again", t, func() {
+		writeTestCertificate(merchantID, certLocation, keyLocation)
+		calls := 0
+		once := func(m *Merchant) error {
+			if calls++; calls > 1 {
+				return errors.New("applied again")
+			}
+			return nil
+		}
+		m, err := New(merchantID, ProcessingCertificateLocation(certLocation, keyLocation), once)
+		So(err, ShouldBeNil)
+		newHash := writeTestCertificate(merchantID, certLocation, keyLocation)
+
+		So(m.ReloadCertificates(), ShouldBeNil)
+		So(calls, ShouldEqual, 1)
+		So(m.certificateOptions, ShouldHaveLength, 1)
+		So(m.keys().processingKeys, ShouldHaveLength, 1)
+		So(m.keys().processingKeys, ShouldContainKey, string(newHash))
+	})
+
+	Convey("Idle connections are closed", t, func() {
+		writeTestCertificate(merchantID, certLocation, keyLocation)
+		transport := &closingRoundTripper{}
+		m, _ := New(
+			merchantID,
+			ProcessingCertificateLocation(certLocation, keyLocation),
+			MerchantRoundTripper(transport),
+		)
+
+		So(m.ReloadCertificates(), ShouldBeNil)
+		So(transport.closes, ShouldEqual, 1)
+	})
+
+	Convey("Concurrent readers see consistent certificates", t, func() {
+		writeTestCertificate(merchantID, certLocation, keyLocation)
+		m, _ := New(merchantID, ProcessingCertificateLocation(certLocation, keyLocation))
+
+		wg := &sync.WaitGroup{}
+		for i := 0; i < 10; i++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				m.ReloadCertificates()
+			}()
+			go func() {
+				defer wg.Done()
+				m.DecryptToken(&PKPaymentToken{})
+			}()
+		}
+		wg.Wait()
+
+		So(m.keys().processingKeys, ShouldHaveLength, 1)
+	})
+}
+
+func TestWatchCertificates(t *testing.T) {
+	merchantID := "merchant.com.processout.test"
+	dir := t.TempDir()
+	certLocation := filepath.Join(dir, "cert-processing.crt")
+	keyLocation := filepath.Join(dir, "cert-processing-key.pem")
+
+	Convey("Certificates are reloaded when the files change", t, func() {
+		writeTestCertificate(merchantID, certLocation, keyLocation)
+		m, _ := New(merchantID, ProcessingCertificateLocation(certLocation, keyLocation))
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		m.WatchCertificates(ctx, 10*time.Millisecond, nil)
+
+		// Make sure the modification time changes
+		time.Sleep(20 * time.Millisecond)
+		newHash := writeTestCertificate(merchantID, certLocation, keyLocation)
+
+		reloaded := false
+		for i := 0; i < 100 && !reloaded; i++ {
+			time.Sleep(10 * time.Millisecond)
+			_, reloaded = m.keys().processingKeys[string(newHash)]
+		}
+
+		So(reloaded, ShouldBeTrue)
+	})
+
+	Convey("Files added by other options are watched", t, func() {
+		writeTestCertificate(merchantID, certLocation, keyLocation)
+		m, _ := New(merchantID, WatchFile(certLocation))
+		state := m.certificateFilesState()
+
+		time.Sleep(20 * time.Millisecond)
+		writeTestCertificate(merchantID, certLocation, keyLocation)
+
+		So(m.certificateFiles, ShouldResemble, []string{certLocation})
+		So(m.certificateFilesState(), ShouldNotEqual, state)
+	})
+
+	Convey("Reload errors are reported", t, func() {
+		writeTestCertificate(merchantID, certLocation, keyLocation)
+		m, _ := New(merchantID, ProcessingCertificateLocation(certLocation, keyLocation))
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		errs := make(chan error, 1)
+		m.WatchCertificates(ctx, 10*time.Millisecond, func(err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		})
+
+		time.Sleep(20 * time.Millisecond)
+		os.WriteFile(keyLocation, []byte("invalid key"), 0600)
+
+		select {
+		case err := <-errs:
+			So(err.Error(), ShouldStartWith, "error reloading the certificates")
+		case <-time.After(time.Second):
+			So("no error reported", ShouldBeEmpty)
+		}
+	})
+}
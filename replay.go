@@ -0,0 +1,147 @@
+package applepay
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type (
+	// ReplayStore records the transactions of the tokens already decrypted,
+	// to reject the tokens submitted again
+	ReplayStore interface {
+		// CheckAndSet atomically records transactionID until expiresAt, and
+		// returns false if it was already recorded and not expired at now
+		CheckAndSet(transactionID string, now, expiresAt time.Time) (bool, error)
+	}
+
+	// MemoryReplayStore is an in-memory ReplayStore, sharded to limit the
+	// contention. It is only suitable for a single instance.
+	MemoryReplayStore struct {
+		shards []*replayShard
+	}
+
+	// replayShard holds the expiration time of a subset of the transactions
+	replayShard struct {
+		mu          sync.Mutex
+		expirations map[string]time.Time
+		// nextSweep is the size above which expired transactions are removed
+		nextSweep int
+	}
+)
+
+const (
+	// replayShardCount is the number of shards of a MemoryReplayStore
+	replayShardCount = 32
+	// minReplaySweep is the minimum size of a shard before removing its
+	// expired transactions
+	minReplaySweep = 64
+)
+
+// MerchantReplayStore rejects the tokens whose transaction was already
+// recorded in store. Transactions are recorded once their tokens are
+// decrypted and pass every check, for as long as their tokens pass the
+// signing time check.
+func MerchantReplayStore(store ReplayStore) func(*Merchant) error {
+	return func(m *Merchant) error {
+		if store == nil {
+			return newError(
+				CodeInvalidConfiguration,
+				errors.New("nil replay store"),
+			)
+		}
+		m.replayStore = store
+		return nil
+	}
+}
+
+// checkReplay records the transaction of t, and rejects it if it was already
+// recorded
+func (m Merchant) checkReplay(t *PKPaymentToken) error {
+	if m.replayStore == nil {
+		return nil
+	}
+	if t.PaymentData.Header.TransactionID == "" {
+		return newError(CodeMalformedToken, errors.New("empty transaction ID"))
+	}
+
+	// Tokens received now are accepted if signed up to FutureSkew later, and
+	// for PastWindow after their signing
+	policy := m.policy()
+	now := t.receptionTime(policy)
+	expiresAt := now.Add(policy.FutureSkew).Add(policy.PastWindow)
+
+	fresh, err := m.replayStore.CheckAndSet(t.PaymentData.Header.TransactionID, now, expiresAt)
+	if err != nil {
+		return newError(
+			CodeReplayStore,
+			errors.Wrap(err, "error checking the transaction ID"),
+		)
+	}
+	if !fresh {
+		return newError(
+			CodeReplayedToken,
+			errors.Errorf("transaction %s was already processed", t.PaymentData.Header.TransactionID),
+		)
+	}
+	return nil
+}
+
+// NewMemoryReplayStore creates an empty MemoryReplayStore
+func NewMemoryReplayStore() *MemoryReplayStore {
+	s := &MemoryReplayStore{
+		shards: make([]*replayShard, replayShardCount),
+	}
+	for i := range s.shards {
+		s.shards[i] = &replayShard{
+			expirations: make(map[string]time.Time),
+			nextSweep:   minReplaySweep,
+		}
+	}
+	return s
+}
+
+// CheckAndSet implements ReplayStore
+func (s *MemoryReplayStore) CheckAndSet(transactionID string,
+	now, expiresAt time.Time) (bool, error) {
+
+	h := fnv.New32a()
+	h.Write([]byte(transactionID))
+	shard := s.shards[h.Sum32()%uint32(len(s.shards))]
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if expiration, ok := shard.expirations[transactionID]; ok && now.Before(expiration) {
+		return false, nil
+	}
+	shard.expirations[transactionID] = expiresAt
+
+	// Remove the expired transactions once the shard doubled in size
+	if len(shard.expirations) >= shard.nextSweep {
+		for id, expiration := range shard.expirations {
+			if !now.Before(expiration) {
+				delete(shard.expirations, id)
+			}
+		}
+		shard.nextSweep = 2 * len(shard.expirations)
+		if shard.nextSweep < minReplaySweep {
+			shard.nextSweep = minReplaySweep
+		}
+	}
+	return true, nil
+}
+
+// Len returns the number of transactions recorded, including the expired
+// ones not removed yet
+func (s *MemoryReplayStore) Len() int {
+	n := 0
+	for _, shard := range s.shards {
+		shard.mu.Lock()
+		n += len(shard.expirations)
+		shard.mu.Unlock()
+	}
+	return n
+}
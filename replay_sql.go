@@ -0,0 +1,135 @@
+package applepay
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type (
+	// SQLReplayStore is a ReplayStore backed by a database/sql table, to be
+	// shared by several instances. The table can be created with CreateTable.
+	// Expiration times are rounded up to the second.
+	SQLReplayStore struct {
+		db          *sql.DB
+		table       string
+		placeholder SQLPlaceholder
+	}
+
+	// SQLPlaceholder returns the placeholder of the n-th argument of a query,
+	// starting from 1, in the syntax of the database driver
+	SQLPlaceholder func(n int) string
+)
+
+var (
+	// QuestionPlaceholder is the placeholder syntax of SQLite and MySQL
+	QuestionPlaceholder SQLPlaceholder = func(int) string {
+		return "?"
+	}
+	// DollarPlaceholder is the placeholder syntax of PostgreSQL
+	DollarPlaceholder SQLPlaceholder = func(n int) string {
+		return "$" + strconv.Itoa(n)
+	}
+
+	// sqlIdentifierRegexp matches the table names accepted by SQLReplayStore
+	sqlIdentifierRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// NewSQLReplayStore creates a replay store using table of db. placeholder
+// defaults to QuestionPlaceholder if nil.
+func NewSQLReplayStore(db *sql.DB, table string,
+	placeholder SQLPlaceholder) (*SQLReplayStore, error) {
+
+	if db == nil {
+		return nil, newError(CodeInvalidConfiguration, errors.New("nil database"))
+	}
+	if !sqlIdentifierRegexp.MatchString(table) {
+		return nil, newError(
+			CodeInvalidConfiguration,
+			errors.Errorf("invalid table name %q", table),
+		)
+	}
+	if placeholder == nil {
+		placeholder = QuestionPlaceholder
+	}
+	return &SQLReplayStore{
+		db:          db,
+		table:       table,
+		placeholder: placeholder,
+	}, nil
+}
+
+// CreateTable creates the table of the store if it does not exist yet
+func (s *SQLReplayStore) CreateTable() error {
+	_, err := s.db.Exec(fmt.Sprintf(
+		`CREATE TABLE IF NOT EXISTS %s (
+			transaction_id VARCHAR(255) NOT NULL PRIMARY KEY,
+			expires_at BIGINT NOT NULL
+		)`,
+		s.table,
+	))
+	return errors.Wrap(err, "error creating the replay table")
+}
+
+// CheckAndSet implements ReplayStore. The primary key of the table makes
+// concurrent calls for the same transaction fail, except one.
+func (s *SQLReplayStore) CheckAndSet(transactionID string,
+	now, expiresAt time.Time) (bool, error) {
+
+	// Remove the transaction if expired, so that it can be inserted again
+	_, err := s.db.Exec(fmt.Sprintf(
+		"DELETE FROM %s WHERE transaction_id = %s AND expires_at <= %s",
+		s.table, s.placeholder(1), s.placeholder(2),
+	), transactionID, now.Unix())
+	if err != nil {
+		return false, errors.Wrap(err, "error removing the expired transaction")
+	}
+
+	_, insertErr := s.db.Exec(fmt.Sprintf(
+		"INSERT INTO %s (transaction_id, expires_at) VALUES (%s, %s)",
+		s.table, s.placeholder(1), s.placeholder(2),
+	), transactionID, unixCeil(expiresAt))
+	if insertErr == nil {
+		return true, nil
+	}
+
+	// Drivers report duplicate keys differently: check whether the
+	// transaction exists instead
+	var count int
+	err = s.db.QueryRow(fmt.Sprintf(
+		"SELECT COUNT(*) FROM %s WHERE transaction_id = %s",
+		s.table, s.placeholder(1),
+	), transactionID).Scan(&count)
+	if err != nil {
+		return false, errors.Wrap(err, "error reading the transaction")
+	}
+	if count == 0 {
+		return false, errors.Wrap(insertErr, "error recording the transaction")
+	}
+	return false, nil
+}
+
+// Purge removes the transactions expired at now, and returns their number
+func (s *SQLReplayStore) Purge(now time.Time) (int64, error) {
+	res, err := s.db.Exec(fmt.Sprintf(
+		"DELETE FROM %s WHERE expires_at <= %s",
+		s.table, s.placeholder(1),
+	), now.Unix())
+	if err != nil {
+		return 0, errors.Wrap(err, "error removing the expired transactions")
+	}
+	return res.RowsAffected()
+}
+
+// unixCeil returns t as a Unix time in seconds, rounded up so that
+// transactions do not expire early
+func unixCeil(t time.Time) int64 {
+	if t.Nanosecond() > 0 {
+		return t.Unix() + 1
+	}
+	return t.Unix()
+}
@@ -0,0 +1,31 @@
+package applepay
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// The stores are tested with SQLite in internal/sqlitetest, a separate module
+// keeping the cgo driver out of the dependencies of applepay
+
+func TestSQLReplayStore(t *testing.T) {
+	Convey("Invalid table names are rejected", t, func() {
+		_, err := NewSQLReplayStore(&sql.DB{}, "transactions; DROP TABLE users", nil)
+
+		So(errors.Is(err, ErrInvalidConfiguration), ShouldBeTrue)
+	})
+
+	Convey("Databases are required", t, func() {
+		_, err := NewSQLReplayStore(nil, "applepay_transactions", nil)
+
+		So(errors.Is(err, ErrInvalidConfiguration), ShouldBeTrue)
+	})
+
+	Convey("Placeholders follow the driver syntax", t, func() {
+		So(QuestionPlaceholder(2), ShouldEqual, "?")
+		So(DollarPlaceholder(2), ShouldEqual, "$2")
+	})
+}
@@ -0,0 +1,246 @@
+package applepay
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mozilla.org/pkcs7"
+)
+
+// failingReplayStore fails every check
+type failingReplayStore struct{}
+
+func (failingReplayStore) CheckAndSet(string, time.Time, time.Time) (bool, error) {
+	return false, errors.New("unavailable")
+}
+
+// flakyKeyProvider is a KeyProvider failing its first ECDH operation, standing
+// for a transient error of an external key store
+type flakyKeyProvider struct {
+	*MemoryKeyProvider
+	failed bool
+}
+
+func (p *flakyKeyProvider) ECDH(pub *ecdh.PublicKey) ([]byte, error) {
+	if !p.failed {
+		p.failed = true
+		return nil, errors.New("session closed")
+	}
+	return p.MemoryKeyProvider.ECDH(pub)
+}
+
+// newTestToken creates an EC_v1 token of plaintext, encrypted for the
+// processing certificate cert of merchantID, and signed by a test chain
+// trusted by the returned policy
+func newTestToken(merchantID string, cert tls.Certificate,
+	plaintext []byte) (*PKPaymentToken, VerificationPolicy) {
+
+	processingKey, _ := cert.PrivateKey.(*ecdsa.PrivateKey).ECDH()
+	ephemeral, _ := ecdh.P256().GenerateKey(rand.Reader)
+	secret, _ := ephemeral.ECDH(processingKey.PublicKey())
+	merchantIDHash := sha256.Sum256([]byte(merchantID))
+	block, _ := aes.NewCipher(deriveEncryptionKey(secret, merchantIDHash[:]))
+	aesGCM, _ := cipher.NewGCMWithNonceSize(block, 16)
+	transactionID := make([]byte, 32)
+	rand.Read(transactionID)
+
+	token := &PKPaymentToken{}
+	token.PaymentData.Version = string(vEC_v1)
+	token.PaymentData.Data = aesGCM.Seal(nil, make([]byte, 16), plaintext, nil)
+	token.PaymentData.Header.EphemeralPublicKey, _ = x509.MarshalPKIXPublicKey(ephemeral.PublicKey())
+	token.PaymentData.Header.PublicKeyHash, _ = publicKeyHash(cert)
+	token.PaymentData.Header.TransactionID = hex.EncodeToString(transactionID)
+
+	leaf, inter, leafKey, _ := newSigningChain()
+	sd, _ := pkcs7.NewSignedData(token.signedData())
+	sd.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	sd.AddSignerChain(leaf, leafKey, []*x509.Certificate{inter}, pkcs7.SignerInfoConfig{})
+	sd.Detach()
+	token.PaymentData.Signature, _ = sd.Finish()
+
+	policy := DefaultVerificationPolicy()
+	policy.Roots = x509.NewCertPool()
+	policy.Roots.AddCert(inter)
+	return token, policy
+}
+
+// testReplayStore runs the tests common to every ReplayStore
+func testReplayStore(store ReplayStore) {
+	// SQL stores have a precision of a second
+	now := time.Now().Truncate(time.Second)
+
+	Convey("Transactions are only accepted once", func() {
+		fresh, err := store.CheckAndSet("transaction", now, now.Add(time.Minute))
+		So(err, ShouldBeNil)
+		So(fresh, ShouldBeTrue)
+
+		fresh, err = store.CheckAndSet("transaction", now.Add(time.Second), now.Add(time.Minute))
+		So(err, ShouldBeNil)
+		So(fresh, ShouldBeFalse)
+
+		fresh, err = store.CheckAndSet("other", now, now.Add(time.Minute))
+		So(err, ShouldBeNil)
+		So(fresh, ShouldBeTrue)
+	})
+
+	Convey("Expired transactions are accepted again", func() {
+		store.CheckAndSet("expiring", now, now.Add(time.Minute))
+
+		fresh, err := store.CheckAndSet("expiring", now.Add(time.Minute), now.Add(2*time.Minute))
+
+		So(err, ShouldBeNil)
+		So(fresh, ShouldBeTrue)
+	})
+
+	Convey("Concurrent submissions are only accepted once", func() {
+		accepted := int32(0)
+		wg := sync.WaitGroup{}
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if fresh, err := store.CheckAndSet("concurrent", now, now.Add(time.Minute)); err == nil && fresh {
+					atomic.AddInt32(&accepted, 1)
+				}
+			}()
+		}
+		wg.Wait()
+
+		So(accepted, ShouldEqual, 1)
+	})
+}
+
+func TestMemoryReplayStore(t *testing.T) {
+	Convey("Memory stores implement ReplayStore", t, func() {
+		testReplayStore(NewMemoryReplayStore())
+	})
+
+	Convey("Expired transactions are removed", t, func() {
+		store := NewMemoryReplayStore()
+		now := time.Now()
+		for i := 0; i < 100*replayShardCount; i++ {
+			store.CheckAndSet(fmt.Sprint(i), now, now.Add(time.Minute))
+		}
+		for i := 0; i < 100*replayShardCount; i++ {
+			store.CheckAndSet(fmt.Sprint("later", i), now.Add(time.Hour), now.Add(2*time.Hour))
+		}
+
+		So(store.Len(), ShouldBeLessThan, 200*replayShardCount)
+	})
+}
+
+func TestMerchantReplayStore(t *testing.T) {
+	token := &PKPaymentToken{}
+	token.PaymentData.Header.TransactionID = "d60e5b29daaf960c9837d15f1e968e1bb3ad124fe7fa4f85482d7d53789c273f"
+	token.SetTransactionTime(testTokenSigningTime)
+
+	Convey("Nil stores are rejected", t, func() {
+		_, err := New("merchant.com.processout.test", MerchantReplayStore(nil))
+
+		So(errors.Is(err, ErrInvalidConfiguration), ShouldBeTrue)
+	})
+
+	Convey("Replayed tokens are rejected", t, func() {
+		m, _ := New("merchant.com.processout.test", MerchantReplayStore(NewMemoryReplayStore()))
+
+		So(m.checkReplay(token), ShouldBeNil)
+
+		err := m.checkReplay(token)
+		So(errors.Is(err, ErrReplayedToken), ShouldBeTrue)
+		So(err.Error(), ShouldEqual, "transaction d60e5b29daaf960c9837d15f1e968e1bb3ad124fe7fa4f85482d7d53789c273f was already processed")
+	})
+
+	Convey("Transactions are recorded for the signing time window", t, func() {
+		policy := DefaultVerificationPolicy()
+		policy.PastWindow = 5 * time.Minute
+		m, _ := New(
+			"merchant.com.processout.test",
+			MerchantVerificationPolicy(policy),
+			MerchantReplayStore(NewMemoryReplayStore()),
+		)
+		m.checkReplay(token)
+
+		replayed := *token
+		replayed.SetTransactionTime(testTokenSigningTime.Add(5 * time.Minute))
+		So(errors.Is(m.checkReplay(&replayed), ErrReplayedToken), ShouldBeTrue)
+
+		replayed.SetTransactionTime(testTokenSigningTime.Add(5*time.Minute + time.Second))
+		So(m.checkReplay(&replayed), ShouldBeNil)
+	})
+
+	Convey("Tokens without transaction ID are rejected", t, func() {
+		m, _ := New("merchant.com.processout.test", MerchantReplayStore(NewMemoryReplayStore()))
+
+		err := m.checkReplay(&PKPaymentToken{})
+
+		So(errors.Is(err, ErrMalformedToken), ShouldBeTrue)
+	})
+
+	Convey("Store failures are reported", t, func() {
+		m, _ := New("merchant.com.processout.test", MerchantReplayStore(failingReplayStore{}))
+
+		err := m.checkReplay(token)
+
+		So(errors.Is(err, ErrReplayStore), ShouldBeTrue)
+	})
+
+	Convey("Transactions are only recorded once their token is decrypted", t, func() {
+		merchantID := "merchant.com.processout.test"
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		cert := testCertificate(merchantID, key)
+		leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+		memoryProvider, _ := NewMemoryKeyProvider(key)
+		token, policy := newTestToken(merchantID, cert, []byte(`{"currencyCode":"978","transactionAmount":1099}`))
+		m, err := New(
+			merchantID,
+			ProcessingKeyProvider(leaf, &flakyKeyProvider{MemoryKeyProvider: memoryProvider}),
+			MerchantVerificationPolicy(policy),
+			MerchantReplayStore(NewMemoryReplayStore()),
+		)
+		So(err, ShouldBeNil)
+
+		Convey("Tokens failing to decrypt can be submitted again", func() {
+			_, err := m.DecryptToken(token)
+			So(errors.Is(err, ErrDecryptionFailed), ShouldBeTrue)
+
+			res, err := m.DecryptToken(token)
+			So(err, ShouldBeNil)
+			So(res.TransactionAmount, ShouldResemble, NewAmount(1099))
+
+			_, err = m.DecryptToken(token)
+			So(errors.Is(err, ErrReplayedToken), ShouldBeTrue)
+		})
+
+		Convey("Tokens failing the checks can be submitted again", func() {
+			m.DecryptToken(token)
+
+			_, err := m.DecryptToken(token, ExpectedOrder("10.00", "EUR", "order"))
+			So(errors.Is(err, ErrAmountMismatch), ShouldBeTrue)
+
+			_, err = m.DecryptToken(token, ExpectedOrder("10.99", "EUR", "order"))
+			So(err, ShouldBeNil)
+		})
+	})
+
+	Convey("Merchants without a store accept replays", t, func() {
+		m, _ := New("merchant.com.processout.test")
+
+		So(m.checkReplay(token), ShouldBeNil)
+		So(m.checkReplay(token), ShouldBeNil)
+	})
+}
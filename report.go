@@ -0,0 +1,303 @@
+package applepay
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mozilla.org/pkcs7"
+)
+
+type (
+	// VerificationReport describes every step of the verification of a
+	// token's signature, to debug the tokens that are rejected
+	VerificationReport struct {
+		Version      string
+		Certificates []CertificateReport
+		// SigningTime is the time the token was signed at, and
+		// TransactionTime the time it was received at
+		SigningTime     time.Time
+		TransactionTime time.Time
+		// SigningTimeDelta is the time elapsed between the signing and the
+		// reception of the token
+		SigningTimeDelta time.Duration
+		Checks           []VerificationCheck
+	}
+
+	// CertificateReport describes a certificate of the signature
+	CertificateReport struct {
+		// Role is "leaf", "intermediate", or empty for other certificates
+		Role         string
+		Subject      string
+		Issuer       string
+		SerialNumber *big.Int
+		NotBefore    time.Time
+		NotAfter     time.Time
+		// HasLeafOID and HasIntermediateOID tell whether the certificate
+		// contains Apple's marker OIDs
+		HasLeafOID         bool
+		HasIntermediateOID bool
+	}
+
+	// VerificationCheck is the result of a step of the verification
+	VerificationCheck struct {
+		Name   string
+		Status CheckStatus
+		// Details explains the failure of the check, or gives the values
+		// checked
+		Details string
+		// Code is the error code of the failure, if any
+		Code ErrorCode
+	}
+
+	// CheckStatus is the outcome of a VerificationCheck
+	CheckStatus string
+)
+
+const (
+	// Statuses of the checks
+	CheckPassed  CheckStatus = "passed"
+	CheckFailed  CheckStatus = "failed"
+	CheckSkipped CheckStatus = "skipped"
+)
+
+// VerifySignatureReport calls
+// VerifySignatureReportContext(context.Background(), t)
+func (m Merchant) VerifySignatureReport(t *PKPaymentToken) *VerificationReport {
+	return m.VerifySignatureReportContext(context.Background(), t)
+}
+
+// VerifySignatureReportContext runs every step of the verification of the
+// token's signature with the merchant's policy, without stopping at the first
+// failure. Steps depending on a failed one are skipped. The revocation
+// statuses of the signing certificates are fetched until ctx is done.
+func (m Merchant) VerifySignatureReportContext(ctx context.Context,
+	t *PKPaymentToken) *VerificationReport {
+
+	return m.policy().verifySignatureReport(ctx, t)
+}
+
+// verifySignatureReport runs the steps of verifySignature and reports their
+// results
+func (p VerificationPolicy) verifySignatureReport(ctx context.Context,
+	t *PKPaymentToken) *VerificationReport {
+
+	r := &VerificationReport{}
+	if t == nil {
+		r.fail("token", newError(CodeMalformedToken, errors.New("nil token")))
+		return r
+	}
+	r.Version = t.PaymentData.Version
+
+	scheme, err := lookupScheme(t.PaymentData.Version)
+	r.check("version", err, t.PaymentData.Version)
+
+	p7, err := pkcs7.Parse(t.PaymentData.Signature)
+	r.check("pkcs7_parse", withDefaultCode(CodeInvalidSignature, err), "")
+	if err != nil {
+		for _, name := range []string{
+			"certificates", "signing_time", "leaf_validity",
+			"intermediate_validity", "chain", "signer",
+			"signature_algorithm", "signature", "signing_time_window",
+			"revocation",
+		} {
+			r.skip(name, "the signature cannot be parsed")
+		}
+		return r
+	}
+
+	for _, cert := range p7.Certificates {
+		_, leafErr := extractExtension(cert, p.LeafCertificateOID)
+		_, interErr := extractExtension(cert, p.IntermediateCertificateOID)
+		r.Certificates = append(r.Certificates, CertificateReport{
+			Subject:            cert.Subject.String(),
+			Issuer:             cert.Issuer.String(),
+			SerialNumber:       cert.SerialNumber,
+			NotBefore:          cert.NotBefore,
+			NotAfter:           cert.NotAfter,
+			HasLeafOID:         leafErr == nil,
+			HasIntermediateOID: interErr == nil,
+		})
+	}
+
+	leaf, inter, err := p.signingCertificates(p7)
+	if err == nil {
+		for i, cert := range p7.Certificates {
+			switch cert {
+			case leaf:
+				r.Certificates[i].Role = "leaf"
+			case inter:
+				r.Certificates[i].Role = "intermediate"
+			}
+		}
+		r.check("certificates", nil, fmt.Sprintf(
+			"leaf %s, intermediate %s",
+			leaf.Subject.CommonName,
+			inter.Subject.CommonName,
+		))
+	} else {
+		r.check("certificates", newError(CodeUntrustedChain, err), "")
+	}
+
+	signingTime, err := extractSigningTime(p7)
+	if err == nil {
+		r.SigningTime = signingTime
+		r.check("signing_time", nil, signingTime.UTC().Format(time.RFC3339))
+	} else {
+		r.check("signing_time", newError(CodeInvalidSignature, err), "")
+	}
+
+	var chain []*x509.Certificate
+	switch {
+	case leaf == nil:
+		r.skip("leaf_validity", "the certificates cannot be located")
+		r.skip("intermediate_validity", "the certificates cannot be located")
+		r.skip("chain", "the certificates cannot be located")
+		r.skip("signer", "the certificates cannot be located")
+	case signingTime.IsZero():
+		r.skip("leaf_validity", "the signing time is missing")
+		r.skip("intermediate_validity", "the signing time is missing")
+		r.skip("chain", "the signing time is missing")
+	default:
+		err := checkValidityAt(leaf, "leaf", signingTime)
+		r.check("leaf_validity", withDefaultCode(CodeUntrustedChain, err), "")
+		err = checkValidityAt(inter, "intermediate", signingTime)
+		r.check("intermediate_validity", withDefaultCode(CodeUntrustedChain, err), "")
+
+		roots, err := p.roots()
+		if err == nil {
+			chain, err = p.verifyCertificates(roots, inter, leaf, signingTime)
+			err = withDefaultCode(CodeUntrustedChain, err)
+		} else {
+			err = newError(CodeInvalidConfiguration, err)
+		}
+		r.check("chain", err, "")
+	}
+	if leaf != nil {
+		r.check("signer", withDefaultCode(CodeInvalidSignature, verifySigner(p7, leaf)), "")
+	}
+
+	if scheme == nil {
+		r.skip("signature_algorithm", "the version is not supported")
+		r.skip("signature", "the version is not supported")
+	} else {
+		err := verifySignatureAlgorithm(p7, scheme.SignatureAlgorithm())
+		r.check("signature_algorithm", withDefaultCode(CodeInvalidSignature, err), scheme.SignatureAlgorithm().String())
+
+		p7.Content = scheme.SignedData(t)
+		r.check("signature", withDefaultCode(CodeInvalidSignature, p7.Verify()), "")
+	}
+
+	if signingTime.IsZero() {
+		r.skip("signing_time_window", "the signing time is missing")
+	} else {
+		r.TransactionTime = t.receptionTime(p)
+		r.SigningTimeDelta = r.TransactionTime.Sub(signingTime)
+		r.check("signing_time_window", t.verifySigningTime(p7, p), fmt.Sprintf(
+			"%s between the signing and the transaction, allowed from -%s to %s",
+			r.SigningTimeDelta,
+			p.FutureSkew,
+			p.PastWindow,
+		))
+	}
+
+	// As in verifySignature, revocations are only checked for the tokens
+	// signed by the leaf
+	switch {
+	case chain == nil:
+		r.skip("revocation", "the chain is not trusted")
+	case r.Check("signer").Status != CheckPassed || r.Check("signature").Status != CheckPassed:
+		r.skip("revocation", "the signature is invalid")
+	default:
+		err := p.Revocation.checkChain(ctx, chain, p.Now())
+		r.check("revocation", err, "")
+	}
+
+	return r
+}
+
+// check records the result of the check name. details are reported if it
+// passed.
+func (r *VerificationReport) check(name string, err error, details string) {
+	if err != nil {
+		r.fail(name, err)
+		return
+	}
+	r.Checks = append(r.Checks, VerificationCheck{
+		Name:    name,
+		Status:  CheckPassed,
+		Details: details,
+	})
+}
+
+// fail records the failure of the check name
+func (r *VerificationReport) fail(name string, err error) {
+	r.Checks = append(r.Checks, VerificationCheck{
+		Name:    name,
+		Status:  CheckFailed,
+		Details: err.Error(),
+		Code:    ErrorCodeOf(err),
+	})
+}
+
+// skip records that the check name could not be run
+func (r *VerificationReport) skip(name, reason string) {
+	r.Checks = append(r.Checks, VerificationCheck{
+		Name:    name,
+		Status:  CheckSkipped,
+		Details: reason,
+	})
+}
+
+// Passed returns whether every check passed
+func (r VerificationReport) Passed() bool {
+	for _, c := range r.Checks {
+		if c.Status != CheckPassed {
+			return false
+		}
+	}
+	return len(r.Checks) > 0
+}
+
+// Check returns the check named name, or nil if it is not part of the report
+func (r VerificationReport) Check(name string) *VerificationCheck {
+	for i := range r.Checks {
+		if r.Checks[i].Name == name {
+			return &r.Checks[i]
+		}
+	}
+	return nil
+}
+
+// String renders the report as text
+func (r VerificationReport) String() string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "version: %s\n", r.Version)
+	for _, c := range r.Certificates {
+		role := c.Role
+		if role == "" {
+			role = "other"
+		}
+		fmt.Fprintf(b, "certificate (%s): %s\n", role, c.Subject)
+		fmt.Fprintf(b, "  issuer: %s\n", c.Issuer)
+		fmt.Fprintf(b, "  serial: %x\n", c.SerialNumber)
+		fmt.Fprintf(b, "  validity: %s to %s\n",
+			c.NotBefore.UTC().Format(time.RFC3339),
+			c.NotAfter.UTC().Format(time.RFC3339),
+		)
+		fmt.Fprintf(b, "  marker OIDs: leaf %t, intermediate %t\n",
+			c.HasLeafOID, c.HasIntermediateOID)
+	}
+	for _, c := range r.Checks {
+		fmt.Fprintf(b, "%-22s %-7s %s", c.Name, c.Status, c.Details)
+		if c.Code != "" {
+			fmt.Fprintf(b, " (%s)", c.Code)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,113 @@
+package applepay
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestVerifySignatureReport(t *testing.T) {
+	tokenJSON, _ := os.ReadFile("tests/token.json")
+	token := &PKPaymentToken{}
+	json.Unmarshal(tokenJSON, token)
+	received := *token
+	received.SetTransactionTime(testTokenSigningTime.Add(time.Minute))
+
+	Convey("Valid tokens pass every check", t, func() {
+		m, _ := New("merchant.com.processout.test")
+
+		r := m.VerifySignatureReport(&received)
+
+		So(r.Passed(), ShouldBeTrue)
+		So(r.Version, ShouldEqual, "EC_v1")
+		So(r.SigningTime.Equal(testTokenSigningTime), ShouldBeTrue)
+		So(r.SigningTimeDelta, ShouldEqual, time.Minute)
+		So(r.Certificates, ShouldHaveLength, 2)
+		So(r.Certificates[0].Role, ShouldEqual, "leaf")
+		So(r.Certificates[0].HasLeafOID, ShouldBeTrue)
+		So(r.Certificates[1].Role, ShouldEqual, "intermediate")
+		So(r.Certificates[1].Subject, ShouldContainSubstring, "Apple Application Integration CA - G3")
+	})
+
+	Convey("Every check runs after a failure", t, func() {
+		policy := DefaultVerificationPolicy()
+		policy.PastWindow = 5 * time.Minute
+		m := testPolicyMerchant(policy)
+		replayed := *token
+		replayed.SetTransactionTime(testTokenSigningTime.Add(time.Hour))
+		replayed.PaymentData.Data = []byte("tampered")
+
+		r := m.VerifySignatureReport(&replayed)
+
+		So(r.Passed(), ShouldBeFalse)
+		So(r.Check("chain").Status, ShouldEqual, CheckPassed)
+		So(r.Check("signature").Status, ShouldEqual, CheckFailed)
+		So(r.Check("signature").Code, ShouldEqual, CodeInvalidSignature)
+		So(r.Check("signing_time_window").Status, ShouldEqual, CheckFailed)
+		So(r.Check("signing_time_window").Code, ShouldEqual, CodeSigningTimeOutOfWindow)
+		So(r.Check("revocation").Status, ShouldEqual, CheckSkipped)
+	})
+
+	Convey("Steps depending on a failed one are skipped", t, func() {
+		m, _ := New("merchant.com.processout.test")
+		broken := *token
+		broken.PaymentData.Version = "EC_v2"
+		broken.PaymentData.Signature = []byte("invalid")
+
+		r := m.VerifySignatureReport(&broken)
+
+		So(r.Check("version").Code, ShouldEqual, CodeUnsupportedVersion)
+		So(r.Check("pkcs7_parse").Status, ShouldEqual, CheckFailed)
+		So(r.Check("chain").Status, ShouldEqual, CheckSkipped)
+		So(r.Check("signing_time_window").Status, ShouldEqual, CheckSkipped)
+	})
+
+	Convey("Untrusted chains are reported", t, func() {
+		policy := DefaultVerificationPolicy()
+		policy.Roots = x509.NewCertPool()
+
+		r := policy.verifySignatureReport(context.Background(), &received)
+
+		So(r.Check("leaf_validity").Status, ShouldEqual, CheckPassed)
+		So(r.Check("chain").Code, ShouldEqual, CodeUntrustedChain)
+		So(r.Check("signature").Status, ShouldEqual, CheckPassed)
+	})
+
+	Convey("Revocations are fetched until the context is done", t, func() {
+		policy := DefaultVerificationPolicy()
+		policy.Revocation = NewRevocationChecker(RevocationHardFail, blockingFetcher{})
+		m := testPolicyMerchant(policy)
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		r := m.VerifySignatureReportContext(ctx, &received)
+
+		So(r.Check("signature").Status, ShouldEqual, CheckPassed)
+		So(r.Check("revocation").Code, ShouldEqual, CodeRevocationUnavailable)
+		So(time.Since(start), ShouldBeLessThan, time.Second)
+	})
+
+	Convey("Reports are rendered as text", t, func() {
+		m, _ := New("merchant.com.processout.test")
+
+		text := m.VerifySignatureReport(&received).String()
+
+		So(text, ShouldContainSubstring, "certificate (leaf): CN=ecc-smp-broker-sign_UC4-PROD")
+		So(text, ShouldContainSubstring, "signing_time_window    passed  1m0s between the signing and the transaction")
+	})
+
+	Convey("Nil tokens are reported", t, func() {
+		m, _ := New("merchant.com.processout.test")
+
+		r := m.VerifySignatureReport(nil)
+
+		So(r.Passed(), ShouldBeFalse)
+		So(r.Check("token").Code, ShouldEqual, CodeMalformedToken)
+	})
+}
@@ -0,0 +1,115 @@
+package applepay
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type (
+	// RetryPolicy retries the session requests failing temporarily:
+	// connection errors, 5xx and 429 responses. Retries stop before the
+	// deadline of the request's context.
+	RetryPolicy struct {
+		// MaxAttempts is the maximum number of attempts, including the first
+		// one
+		MaxAttempts int
+		// InitialBackoff is the wait before the first retry, doubled for each
+		// following retry. Waits are jittered down to half their value.
+		InitialBackoff time.Duration
+		// MaxBackoff bounds the wait between attempts
+		MaxBackoff time.Duration
+	}
+)
+
+// DefaultRetryPolicy returns a policy making up to 3 attempts, waiting up to
+// 100ms then 200ms between them
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+	}
+}
+
+// MerchantRetryPolicy sets the retries of session requests, which are not
+// retried by default
+func MerchantRetryPolicy(policy RetryPolicy) func(*Merchant) error {
+	return func(m *Merchant) error {
+		if policy.MaxAttempts < 1 {
+			return newError(
+				CodeInvalidConfiguration,
+				errors.New("the maximum number of attempts should be positive"),
+			)
+		}
+		if policy.InitialBackoff < 0 || policy.MaxBackoff < policy.InitialBackoff {
+			return newError(
+				CodeInvalidConfiguration,
+				errors.New("invalid backoff"),
+			)
+		}
+		m.retryPolicy = policy
+		return nil
+	}
+}
+
+// backoff returns the wait before the retry following attempt, starting from
+// 1. random returns a number in [0, n).
+func (p RetryPolicy) backoff(attempt int, random func(n int64) int64) time.Duration {
+	wait := p.InitialBackoff
+	for i := 1; i < attempt && wait < p.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > p.MaxBackoff {
+		wait = p.MaxBackoff
+	}
+	if wait < 2 {
+		return wait
+	}
+	half := wait / 2
+	return half + time.Duration(random(int64(wait-half)+1))
+}
+
+// isRetryable tells whether a failed session request can be sent again
+func isRetryable(err error) bool {
+	var sessionErr *SessionError
+	if errors.As(err, &sessionErr) {
+		return isGatewayStatusFailure(sessionErr.StatusCode)
+	}
+
+	// The request was not sent if the connection failed
+	var opErr *net.OpError
+	return errors.As(err, &opErr) &&
+		(opErr.Op == "dial" || opErr.Op == "proxyconnect")
+}
+
+// isGatewayStatusFailure tells whether Apple answered with a status
+// reporting a failure of the gateway
+func isGatewayStatusFailure(status int) bool {
+	return status >= 500 || status == http.StatusTooManyRequests
+}
+
+// sleepContext waits for d, unless ctx is done or its deadline is less than d
+// away. It returns false if it did not wait.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= d {
+		return false
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// randomBackoff is the random source of the backoff jitter
+func randomBackoff(n int64) int64 {
+	return rand.Int63n(n)
+}
@@ -0,0 +1,163 @@
+package applepay
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// sessionRoundTripper answers session requests with the responses, errors or
+// statuses, in order, and counts the requests
+func sessionRoundTripper(calls *int, answers ...interface{}) http.RoundTripper {
+	return roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		answer := answers[*calls]
+		*calls++
+		switch answer := answer.(type) {
+		case error:
+			return nil, answer
+		case int:
+			return sessionResponse(answer, `{"statusMessage":"failure"}`), nil
+		}
+		return sessionResponse(http.StatusOK, answer.(string)), nil
+	})
+}
+
+func TestRetryPolicy(t *testing.T) {
+	merchantID := "merchant.com.processout.test"
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	cert := testCertificate(merchantID, key)
+	sessionURL := "https://apple-pay-gateway.apple.com/paymentservices/paymentSession"
+	validSession := `{"epochTimestamp":1700000000000,"expiresAt":4102444800000,"merchantSessionIdentifier":"SSH1","nonce":"abcd","signature":"3080"}`
+	connectErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	fastRetries := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+	newMerchant := func(rt http.RoundTripper, options ...func(*Merchant) error) *Merchant {
+		m, err := New(merchantID, append([]func(*Merchant) error{
+			MerchantCertificate(cert),
+			MerchantRoundTripper(rt),
+		}, options...)...)
+		So(err, ShouldBeNil)
+		return m
+	}
+
+	Convey("Backoffs double up to the maximum, with jitter", t, func() {
+		p := RetryPolicy{MaxAttempts: 5, InitialBackoff: 100 * time.Millisecond, MaxBackoff: 300 * time.Millisecond}
+		lowest := func(int64) int64 { return 0 }
+		highest := func(n int64) int64 { return n - 1 }
+
+		So(p.backoff(1, lowest), ShouldEqual, 50*time.Millisecond)
+		So(p.backoff(1, highest), ShouldEqual, 100*time.Millisecond)
+		So(p.backoff(2, highest), ShouldEqual, 200*time.Millisecond)
+		So(p.backoff(3, highest), ShouldEqual, 300*time.Millisecond)
+		So(p.backoff(3, lowest), ShouldEqual, 150*time.Millisecond)
+		So(p.backoff(100, highest), ShouldEqual, 300*time.Millisecond)
+	})
+
+	Convey("Requests are sent once by default", t, func() {
+		calls := 0
+		m := newMerchant(sessionRoundTripper(&calls, http.StatusServiceUnavailable))
+
+		_, err := m.StartSession(sessionURL)
+
+		So(errors.Is(err, ErrSessionRejected), ShouldBeTrue)
+		So(calls, ShouldEqual, 1)
+	})
+
+	Convey("Gateway failures are retried", t, func() {
+		calls := 0
+		m := newMerchant(
+			sessionRoundTripper(&calls, connectErr, http.StatusTooManyRequests, validSession),
+			MerchantRetryPolicy(fastRetries),
+		)
+
+		session, err := m.StartSession(sessionURL)
+
+		So(err, ShouldBeNil)
+		So(session.MerchantSessionIdentifier, ShouldEqual, "SSH1")
+		So(calls, ShouldEqual, 3)
+	})
+
+	Convey("The last failure is returned after the last attempt", t, func() {
+		calls := 0
+		m := newMerchant(
+			sessionRoundTripper(&calls, http.StatusBadGateway, http.StatusBadGateway, http.StatusServiceUnavailable),
+			MerchantRetryPolicy(fastRetries),
+		)
+
+		_, err := m.StartSession(sessionURL)
+
+		var sessionErr *SessionError
+		So(errors.As(err, &sessionErr), ShouldBeTrue)
+		So(sessionErr.StatusCode, ShouldEqual, http.StatusServiceUnavailable)
+		So(calls, ShouldEqual, 3)
+	})
+
+	Convey("Other failures are not retried", t, func() {
+		for _, answer := range []interface{}{
+			http.StatusBadRequest,
+			errors.New("connection reset"),
+			`{"merchantSessionIdentifier":"SSH1"}`,
+		} {
+			calls := 0
+			m := newMerchant(sessionRoundTripper(&calls, answer), MerchantRetryPolicy(fastRetries))
+
+			_, err := m.StartSession(sessionURL)
+
+			So(err, ShouldNotBeNil)
+			So(calls, ShouldEqual, 1)
+		}
+	})
+
+	Convey("Retries stop before the deadline of the context", t, func() {
+		calls := 0
+		m := newMerchant(
+			sessionRoundTripper(&calls, http.StatusServiceUnavailable, validSession),
+			MerchantRetryPolicy(RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Minute, MaxBackoff: time.Minute}),
+		)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		start := time.Now()
+		_, err := m.StartSessionContext(ctx, sessionURL)
+
+		So(errors.Is(err, ErrSessionRejected), ShouldBeTrue)
+		So(calls, ShouldEqual, 1)
+		So(time.Since(start), ShouldBeLessThan, time.Second)
+	})
+
+	Convey("Retries stop after the request timeout without a deadline", t, func() {
+		calls := 0
+		m := newMerchant(
+			sessionRoundTripper(&calls, http.StatusServiceUnavailable, validSession),
+			MerchantRetryPolicy(RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Minute, MaxBackoff: time.Minute}),
+			MerchantRequestTimeout(time.Second),
+		)
+
+		start := time.Now()
+		_, err := m.StartSession(sessionURL)
+
+		So(errors.Is(err, ErrSessionRejected), ShouldBeTrue)
+		So(calls, ShouldEqual, 1)
+		So(time.Since(start), ShouldBeLessThan, time.Second)
+	})
+
+	Convey("Invalid policies are rejected", t, func() {
+		for _, p := range []RetryPolicy{
+			{},
+			{MaxAttempts: 2, InitialBackoff: -time.Second},
+			{MaxAttempts: 2, InitialBackoff: time.Second, MaxBackoff: time.Millisecond},
+		} {
+			_, err := New(merchantID, MerchantRetryPolicy(p))
+			So(errors.Is(err, ErrInvalidConfiguration), ShouldBeTrue)
+		}
+		_, err := New(merchantID, MerchantRetryPolicy(DefaultRetryPolicy()))
+		So(err, ShouldBeNil)
+	})
+}
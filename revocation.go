@@ -0,0 +1,405 @@
+package applepay
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ocsp"
+)
+
+type (
+	// RevocationMode sets how the revocation status of the certificates
+	// signing the tokens is checked
+	RevocationMode int
+
+	// RevocationFetcher retrieves revocation information from the URLs listed
+	// in certificates. Fetches should stop once ctx is done.
+	RevocationFetcher interface {
+		// FetchOCSP sends a DER-encoded OCSP request to the responder at
+		// url, and returns its DER-encoded response
+		FetchOCSP(ctx context.Context, url string, request []byte) ([]byte, error)
+		// FetchCRL returns the DER-encoded CRL at url
+		FetchCRL(ctx context.Context, url string) ([]byte, error)
+	}
+
+	// HTTPRevocationFetcher fetches revocation information over HTTP.
+	// Requests time out with their context, or after 5s if it has no
+	// deadline.
+	HTTPRevocationFetcher struct {
+		// Client is used for the requests, http.DefaultClient if nil
+		Client *http.Client
+	}
+
+	// RevocationChecker checks the revocation status of certificates using
+	// OCSP first, then CRLs. Statuses are cached until their next update, in
+	// a cache holding the most recently used ones. Failures to retrieve them
+	// are cached for a minute, so that unavailable responders do not slow
+	// down every verification.
+	RevocationChecker struct {
+		mode    RevocationMode
+		fetcher RevocationFetcher
+
+		mu      sync.Mutex
+		entries map[string]*list.Element
+		// lru orders the entries from the most to the least recently used
+		lru *list.List
+	}
+
+	// revocationStatus is the status of a certificate
+	revocationStatus struct {
+		revoked    bool
+		revokedAt  time.Time
+		nextUpdate time.Time
+	}
+
+	// revocationEntry is the cached status of the certificate key, or the
+	// error retrieving it, until expiresAt
+	revocationEntry struct {
+		key       string
+		status    revocationStatus
+		err       error
+		expiresAt time.Time
+	}
+)
+
+const (
+	// RevocationOff disables revocation checking
+	RevocationOff RevocationMode = iota
+	// RevocationSoftFail rejects revoked certificates, but accepts the ones
+	// whose status cannot be retrieved
+	RevocationSoftFail
+	// RevocationHardFail rejects certificates whose status cannot be retrieved
+	RevocationHardFail
+)
+
+const (
+	// maxRevocationResponseSize limits the size of OCSP responses and CRLs
+	maxRevocationResponseSize = 10 << 20
+	// revocationCacheSize is the number of statuses a checker caches
+	revocationCacheSize = 256
+	// revocationStatusTTL is how long statuses without next update, which
+	// may change at any time, are cached
+	revocationStatusTTL = 5 * time.Minute
+	// revocationFailureTTL is how long failures to retrieve a status are
+	// cached
+	revocationFailureTTL = time.Minute
+	// revocationRequestTimeout is the default timeout of the requests of
+	// HTTPRevocationFetcher
+	revocationRequestTimeout = 5 * time.Second
+)
+
+// NewRevocationChecker creates a revocation checker using mode. fetcher
+// defaults to an HTTPRevocationFetcher if nil.
+func NewRevocationChecker(mode RevocationMode,
+	fetcher RevocationFetcher) *RevocationChecker {
+
+	if fetcher == nil {
+		fetcher = &HTTPRevocationFetcher{}
+	}
+	return &RevocationChecker{
+		mode:    mode,
+		fetcher: fetcher,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Mode returns the mode of the checker
+func (c *RevocationChecker) Mode() RevocationMode {
+	if c == nil {
+		return RevocationOff
+	}
+	return c.mode
+}
+
+// checkChain checks the revocation status of each certificate of chain,
+// ordered from the leaf to the root, against its issuer. Statuses are fetched
+// until ctx is done.
+func (c *RevocationChecker) checkChain(ctx context.Context,
+	chain []*x509.Certificate, now time.Time) error {
+
+	if c.Mode() == RevocationOff {
+		return nil
+	}
+	for i := 0; i+1 < len(chain); i++ {
+		if err := c.check(ctx, chain[i], chain[i+1], now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// check checks the revocation status of cert, issued by issuer
+func (c *RevocationChecker) check(ctx context.Context,
+	cert, issuer *x509.Certificate, now time.Time) error {
+
+	status, err := c.status(ctx, cert, issuer, now)
+	if err != nil {
+		if c.mode == RevocationSoftFail {
+			logrus.WithError(err).WithField("serial", cert.SerialNumber).
+				Warning("unable to retrieve the revocation status")
+			return nil
+		}
+		return newError(CodeRevocationUnavailable, errors.Wrapf(
+			err,
+			"unable to retrieve the revocation status of %s",
+			cert.Subject.CommonName,
+		))
+	}
+
+	if status.revoked {
+		return newError(CodeCertificateRevoked, errors.Errorf(
+			"%s was revoked at %s",
+			cert.Subject.CommonName,
+			status.revokedAt.UTC().Format(time.RFC3339),
+		))
+	}
+	return nil
+}
+
+// status returns the revocation status of cert, or the error retrieving it,
+// from the cache if still up to date
+func (c *RevocationChecker) status(ctx context.Context,
+	cert, issuer *x509.Certificate, now time.Time) (revocationStatus, error) {
+
+	key := fmt.Sprintf("%x/%s", issuer.RawSubject, cert.SerialNumber)
+	if entry, ok := c.cached(key, now); ok {
+		return entry.status, entry.err
+	}
+
+	status, err := c.fetchStatus(ctx, cert, issuer, now)
+	if err != nil {
+		// Fetches stopped by the caller tell nothing about the responders
+		if ctx.Err() == nil {
+			c.store(key, revocationStatus{}, err, now.Add(revocationFailureTTL))
+		}
+		return revocationStatus{}, err
+	}
+
+	expiresAt := status.nextUpdate
+	if expiresAt.IsZero() {
+		expiresAt = now.Add(revocationStatusTTL)
+	}
+	if now.Before(expiresAt) {
+		c.store(key, status, nil, expiresAt)
+	}
+	return status, nil
+}
+
+// cached returns the entry of key if it is cached and not expired at now.
+// Expired entries are removed.
+func (c *RevocationChecker) cached(key string,
+	now time.Time) (*revocationEntry, bool) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*revocationEntry)
+	if !now.Before(entry.expiresAt) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return entry, true
+}
+
+// store caches the status of key, or the error retrieving it, until
+// expiresAt. The least recently used entry is evicted if the cache is full.
+func (c *RevocationChecker) store(key string, status revocationStatus,
+	err error, expiresAt time.Time) {
+
+	entry := &revocationEntry{
+		key:       key,
+		status:    status,
+		err:       err,
+		expiresAt: expiresAt,
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	for c.lru.Len() >= revocationCacheSize {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*revocationEntry).key)
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+}
+
+// fetchStatus retrieves the revocation status of cert from its OCSP
+// responders, then from its CRL distribution points
+func (c *RevocationChecker) fetchStatus(ctx context.Context,
+	cert, issuer *x509.Certificate, now time.Time) (revocationStatus, error) {
+
+	if len(cert.OCSPServer) == 0 && len(cert.CRLDistributionPoints) == 0 {
+		return revocationStatus{}, errors.New("no OCSP responder nor CRL distribution point")
+	}
+
+	var err error
+	var status revocationStatus
+	for _, url := range cert.OCSPServer {
+		if status, err = c.fetchOCSPStatus(ctx, url, cert, issuer, now); err == nil {
+			return status, nil
+		}
+	}
+	for _, url := range cert.CRLDistributionPoints {
+		if status, err = c.fetchCRLStatus(ctx, url, cert, issuer, now); err == nil {
+			return status, nil
+		}
+	}
+	return revocationStatus{}, err
+}
+
+// fetchOCSPStatus retrieves the status of cert from the OCSP responder at url
+func (c *RevocationChecker) fetchOCSPStatus(ctx context.Context, url string,
+	cert, issuer *x509.Certificate, now time.Time) (revocationStatus, error) {
+
+	request, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return revocationStatus{}, errors.Wrap(err, "error creating the OCSP request")
+	}
+	body, err := c.fetcher.FetchOCSP(ctx, url, request)
+	if err != nil {
+		return revocationStatus{}, errors.Wrapf(err, "error querying %s", url)
+	}
+	resp, err := ocsp.ParseResponseForCert(body, cert, issuer)
+	if err != nil {
+		return revocationStatus{}, errors.Wrapf(err, "invalid OCSP response from %s", url)
+	}
+
+	// Delegated responders must be authorized by the issuer
+	if resp.Certificate != nil && !bytes.Equal(resp.Certificate.Raw, issuer.Raw) {
+		if !hasExtKeyUsage(resp.Certificate, x509.ExtKeyUsageOCSPSigning) {
+			return revocationStatus{}, errors.Errorf("OCSP responder of %s is not authorized", url)
+		}
+	}
+	if now.Before(resp.ThisUpdate) ||
+		(!resp.NextUpdate.IsZero() && now.After(resp.NextUpdate)) {
+
+		return revocationStatus{}, errors.Errorf("stale OCSP response from %s", url)
+	}
+
+	switch resp.Status {
+	case ocsp.Good:
+		return revocationStatus{nextUpdate: resp.NextUpdate}, nil
+	case ocsp.Revoked:
+		return revocationStatus{
+			revoked:    true,
+			revokedAt:  resp.RevokedAt,
+			nextUpdate: resp.NextUpdate,
+		}, nil
+	default:
+		return revocationStatus{}, errors.Errorf("unknown certificate status from %s", url)
+	}
+}
+
+// fetchCRLStatus retrieves the status of cert from the CRL at url
+func (c *RevocationChecker) fetchCRLStatus(ctx context.Context, url string,
+	cert, issuer *x509.Certificate, now time.Time) (revocationStatus, error) {
+
+	body, err := c.fetcher.FetchCRL(ctx, url)
+	if err != nil {
+		return revocationStatus{}, errors.Wrapf(err, "error downloading %s", url)
+	}
+	crl, err := x509.ParseRevocationList(body)
+	if err != nil {
+		return revocationStatus{}, errors.Wrapf(err, "invalid CRL at %s", url)
+	}
+	if err := crl.CheckSignatureFrom(issuer); err != nil {
+		return revocationStatus{}, errors.Wrapf(err, "invalid CRL signature at %s", url)
+	}
+	if now.Before(crl.ThisUpdate) ||
+		(!crl.NextUpdate.IsZero() && now.After(crl.NextUpdate)) {
+
+		return revocationStatus{}, errors.Errorf("stale CRL at %s", url)
+	}
+
+	status := revocationStatus{nextUpdate: crl.NextUpdate}
+	for _, revoked := range crl.RevokedCertificateEntries {
+		if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+			status.revoked = true
+			status.revokedAt = revoked.RevocationTime
+			break
+		}
+	}
+	return status, nil
+}
+
+// hasExtKeyUsage returns whether cert has the extended key usage usage
+func hasExtKeyUsage(cert *x509.Certificate, usage x509.ExtKeyUsage) bool {
+	for _, u := range cert.ExtKeyUsage {
+		if u == usage {
+			return true
+		}
+	}
+	return false
+}
+
+// FetchOCSP sends request to url with a POST request
+func (f *HTTPRevocationFetcher) FetchOCSP(ctx context.Context, url string,
+	request []byte) ([]byte, error) {
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(request))
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating the request")
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	req.Header.Set("Accept", "application/ocsp-response")
+	return f.do(ctx, req)
+}
+
+// FetchCRL downloads the CRL at url
+func (f *HTTPRevocationFetcher) FetchCRL(ctx context.Context,
+	url string) ([]byte, error) {
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating the request")
+	}
+	return f.do(ctx, req)
+}
+
+// do sends req and returns the body of its response, until ctx is done
+func (f *HTTPRevocationFetcher) do(ctx context.Context,
+	req *http.Request) ([]byte, error) {
+
+	ctx, cancel := withDefaultTimeout(ctx, revocationRequestTimeout)
+	defer cancel()
+
+	client := f.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrap(err, "error making the request")
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status %s", res.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxRevocationResponseSize))
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading the response")
+	}
+	return body, nil
+}
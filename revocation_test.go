@@ -0,0 +1,431 @@
+package applepay
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ocsp"
+)
+
+// testPKI is a root, intermediate and leaf chain whose revocation
+// information is served by local OCSP and CRL servers
+type testPKI struct {
+	root, inter, leaf *x509.Certificate
+	rootKey, interKey crypto.Signer
+
+	ocspServer, crlServer *httptest.Server
+	// revoked are the serials reported as revoked
+	revoked map[int64]bool
+	// noNextUpdate leaves the next update out of the OCSP responses
+	noNextUpdate bool
+	// ocspRequests counts the requests to the OCSP server
+	ocspRequests int32
+}
+
+// newTestPKI creates the chain and starts its servers
+func newTestPKI(now time.Time) *testPKI {
+	pki := &testPKI{revoked: map[int64]bool{}}
+	pki.ocspServer = httptest.NewServer(http.HandlerFunc(pki.serveOCSP))
+	pki.crlServer = httptest.NewServer(http.HandlerFunc(pki.serveCRL))
+
+	notBefore := now.Add(-time.Hour)
+	notAfter := now.Add(time.Hour)
+	rootKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rootTpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	rootBytes, _ := x509.CreateCertificate(rand.Reader, rootTpl, rootTpl, &rootKey.PublicKey, rootKey)
+	pki.root, _ = x509.ParseCertificate(rootBytes)
+	pki.rootKey = rootKey
+
+	interKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	interTpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		OCSPServer:            []string{pki.ocspServer.URL},
+		CRLDistributionPoints: []string{pki.crlServer.URL},
+	}
+	interBytes, _ := x509.CreateCertificate(rand.Reader, interTpl, pki.root, &interKey.PublicKey, rootKey)
+	pki.inter, _ = x509.ParseCertificate(interBytes)
+	pki.interKey = interKey
+
+	leafKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	leafTpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(3),
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		OCSPServer:            []string{pki.ocspServer.URL},
+		CRLDistributionPoints: []string{pki.crlServer.URL},
+	}
+	leafBytes, _ := x509.CreateCertificate(rand.Reader, leafTpl, pki.inter, &leafKey.PublicKey, interKey)
+	pki.leaf, _ = x509.ParseCertificate(leafBytes)
+
+	return pki
+}
+
+// close stops the servers
+func (pki *testPKI) close() {
+	pki.ocspServer.Close()
+	pki.crlServer.Close()
+}
+
+// chain returns the chain from the leaf to the root
+func (pki *testPKI) chain() []*x509.Certificate {
+	return []*x509.Certificate{pki.leaf, pki.inter, pki.root}
+}
+
+// issuer returns the issuer of the certificate with serial
+func (pki *testPKI) issuer(serial *big.Int) (*x509.Certificate, crypto.Signer) {
+	if serial.Int64() == 2 {
+		return pki.root, pki.rootKey
+	}
+	return pki.inter, pki.interKey
+}
+
+func (pki *testPKI) serveOCSP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&pki.ocspRequests, 1)
+	body, _ := io.ReadAll(r.Body)
+	req, err := ocsp.ParseRequest(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	template := ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: req.SerialNumber,
+		ThisUpdate:   now.Add(-time.Minute),
+		NextUpdate:   now.Add(time.Hour),
+	}
+	if pki.noNextUpdate {
+		template.NextUpdate = time.Time{}
+	}
+	if pki.revoked[req.SerialNumber.Int64()] {
+		template.Status = ocsp.Revoked
+		template.RevokedAt = now.Add(-time.Minute)
+	}
+	issuer, key := pki.issuer(req.SerialNumber)
+	resp, _ := ocsp.CreateResponse(issuer, issuer, template, key)
+	w.Write(resp)
+}
+
+func (pki *testPKI) serveCRL(w http.ResponseWriter, r *http.Request) {
+	// The server only publishes the CRL of the intermediate
+	now := time.Now()
+	crl := &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: now.Add(-time.Minute),
+		NextUpdate: now.Add(time.Hour),
+	}
+	if pki.revoked[3] {
+		crl.RevokedCertificateEntries = []x509.RevocationListEntry{{
+			SerialNumber:   big.NewInt(3),
+			RevocationTime: now.Add(-time.Minute),
+		}}
+	}
+	der, _ := x509.CreateRevocationList(rand.Reader, crl, pki.inter, pki.interKey)
+	w.Write(der)
+}
+
+// failingFetcher fails every request, after counting it
+type failingFetcher struct {
+	requests int32
+}
+
+func (f *failingFetcher) FetchOCSP(ctx context.Context, url string, request []byte) ([]byte, error) {
+	atomic.AddInt32(&f.requests, 1)
+	return nil, errors.New("unreachable")
+}
+
+func (f *failingFetcher) FetchCRL(ctx context.Context, url string) ([]byte, error) {
+	atomic.AddInt32(&f.requests, 1)
+	return nil, errors.New("unreachable")
+}
+
+// blockingFetcher answers no request, until their context is done
+type blockingFetcher struct{}
+
+func (blockingFetcher) FetchOCSP(ctx context.Context, url string, request []byte) ([]byte, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (blockingFetcher) FetchCRL(ctx context.Context, url string) ([]byte, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// crlOnlyFetcher fails OCSP requests and fetches CRLs over HTTP
+type crlOnlyFetcher struct {
+	HTTPRevocationFetcher
+}
+
+func (f *crlOnlyFetcher) FetchOCSP(ctx context.Context, url string, request []byte) ([]byte, error) {
+	return nil, errors.New("unreachable")
+}
+
+func TestRevocationChecker(t *testing.T) {
+	now := time.Now()
+
+	Convey("Good certificates are accepted", t, func() {
+		pki := newTestPKI(now)
+		defer pki.close()
+		checker := NewRevocationChecker(RevocationHardFail, nil)
+
+		So(checker.checkChain(context.Background(), pki.chain(), now), ShouldBeNil)
+		So(atomic.LoadInt32(&pki.ocspRequests), ShouldEqual, 2)
+
+		Convey("Responses are cached until their next update", func() {
+			So(checker.checkChain(context.Background(), pki.chain(), now), ShouldBeNil)
+			So(atomic.LoadInt32(&pki.ocspRequests), ShouldEqual, 2)
+
+			// The responses are stale two hours later
+			So(checker.checkChain(context.Background(), pki.chain(), now.Add(2*time.Hour)), ShouldNotBeNil)
+			So(atomic.LoadInt32(&pki.ocspRequests), ShouldEqual, 3)
+		})
+	})
+
+	Convey("Responses without next update are cached for a while", t, func() {
+		pki := newTestPKI(now)
+		defer pki.close()
+		pki.noNextUpdate = true
+		checker := NewRevocationChecker(RevocationHardFail, nil)
+
+		So(checker.checkChain(context.Background(), pki.chain(), now), ShouldBeNil)
+		So(checker.checkChain(context.Background(), pki.chain(), now.Add(time.Minute)), ShouldBeNil)
+		So(atomic.LoadInt32(&pki.ocspRequests), ShouldEqual, 2)
+
+		So(checker.checkChain(context.Background(), pki.chain(), now.Add(revocationStatusTTL)), ShouldBeNil)
+		So(atomic.LoadInt32(&pki.ocspRequests), ShouldEqual, 4)
+	})
+
+	Convey("The most recently used statuses are cached", t, func() {
+		checker := NewRevocationChecker(RevocationHardFail, nil)
+		for i := 0; i <= revocationCacheSize; i++ {
+			checker.store(fmt.Sprint(i), revocationStatus{}, nil, now.Add(time.Hour))
+		}
+
+		So(checker.lru.Len(), ShouldEqual, revocationCacheSize)
+		_, ok := checker.cached("0", now)
+		So(ok, ShouldBeFalse)
+		_, ok = checker.cached(fmt.Sprint(revocationCacheSize), now)
+		So(ok, ShouldBeTrue)
+	})
+
+	Convey("Revoked leaf certificates are rejected", t, func() {
+		pki := newTestPKI(now)
+		defer pki.close()
+		pki.revoked[3] = true
+
+		err := NewRevocationChecker(RevocationSoftFail, nil).checkChain(context.Background(), pki.chain(), now)
+
+		So(errors.Is(err, ErrCertificateRevoked), ShouldBeTrue)
+	})
+
+	Convey("Revoked intermediate certificates are rejected", t, func() {
+		pki := newTestPKI(now)
+		defer pki.close()
+		pki.revoked[2] = true
+
+		err := NewRevocationChecker(RevocationHardFail, nil).checkChain(context.Background(), pki.chain(), now)
+
+		So(errors.Is(err, ErrCertificateRevoked), ShouldBeTrue)
+	})
+
+	Convey("CRLs are used when OCSP responders are unavailable", t, func() {
+		pki := newTestPKI(now)
+		defer pki.close()
+		checker := NewRevocationChecker(RevocationHardFail, &crlOnlyFetcher{})
+
+		So(checker.check(context.Background(), pki.leaf, pki.inter, now), ShouldBeNil)
+
+		pki.revoked[3] = true
+		checker = NewRevocationChecker(RevocationHardFail, &crlOnlyFetcher{})
+		err := checker.check(context.Background(), pki.leaf, pki.inter, now)
+		So(errors.Is(err, ErrCertificateRevoked), ShouldBeTrue)
+	})
+
+	Convey("CRLs must be signed by the issuer", t, func() {
+		pki := newTestPKI(now)
+		defer pki.close()
+		checker := NewRevocationChecker(RevocationHardFail, &crlOnlyFetcher{})
+
+		err := checker.check(context.Background(), pki.leaf, pki.root, now)
+
+		So(errors.Is(err, ErrRevocationUnavailable), ShouldBeTrue)
+	})
+
+	Convey("Unavailable statuses depend on the mode", t, func() {
+		pki := newTestPKI(now)
+		defer pki.close()
+		fetcher := &failingFetcher{}
+
+		So(NewRevocationChecker(RevocationSoftFail, fetcher).checkChain(context.Background(), pki.chain(), now), ShouldBeNil)
+
+		err := NewRevocationChecker(RevocationHardFail, fetcher).checkChain(context.Background(), pki.chain(), now)
+		So(errors.Is(err, ErrRevocationUnavailable), ShouldBeTrue)
+		So(ErrorCodeOf(err), ShouldEqual, CodeRevocationUnavailable)
+	})
+
+	Convey("Unavailable statuses are cached for a while", t, func() {
+		pki := newTestPKI(now)
+		defer pki.close()
+		fetcher := &failingFetcher{}
+		checker := NewRevocationChecker(RevocationSoftFail, fetcher)
+
+		So(checker.checkChain(context.Background(), pki.chain(), now), ShouldBeNil)
+		requests := atomic.LoadInt32(&fetcher.requests)
+		So(requests, ShouldBeGreaterThan, 0)
+
+		So(checker.checkChain(context.Background(), pki.chain(), now.Add(time.Second)), ShouldBeNil)
+		So(atomic.LoadInt32(&fetcher.requests), ShouldEqual, requests)
+
+		So(checker.checkChain(context.Background(), pki.chain(), now.Add(revocationFailureTTL)), ShouldBeNil)
+		So(atomic.LoadInt32(&fetcher.requests), ShouldEqual, 2*requests)
+	})
+
+	Convey("Fetches stopped by the caller are not cached", t, func() {
+		pki := newTestPKI(now)
+		defer pki.close()
+		fetcher := &failingFetcher{}
+		checker := NewRevocationChecker(RevocationHardFail, fetcher)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		So(checker.checkChain(ctx, pki.chain(), now), ShouldNotBeNil)
+		So(checker.lru.Len(), ShouldEqual, 0)
+	})
+
+	Convey("Certificates without revocation information are unavailable", t, func() {
+		pki := newTestPKI(now)
+		defer pki.close()
+
+		err := NewRevocationChecker(RevocationHardFail, nil).check(context.Background(), pki.root, pki.root, now)
+		So(errors.Is(err, ErrRevocationUnavailable), ShouldBeTrue)
+	})
+
+	Convey("Disabled checkers do not fetch anything", t, func() {
+		pki := newTestPKI(now)
+		defer pki.close()
+		fetcher := &failingFetcher{}
+		var nilChecker *RevocationChecker
+
+		So(NewRevocationChecker(RevocationOff, fetcher).checkChain(context.Background(), pki.chain(), now), ShouldBeNil)
+		So(nilChecker.checkChain(context.Background(), pki.chain(), now), ShouldBeNil)
+		So(atomic.LoadInt32(&fetcher.requests), ShouldEqual, 0)
+	})
+}
+
+func TestHTTPRevocationFetcher(t *testing.T) {
+	Convey("Error statuses are reported", t, func() {
+		server := httptest.NewServer(http.NotFoundHandler())
+		defer server.Close()
+
+		_, err := (&HTTPRevocationFetcher{}).FetchCRL(context.Background(), server.URL)
+
+		So(err.Error(), ShouldEqual, "unexpected status 404 Not Found")
+	})
+
+	Convey("Requests stop with their context", t, func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		}))
+		defer server.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		_, err := (&HTTPRevocationFetcher{}).FetchCRL(ctx, server.URL)
+
+		So(errors.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+		So(time.Since(start), ShouldBeLessThan, time.Second)
+	})
+
+	Convey("OCSP requests are posted", t, func() {
+		var method, contentType string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			method, contentType = r.Method, r.Header.Get("Content-Type")
+			body, _ := io.ReadAll(r.Body)
+			w.Write(body)
+		}))
+		defer server.Close()
+
+		resp, err := (&HTTPRevocationFetcher{Client: server.Client()}).FetchOCSP(context.Background(), server.URL, []byte("request"))
+
+		So(err, ShouldBeNil)
+		So(string(resp), ShouldEqual, "request")
+		So(method, ShouldEqual, "POST")
+		So(contentType, ShouldEqual, "application/ocsp-request")
+	})
+}
+
+func TestVerifySignatureRevocation(t *testing.T) {
+	tokenJSON, _ := os.ReadFile("tests/token.json")
+	token := &PKPaymentToken{}
+	json.Unmarshal(tokenJSON, token)
+
+	Convey("Tokens are rejected if revocations cannot be checked in hard-fail mode", t, func() {
+		policy := DefaultVerificationPolicy()
+		policy.Revocation = NewRevocationChecker(RevocationHardFail, &failingFetcher{})
+
+		err := token.verifySignature(context.Background(), policy)
+
+		So(errors.Is(err, ErrRevocationUnavailable), ShouldBeTrue)
+		So(ErrorCodeOf(err), ShouldEqual, CodeRevocationUnavailable)
+	})
+
+	Convey("Revocations are only checked for tokens signed by the leaf", t, func() {
+		fetcher := &failingFetcher{}
+		policy := DefaultVerificationPolicy()
+		policy.Revocation = NewRevocationChecker(RevocationHardFail, fetcher)
+		forged := *token
+		forged.PaymentData.Data = []byte("forged")
+
+		err := forged.verifySignature(context.Background(), policy)
+
+		So(errors.Is(err, ErrInvalidSignature), ShouldBeTrue)
+		So(atomic.LoadInt32(&fetcher.requests), ShouldEqual, 0)
+	})
+
+	Convey("Tokens are accepted if revocations cannot be checked in soft-fail mode", t, func() {
+		fetcher := &failingFetcher{}
+		policy := DefaultVerificationPolicy()
+		policy.Revocation = NewRevocationChecker(RevocationSoftFail, fetcher)
+
+		So(token.verifySignature(context.Background(), policy), ShouldBeNil)
+		requests := atomic.LoadInt32(&fetcher.requests)
+		So(requests, ShouldBeGreaterThan, 0)
+
+		Convey("Without fetching the statuses again for a while", func() {
+			So(token.verifySignature(context.Background(), policy), ShouldBeNil)
+			So(atomic.LoadInt32(&fetcher.requests), ShouldEqual, requests)
+		})
+	})
+}
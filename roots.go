@@ -0,0 +1,65 @@
+package applepay
+
+import (
+	"crypto/x509"
+	_ "embed"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// appleRootCertificatePEM is Apple Root CA - G3, the root of the
+	// certificates signing the tokens
+	//go:embed AppleRootCA-G3.crt
+	appleRootCertificatePEM []byte
+
+	// appleRoots holds the embedded root certificate, parsed once
+	appleRoots = mustNewRootPool(appleRootCertificatePEM)
+
+	// deprecatedRoots holds the pool loaded from AppleRootCertificatePath,
+	// so that it is read once and verified chains are cached for it
+	deprecatedRoots struct {
+		sync.Mutex
+		path string
+		pool *x509.CertPool
+	}
+)
+
+// AppleRoots returns a new pool holding Apple Root CA - G3, the root trusted
+// by default. Other roots may be added to it before using it as
+// VerificationPolicy.Roots.
+func AppleRoots() *x509.CertPool {
+	return appleRoots.Clone()
+}
+
+// mustNewRootPool creates a pool from a PEM-encoded root certificate and
+// panics if it cannot be parsed
+func mustNewRootPool(rootPEMBytes []byte) *x509.CertPool {
+	root, err := parseRootCertificate(rootPEMBytes)
+	if err != nil {
+		panic(errors.Wrap(err, "error parsing the embedded root certificate"))
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(root)
+	return pool
+}
+
+// loadDeprecatedRoots returns a pool holding the root certificate at path. The
+// file is only read again if the path changes, or if it could not be loaded.
+func loadDeprecatedRoots(path string) (*x509.CertPool, error) {
+	deprecatedRoots.Lock()
+	defer deprecatedRoots.Unlock()
+
+	if deprecatedRoots.pool != nil && deprecatedRoots.path == path {
+		return deprecatedRoots.pool, nil
+	}
+	root, err := loadRootCertificate(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(root)
+	deprecatedRoots.path, deprecatedRoots.pool = path, pool
+	return pool, nil
+}
@@ -0,0 +1,58 @@
+package applepay
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAppleRoots(t *testing.T) {
+	Convey("The embedded root certificate is Apple Root CA - G3", t, func() {
+		root, err := parseRootCertificate(appleRootCertificatePEM)
+
+		So(err, ShouldBeNil)
+		So(root.Subject.CommonName, ShouldEqual, "Apple Root CA - G3")
+	})
+
+	Convey("Each call returns a new pool", t, func() {
+		pool := AppleRoots()
+
+		So(pool.Equal(appleRoots), ShouldBeTrue)
+		So(pool, ShouldNotEqual, AppleRoots())
+	})
+
+	Convey("Invalid root certificates panic", t, func() {
+		So(func() { mustNewRootPool([]byte("invalid")) }, ShouldPanic)
+	})
+}
+
+func TestLoadDeprecatedRoots(t *testing.T) {
+	Convey("Root files are loaded once", t, func() {
+		pool, err := loadDeprecatedRoots("AppleRootCA-G3.crt")
+		So(err, ShouldBeNil)
+		So(pool.Equal(appleRoots), ShouldBeTrue)
+
+		again, _ := loadDeprecatedRoots("AppleRootCA-G3.crt")
+		So(again, ShouldEqual, pool)
+	})
+
+	Convey("Root files are loaded again when the path changes", t, func() {
+		pool, _ := loadDeprecatedRoots("AppleRootCA-G3.crt")
+		path := filepath.Join(t.TempDir(), "root.crt")
+		os.WriteFile(path, appleRootCertificatePEM, 0600)
+
+		other, err := loadDeprecatedRoots(path)
+
+		So(err, ShouldBeNil)
+		So(other, ShouldNotEqual, pool)
+		So(other.Equal(appleRoots), ShouldBeTrue)
+	})
+
+	Convey("Missing root files are reported", t, func() {
+		_, err := loadDeprecatedRoots(filepath.Join(t.TempDir(), "missing.crt"))
+
+		So(err.Error(), ShouldStartWith, "error reading the root certificate")
+	})
+}
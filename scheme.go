@@ -0,0 +1,189 @@
+package applepay
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"sync"
+
+	"github.com/pkg/errors"
+	"go.mozilla.org/pkcs7"
+)
+
+type (
+	// Scheme implements a version of the payment data format, identified by
+	// PaymentData.Version. EC_v1 and RSA_v1 are built in, other versions may
+	// be added with RegisterScheme.
+	Scheme interface {
+		// Version is the PaymentData.Version of the tokens using the scheme
+		Version() string
+
+		// SignedData returns the data signed by the device's Secure Element
+		SignedData(t *PKPaymentToken) []byte
+
+		// SignatureAlgorithm is the algorithm expected for the token
+		// signature
+		SignatureAlgorithm() x509.SignatureAlgorithm
+
+		// EncryptionKey recovers the symmetric key of the token using the
+		// merchant's processing key and the hash of the merchant ID
+		EncryptionKey(key KeyProvider, t *PKPaymentToken,
+			merchantIDHash []byte) ([]byte, error)
+
+		// Decrypt decrypts the payment data using the symmetric key
+		Decrypt(key []byte, t *PKPaymentToken) ([]byte, error)
+	}
+
+	// ecV1Scheme implements the EC_v1 version: ECDH key agreement with an
+	// ephemeral key and an ECDSA signature
+	ecV1Scheme struct{}
+
+	// rsaV1Scheme implements the RSA_v1 version: RSA-OAEP key wrapping and an
+	// RSA signature
+	rsaV1Scheme struct{}
+
+	// signatureAlgorithmOIDs are the CMS identifiers of a signature algorithm
+	signatureAlgorithmOIDs struct {
+		digest    asn1.ObjectIdentifier
+		signature asn1.ObjectIdentifier
+		// key is the key algorithm signers may give instead of signature,
+		// the digest being given separately, if any
+		key asn1.ObjectIdentifier
+	}
+)
+
+var (
+	schemesMu sync.RWMutex
+	schemes   = map[string]Scheme{
+		vEC_v1.String():  ecV1Scheme{},
+		vRSA_v1.String(): rsaV1Scheme{},
+	}
+
+	// signatureAlgorithms maps the signature algorithms schemes may expect to
+	// their CMS identifiers
+	signatureAlgorithms = map[x509.SignatureAlgorithm]signatureAlgorithmOIDs{
+		x509.ECDSAWithSHA256: {pkcs7.OIDDigestAlgorithmSHA256, pkcs7.OIDDigestAlgorithmECDSASHA256, nil},
+		x509.ECDSAWithSHA384: {pkcs7.OIDDigestAlgorithmSHA384, pkcs7.OIDDigestAlgorithmECDSASHA384, nil},
+		x509.ECDSAWithSHA512: {pkcs7.OIDDigestAlgorithmSHA512, pkcs7.OIDDigestAlgorithmECDSASHA512, nil},
+		x509.SHA256WithRSA:   {pkcs7.OIDDigestAlgorithmSHA256, pkcs7.OIDEncryptionAlgorithmRSASHA256, pkcs7.OIDEncryptionAlgorithmRSA},
+		x509.SHA384WithRSA:   {pkcs7.OIDDigestAlgorithmSHA384, pkcs7.OIDEncryptionAlgorithmRSASHA384, pkcs7.OIDEncryptionAlgorithmRSA},
+		x509.SHA512WithRSA:   {pkcs7.OIDDigestAlgorithmSHA512, pkcs7.OIDEncryptionAlgorithmRSASHA512, pkcs7.OIDEncryptionAlgorithmRSA},
+	}
+)
+
+// RegisterScheme adds support for a new version of the payment data format.
+// Built-in versions cannot be replaced.
+func RegisterScheme(s Scheme) error {
+	if s == nil {
+		return newError(CodeInvalidConfiguration, errors.New("nil scheme"))
+	}
+	if s.Version() == "" {
+		return newError(
+			CodeInvalidConfiguration,
+			errors.New("empty scheme version"),
+		)
+	}
+	if _, ok := signatureAlgorithms[s.SignatureAlgorithm()]; !ok {
+		return newError(CodeInvalidConfiguration, errors.Errorf(
+			"unsupported signature algorithm %s",
+			s.SignatureAlgorithm(),
+		))
+	}
+
+	schemesMu.Lock()
+	defer schemesMu.Unlock()
+	if _, ok := schemes[s.Version()]; ok {
+		return newError(
+			CodeInvalidConfiguration,
+			errors.Errorf("scheme %s is already registered", s.Version()),
+		)
+	}
+	schemes[s.Version()] = s
+	return nil
+}
+
+// lookupScheme returns the scheme of a payment data version
+func lookupScheme(version string) (Scheme, error) {
+	schemesMu.RLock()
+	defer schemesMu.RUnlock()
+	s, ok := schemes[version]
+	if !ok {
+		return nil, newError(
+			CodeUnsupportedVersion,
+			errors.Errorf("unsupported version %s", version),
+		)
+	}
+	return s, nil
+}
+
+// signedData concatenates the signed fields of a token, with key being the
+// version-specific key field, as defined in Apple's documentation: https://developer.apple.com/library/content/documentation/PassKit/Reference/PaymentTokenJSON/PaymentTokenJSON.html#//apple_ref/doc/uid/TP40014929-CH8-SW2
+func signedData(key []byte, t *PKPaymentToken) []byte {
+	signed := bytes.NewBuffer(nil)
+	signed.Write(key)
+	signed.Write(t.PaymentData.Data)
+	trIDHex, _ := hex.DecodeString(t.PaymentData.Header.TransactionID)
+	signed.Write(trIDHex)
+	appDataHex, _ := hex.DecodeString(t.PaymentData.Header.ApplicationData)
+	signed.Write(appDataHex)
+	return signed.Bytes()
+}
+
+// EC_v1
+
+// Version implements Scheme
+func (ecV1Scheme) Version() string {
+	return vEC_v1.String()
+}
+
+// SignedData implements Scheme
+func (ecV1Scheme) SignedData(t *PKPaymentToken) []byte {
+	return signedData(t.PaymentData.Header.EphemeralPublicKey, t)
+}
+
+// SignatureAlgorithm implements Scheme
+func (ecV1Scheme) SignatureAlgorithm() x509.SignatureAlgorithm {
+	return x509.ECDSAWithSHA256
+}
+
+// EncryptionKey implements Scheme
+func (ecV1Scheme) EncryptionKey(key KeyProvider, t *PKPaymentToken,
+	merchantIDHash []byte) ([]byte, error) {
+
+	return computeEncryptionKey(key, t, merchantIDHash)
+}
+
+// Decrypt implements Scheme
+func (ecV1Scheme) Decrypt(key []byte, t *PKPaymentToken) ([]byte, error) {
+	return t.decrypt(key)
+}
+
+// RSA_v1
+
+// Version implements Scheme
+func (rsaV1Scheme) Version() string {
+	return vRSA_v1.String()
+}
+
+// SignedData implements Scheme
+func (rsaV1Scheme) SignedData(t *PKPaymentToken) []byte {
+	return signedData(t.PaymentData.Header.WrappedKey, t)
+}
+
+// SignatureAlgorithm implements Scheme
+func (rsaV1Scheme) SignatureAlgorithm() x509.SignatureAlgorithm {
+	return x509.SHA256WithRSA
+}
+
+// EncryptionKey implements Scheme
+func (rsaV1Scheme) EncryptionKey(key KeyProvider, t *PKPaymentToken,
+	merchantIDHash []byte) ([]byte, error) {
+
+	return unwrapEncryptionKey(key, t)
+}
+
+// Decrypt implements Scheme
+func (rsaV1Scheme) Decrypt(key []byte, t *PKPaymentToken) ([]byte, error) {
+	return t.decrypt(key)
+}
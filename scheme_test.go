@@ -0,0 +1,149 @@
+package applepay
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mozilla.org/pkcs7"
+)
+
+// testScheme is an experimental scheme working like EC_v1, with the key field
+// left out of the signed data
+type testScheme struct {
+	ecV1Scheme
+	version string
+}
+
+func (s testScheme) Version() string {
+	return s.version
+}
+
+func (s testScheme) SignedData(t *PKPaymentToken) []byte {
+	return signedData(nil, t)
+}
+
+// unregisterScheme removes a scheme added by a test
+func unregisterScheme(version string) {
+	schemesMu.Lock()
+	defer schemesMu.Unlock()
+	delete(schemes, version)
+}
+
+func TestRegisterScheme(t *testing.T) {
+	Convey("Invalid schemes are rejected", t, func() {
+		So(RegisterScheme(nil).Error(), ShouldEqual, "nil scheme")
+		So(RegisterScheme(testScheme{}).Error(), ShouldEqual, "empty scheme version")
+	})
+
+	Convey("Built-in schemes cannot be replaced", t, func() {
+		err := RegisterScheme(testScheme{version: "EC_v1"})
+
+		So(err.Error(), ShouldEqual, "scheme EC_v1 is already registered")
+	})
+
+	Convey("Experimental schemes can be registered", t, func() {
+		err := RegisterScheme(testScheme{version: "EC_test"})
+		defer unregisterScheme("EC_test")
+		token := &PKPaymentToken{}
+		token.PaymentData.Version = "EC_test"
+		token.PaymentData.Header.EphemeralPublicKey = []byte("ephemeral_public_key-")
+		token.PaymentData.Data = []byte("data")
+
+		Convey("err should be nil", func() {
+			So(err, ShouldBeNil)
+		})
+
+		Convey("the version should be supported", func() {
+			So(token.checkVersion(), ShouldBeNil)
+		})
+
+		Convey("the scheme should define the signed data", func() {
+			So(token.signedData(), ShouldResemble, []byte("data"))
+		})
+	})
+}
+
+func TestLookupScheme(t *testing.T) {
+	Convey("Built-in schemes are registered", t, func() {
+		ec, err := lookupScheme("EC_v1")
+		So(err, ShouldBeNil)
+		So(ec.SignatureAlgorithm(), ShouldEqual, x509.ECDSAWithSHA256)
+
+		rsa, err := lookupScheme("RSA_v1")
+		So(err, ShouldBeNil)
+		So(rsa.SignatureAlgorithm(), ShouldEqual, x509.SHA256WithRSA)
+	})
+
+	Convey("Unknown versions are rejected", t, func() {
+		s, err := lookupScheme("XXXXXX")
+
+		So(s, ShouldBeNil)
+		So(err.Error(), ShouldEqual, "unsupported version XXXXXX")
+	})
+}
+
+func TestVerifySignatureAlgorithm(t *testing.T) {
+	tokenJSON, _ := os.ReadFile("tests/token.json")
+	token := &PKPaymentToken{}
+	json.Unmarshal(tokenJSON, token)
+	p7, _ := pkcs7.Parse(token.PaymentData.Signature)
+
+	Convey("The expected algorithm is accepted", t, func() {
+		So(verifySignatureAlgorithm(p7, x509.ECDSAWithSHA256), ShouldBeNil)
+	})
+
+	Convey("Other algorithms are rejected", t, func() {
+		err := verifySignatureAlgorithm(p7, x509.SHA256WithRSA)
+
+		So(err.Error(), ShouldStartWith, "unexpected signature algorithm")
+	})
+
+	Convey("RSA signers may give the key algorithm with a SHA-256 digest", t, func() {
+		key, _ := rsa.GenerateKey(rand.Reader, 2048)
+		tpl := &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour)}
+		der, _ := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+		cert, _ := x509.ParseCertificate(der)
+		sd, _ := pkcs7.NewSignedData([]byte("data"))
+		sd.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+		sd.AddSigner(cert, key, pkcs7.SignerInfoConfig{})
+		der, _ = sd.Finish()
+		rsaP7, _ := pkcs7.Parse(der)
+		// rsaEncryption, as set by many CMS signers
+		rsaP7.Signers[0].DigestEncryptionAlgorithm.Algorithm = pkcs7.OIDEncryptionAlgorithmRSA
+
+		So(verifySignatureAlgorithm(rsaP7, x509.SHA256WithRSA), ShouldBeNil)
+		So(rsaP7.Verify(), ShouldBeNil)
+
+		rsaP7.Signers[0].DigestAlgorithm.Algorithm = pkcs7.OIDDigestAlgorithmSHA1
+		err := verifySignatureAlgorithm(rsaP7, x509.SHA256WithRSA)
+		So(err.Error(), ShouldStartWith, "unexpected signature algorithm")
+
+		err = verifySignatureAlgorithm(p7, x509.SHA256WithRSA)
+		So(err.Error(), ShouldStartWith, "unexpected signature algorithm")
+	})
+
+	Convey("EC signers must give the signature algorithm", t, func() {
+		ecP7, _ := pkcs7.Parse(token.PaymentData.Signature)
+		ecP7.Signers[0].DigestEncryptionAlgorithm.Algorithm = pkcs7.OIDEncryptionAlgorithmECDSAP256
+
+		err := verifySignatureAlgorithm(ecP7, x509.ECDSAWithSHA256)
+
+		So(err.Error(), ShouldStartWith, "unexpected signature algorithm")
+	})
+
+	Convey("Tokens are verified against the algorithm of their scheme", t, func() {
+		rsaToken := *token
+		rsaToken.PaymentData.Version = "RSA_v1"
+
+		err := rsaToken.verifyPKCS7Signature(p7, p7.Certificates[0])
+
+		So(err.Error(), ShouldStartWith, "unexpected signature algorithm")
+	})
+}
@@ -2,93 +2,240 @@ package applepay
 
 import (
 	"bytes"
-	"crypto/tls"
+	"context"
 	"encoding/json"
-	"io/ioutil"
 	"net/http"
 	"net/url"
-	"regexp"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
 )
 
 type (
+	// Initiative is the context in which an Apple Pay session is started
+	Initiative string
+
+	// SessionOption sets a field of a session request
+	SessionOption func(*sessionRequest) error
+
 	// sessionRequest is the JSON payload sent to Apple for Apple Pay
 	// session requests
 	sessionRequest struct {
-		MerchantIdentifier string `json:"merchantIdentifier"`
-		DomainName         string `json:"domainName"`
-		DisplayName        string `json:"displayName"`
+		MerchantIdentifier string     `json:"merchantIdentifier"`
+		DisplayName        string     `json:"displayName"`
+		Initiative         Initiative `json:"initiative"`
+		InitiativeContext  string     `json:"initiativeContext"`
+		// DomainName is the legacy initiative context of web sessions, still
+		// sent for older gateways
+		DomainName string `json:"domainName,omitempty"`
 	}
 )
 
+const (
+	// InitiativeWeb is Apple Pay on the web, whose context is the domain
+	// name of the payment page
+	InitiativeWeb Initiative = "web"
+	// InitiativeMessaging is Apple Pay in messages, whose context is the URL
+	// of the merchant's payment gateway
+	InitiativeMessaging Initiative = "messaging"
+)
+
 var (
+	// requestTimeout is the default timeout of session requests
 	requestTimeout = 30 * time.Second
 )
 
-// Session returns an opaque payload for setting up an Apple Pay session
-func (m Merchant) Session(url string) (sessionPayload []byte, err error) {
-	if m.merchantCertificate == nil {
-		return nil, errors.New("nil merchant certificate")
+// Session returns an opaque payload for setting up an Apple Pay session. The
+// session is started on the web for the merchant's domain name, unless set
+// otherwise with SessionInitiative.
+func (m Merchant) Session(url string, options ...SessionOption) (sessionPayload []byte, err error) {
+	return m.SessionContext(context.Background(), url, options...)
+}
+
+// SessionContext is Session, cancelled when ctx is done
+func (m Merchant) SessionContext(ctx context.Context, url string,
+	options ...SessionOption) (sessionPayload []byte, err error) {
+
+	session, err := m.StartSessionContext(ctx, url, options...)
+	if err != nil {
+		return nil, err
+	}
+	return session.Raw, nil
+}
+
+// StartSession requests a merchant session from Apple, see Session. Error
+// responses of Apple are returned as *SessionError.
+func (m Merchant) StartSession(url string, options ...SessionOption) (*MerchantSession, error) {
+	return m.StartSessionContext(context.Background(), url, options...)
+}
+
+// StartSessionContext is StartSession, cancelled when ctx is done
+func (m Merchant) StartSessionContext(ctx context.Context, url string,
+	options ...SessionOption) (*MerchantSession, error) {
+
+	cert := m.keys().merchantCertificate
+	if cert == nil {
+		return nil, newError(
+			CodeMissingCertificate,
+			errors.New("nil merchant certificate"),
+		)
 	}
-	// Verify that the session URL is Apple's
-	if err := checkSessionURL(url); err != nil {
-		return nil, errors.Wrap(err, "invalid session request URL")
+	// Verify that the session URL is one of the environment's
+	if err := m.Environment().checkSessionURL(url); err != nil {
+		return nil, newError(
+			CodeInvalidSessionURL,
+			errors.Wrap(err, "invalid session request URL"),
+		)
 	}
 
-	// Send a session request to Apple
-	cl := m.authenticatedClient()
-	buf := bytes.NewBuffer(nil)
-	_ = json.NewEncoder(buf).Encode(m.sessionRequest())
-	res, err := cl.Post(url, "application/json", buf)
+	req, err := m.sessionRequest(options)
 	if err != nil {
-		return nil, errors.Wrap(err, "error making the request")
+		return nil, err
 	}
 
-	// Return directly the result
-	body, _ := ioutil.ReadAll(res.Body)
-	_ = res.Body.Close()
-	return body, nil
+	payload, _ := json.Marshal(req)
+	return m.sendSessionRequest(ctx, url, payload)
+}
+
+// sendSessionRequest sends a session request to Apple, retried according to
+// the retry policy of the merchant. Without a deadline in ctx, the retries
+// stop once the request timeout of the merchant elapsed.
+func (m Merchant) sendSessionRequest(ctx context.Context, sessionURL string,
+	payload []byte) (*MerchantSession, error) {
+
+	ctx, cancel := withDefaultTimeout(ctx, m.timeout())
+	defer cancel()
+
+	maxAttempts := m.retryPolicy.MaxAttempts
+	for attempt := 1; ; attempt++ {
+		session, err := m.sessionAttempt(ctx, sessionURL, payload)
+		if err == nil || attempt >= maxAttempts || !isRetryable(err) {
+			return session, err
+		}
+		if !sleepContext(ctx, m.retryPolicy.backoff(attempt, randomBackoff)) {
+			return nil, err
+		}
+	}
 }
 
-// checkSessionURL validates the request URL sent by the client to check that it
-// belongs to Apple
-func checkSessionURL(location string) error {
-	u, err := url.Parse(location)
+// sessionAttempt sends a session request to Apple once, through the circuit
+// breaker of the merchant
+func (m Merchant) sessionAttempt(ctx context.Context, sessionURL string,
+	payload []byte) (*MerchantSession, error) {
+
+	b := m.circuitBreaker
+	if b == nil {
+		return m.postSession(ctx, sessionURL, payload)
+	}
+
+	// The URL was checked to be a session host
+	u, _ := url.Parse(sessionURL)
+	if err := b.allow(u.Host); err != nil {
+		return nil, err
+	}
+	session, err := m.postSession(ctx, sessionURL, payload)
+
+	var sessionErr *SessionError
+	switch {
+	case errors.As(err, &sessionErr):
+		b.done(u.Host, isGatewayStatusFailure(sessionErr.StatusCode), false)
+	case ErrorCodeOf(err) == CodeGateway:
+		// Requests cancelled by the caller tell nothing about Apple, unlike
+		// the ones timing out
+		b.done(u.Host, true, errors.Is(ctx.Err(), context.Canceled))
+	default:
+		b.done(u.Host, false, false)
+	}
+	return session, err
+}
+
+// postSession posts payload to the session URL
+func (m Merchant) postSession(ctx context.Context, sessionURL string,
+	payload []byte) (*MerchantSession, error) {
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sessionURL,
+		bytes.NewReader(payload))
 	if err != nil {
-		return errors.Wrap(err, "error parsing the URL")
+		return nil, newError(
+			CodeInvalidSessionURL,
+			errors.Wrap(err, "error creating the request"),
+		)
 	}
-	hostReg := regexp.MustCompile("^(cn-)?apple-pay-gateway(-.+)?.apple.com$")
-	if !hostReg.MatchString(u.Host) {
-		return errors.New("invalid host")
+	req.Header.Set("Content-Type", "application/json")
+	res, err := m.authenticatedClient().Do(req)
+	if err != nil {
+		return nil, newError(
+			CodeGateway,
+			errors.Wrap(err, "error making the request"),
+		)
 	}
-	if u.Scheme != "https" {
-		return errors.New("unsupported protocol")
+
+	return parseSessionResponse(res, m.policy().Now())
+}
+
+// SessionInitiative sets the initiative of a session and its context: the
+// domain name of the payment page for InitiativeWeb, or the URL of the
+// payment gateway for InitiativeMessaging
+func SessionInitiative(initiative Initiative, context string) SessionOption {
+	return func(r *sessionRequest) error {
+		switch initiative {
+		case InitiativeWeb:
+			if context == "" || strings.ContainsAny(context, "/:") {
+				return errors.Errorf("invalid domain name %q", context)
+			}
+		case InitiativeMessaging:
+			u, err := url.Parse(context)
+			if err != nil || u.Scheme != "https" || u.Host == "" {
+				return errors.Errorf("invalid payment gateway URL %q", context)
+			}
+		default:
+			return errors.Errorf("unknown initiative %q", initiative)
+		}
+
+		r.Initiative = initiative
+		r.InitiativeContext = context
+		return nil
 	}
-	return nil
 }
 
 // sessionRequest builds a request struct for Apple Pay sessions
-func (m Merchant) sessionRequest() *sessionRequest {
-	return &sessionRequest{
+func (m Merchant) sessionRequest(options []SessionOption) (*sessionRequest, error) {
+	r := &sessionRequest{
 		MerchantIdentifier: m.identifier,
-		DomainName:         m.domainName,
 		DisplayName:        m.displayName,
+		Initiative:         InitiativeWeb,
+		InitiativeContext:  m.domainName,
+	}
+	for _, option := range options {
+		if err := option(r); err != nil {
+			return nil, withDefaultCode(CodeInvalidConfiguration, err)
+		}
+	}
+	if r.Initiative == InitiativeWeb {
+		r.DomainName = r.InitiativeContext
 	}
+	return r, nil
 }
 
 // authenticatedClient returns a HTTP client authenticated with the Merchant
 // Identity certificate signed by Apple
 func (m Merchant) authenticatedClient() *http.Client {
+	transport := m.transport
+	if transport == nil {
+		// Merchants not created with New
+		transport = m.newTransport()
+	}
 	return &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				Certificates: []tls.Certificate{
-					*m.merchantCertificate,
-				},
-			},
-		},
-		Timeout: requestTimeout,
+		Transport: transport,
+		Timeout:   m.timeout(),
+	}
+}
+
+// timeout returns the request timeout of the merchant
+func (m Merchant) timeout() time.Duration {
+	if m.requestTimeout == 0 {
+		return requestTimeout
 	}
+	return m.requestTimeout
 }
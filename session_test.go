@@ -2,6 +2,8 @@ package applepay
 
 import (
 	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"net/http"
 	"os"
 	"testing"
@@ -21,6 +23,7 @@ func TestSession(t *testing.T) {
 
 		Convey("err should be correct", func() {
 			So(err.Error(), ShouldStartWith, "nil merchant certificate")
+			So(errors.Is(err, ErrMissingCertificate), ShouldBeTrue)
 		})
 	})
 
@@ -44,7 +47,6 @@ func TestSession(t *testing.T) {
 	)
 
 	Convey("An invalid session URL is blocked", t, func() {
-		requestTimeout = 30 * time.Second
 		res, err := m.Session("http://example.com")
 
 		Convey("res should be nil", func() {
@@ -53,12 +55,20 @@ func TestSession(t *testing.T) {
 
 		Convey("err should be correct", func() {
 			So(err.Error(), ShouldStartWith, "invalid session request URL")
+			So(errors.Is(err, ErrInvalidSessionURL), ShouldBeTrue)
 		})
 	})
 
 	Convey("Request errors are caught", t, func() {
 		// Let's see if Apple Pay is that fast!
-		requestTimeout = time.Nanosecond
+		m, _ := New(
+			"merchant.com.processout.test",
+			MerchantRequestTimeout(time.Nanosecond),
+			MerchantCertificateLocation(
+				"tests/certs/cert-merchant.crt",
+				"tests/certs/cert-merchant-key.pem",
+			),
+		)
 
 		res, err := m.Session("https://apple-pay-gateway.apple.com/paymentservices/startSession")
 
@@ -68,105 +78,105 @@ func TestSession(t *testing.T) {
 
 		Convey("err should be correct", func() {
 			So(err.Error(), ShouldStartWith, "error making the request")
+			So(errors.Is(err, ErrGateway), ShouldBeTrue)
 		})
 	})
 
 	Convey("A normal request works", t, func() {
-		requestTimeout = 30 * time.Second
 		res, err := m.Session("https://apple-pay-gateway.apple.com/paymentservices/startSession")
 
-		Convey("The body of the response is returned properly", func() {
-			// Out details won't actually work so we'll just check that we're getting some JSON
-			So(string(res), ShouldContainSubstring, "{")
-		})
-
-		Convey("err is nil", func() {
-			So(err, ShouldBeNil)
+		Convey("Apple's answer is returned", func() {
+			// Our details won't actually work so we'll just check that Apple
+			// answered
+			if err == nil {
+				So(string(res), ShouldContainSubstring, "{")
+			} else {
+				So(errors.Is(err, ErrSessionRejected), ShouldBeTrue)
+			}
 		})
 	})
 }
 
-func TestCheckSessionURL(t *testing.T) {
-	Convey("Invalid urls", t, func() {
-		Convey("An known invalid URL does not work", func() {
-			So(checkSessionURL("%gh&%ij"), ShouldNotBeNil)
-		})
+func TestSessionRequest(t *testing.T) {
+	m := &Merchant{
+		identifier:  "merchant.com.example",
+		displayName: "example",
+		domainName:  "example.com",
+	}
 
-		Convey(`"not a url" does not work`, func() {
-			So(checkSessionURL("not a url"), ShouldNotBeNil)
-		})
+	Convey("The config should be used", t, func() {
+		ref := &sessionRequest{
+			MerchantIdentifier: "merchant.com.example",
+			DisplayName:        "example",
+			Initiative:         InitiativeWeb,
+			InitiativeContext:  "example.com",
+			DomainName:         "example.com",
+		}
+		res, err := m.sessionRequest(nil)
+		So(err, ShouldBeNil)
+		So(res, ShouldResemble, ref)
 	})
 
-	Convey("Wrong domain", t, func() {
-		Convey("example.com does not work", func() {
-			So(checkSessionURL("httos://example.com"), ShouldNotBeNil)
-		})
-
-		Convey("apple.com does not work", func() {
-			So(checkSessionURL("https://apple.com"), ShouldNotBeNil)
-		})
-
-		Convey("attacking attempt should not work", func() {
-			So(checkSessionURL("https://attacker.com/cn-apple-pay-gateway.apple.com"), ShouldNotBeNil)
-		})
-
-		Convey("attacking attempt 2 should not work", func() {
-			So(checkSessionURL("https://attacker.com?cn-apple-pay-gateway.apple.com"), ShouldNotBeNil)
-		})
-
-	})
+	Convey("The payload has the current and legacy fields", t, func() {
+		res, _ := m.sessionRequest(nil)
+		payload, _ := json.Marshal(res)
 
-	Convey("Wrong scheme", t, func() {
-		Convey("HTTP does not work", func() {
-			So(checkSessionURL("http://apple-pay-gateway.apple.com"), ShouldNotBeNil)
-		})
+		So(string(payload), ShouldEqual, `{"merchantIdentifier":"merchant.com.example","displayName":"example","initiative":"web","initiativeContext":"example.com","domainName":"example.com"}`)
 	})
 
-	Convey("Valid cases", t, func() {
-		Convey("Right domain with right scheme works", func() {
-			So(checkSessionURL("https://apple-pay-gateway.apple.com"), ShouldBeNil)
-		})
+	Convey("The domain name can be set per call", t, func() {
+		res, err := m.sessionRequest([]SessionOption{SessionInitiative(InitiativeWeb, "shop.example.com")})
 
-		Convey("China specific domain works", func() {
-			So(checkSessionURL("https://cn-apple-pay-gateway.apple.com"), ShouldBeNil)
-		})
+		So(err, ShouldBeNil)
+		So(res.InitiativeContext, ShouldEqual, "shop.example.com")
+		So(res.DomainName, ShouldEqual, "shop.example.com")
+	})
 
-		Convey("Alternative gateway URLs work", func() {
-			So(checkSessionURL("https://apple-pay-gateway-cert.apple.com"), ShouldBeNil)
-		})
+	Convey("Messaging sessions have no domain name", t, func() {
+		res, err := m.sessionRequest([]SessionOption{SessionInitiative(InitiativeMessaging, "https://pay.example.com/messages")})
+		So(err, ShouldBeNil)
 
-		Convey("Function accepts any path", func() {
-			So(checkSessionURL("https://apple-pay-gateway.apple.com/test"), ShouldBeNil)
-		})
+		payload, _ := json.Marshal(res)
+		So(string(payload), ShouldEqual, `{"merchantIdentifier":"merchant.com.example","displayName":"example","initiative":"messaging","initiativeContext":"https://pay.example.com/messages"}`)
 	})
-}
 
-func TestSessionRequest(t *testing.T) {
-	Convey("The config should be used", t, func() {
-		m := &Merchant{
-			identifier:  "merchant.com.example",
-			displayName: "example",
-			domainName:  "example.com",
+	Convey("Invalid initiatives are rejected", t, func() {
+		for _, option := range []SessionOption{
+			SessionInitiative("in_store", "example.com"),
+			SessionInitiative(InitiativeWeb, ""),
+			SessionInitiative(InitiativeWeb, "https://example.com"),
+			SessionInitiative(InitiativeMessaging, "example.com"),
+			SessionInitiative(InitiativeMessaging, "http://example.com"),
+		} {
+			_, err := m.sessionRequest([]SessionOption{option})
+			So(errors.Is(err, ErrInvalidConfiguration), ShouldBeTrue)
 		}
-		ref := &sessionRequest{
-			MerchantIdentifier: "merchant.com.example",
-			DomainName:         "example.com",
-			DisplayName:        "example",
-		}
-		res := m.sessionRequest()
-		So(res, ShouldResemble, ref)
 	})
 }
 
 func TestAuthenticatedClient(t *testing.T) {
 	Convey("The right certificate is used", t, func() {
 		fakeCert := tls.Certificate{Certificate: [][]byte{[]byte("test")}}
-		m := &Merchant{merchantCertificate: &fakeCert}
+		m := &Merchant{}
+		m.storeKeys(&keyPairs{merchantCertificate: &fakeCert})
 
-		So(
-			m.authenticatedClient().Transport.(*http.Transport).TLSClientConfig.Certificates[0],
-			ShouldResemble,
-			fakeCert,
-		)
+		config := m.authenticatedClient().Transport.(*http.Transport).TLSClientConfig
+		cert, err := config.GetClientCertificate(&tls.CertificateRequestInfo{})
+		So(err, ShouldBeNil)
+		So(cert, ShouldResemble, &fakeCert)
+
+		Convey("including after a reload", func() {
+			renewedCert := tls.Certificate{Certificate: [][]byte{[]byte("renewed")}}
+			m.storeKeys(&keyPairs{merchantCertificate: &renewedCert})
+
+			cert, _ := config.GetClientCertificate(&tls.CertificateRequestInfo{})
+			So(cert, ShouldResemble, &renewedCert)
+		})
+	})
+
+	Convey("The transport is shared by the requests", t, func() {
+		m, _ := New("merchant.com.processout.test")
+
+		So(m.authenticatedClient().Transport, ShouldEqual, m.authenticatedClient().Transport)
 	})
 }
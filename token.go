@@ -1,6 +1,7 @@
 package applepay
 
 import (
+	"context"
 	"time"
 
 	"github.com/pkg/errors"
@@ -47,8 +48,9 @@ type (
 		ApplicationExpirationDate string
 		// CurrencyCode is the ISO 4217 numeric currency code, as a string to preserve leading zeros
 		CurrencyCode string
-		// TransactionAmount is the value of the transaction
-		TransactionAmount float64
+		// TransactionAmount is the value of the transaction, in minor units
+		// of the currency
+		TransactionAmount Amount
 		// CardholderName is the name on the card
 		CardholderName string
 		// DeviceManufacturerIdentifier is a hex-encoded device manufacturer identifier
@@ -85,19 +87,25 @@ const (
 var (
 	// This section contains all modifiable settings of the package
 
-	// AppleRootCertificatePath is the relative path to Apple's root certificate
-	AppleRootCertificatePath = "AppleRootCA-G3.crt"
+	// AppleRootCertificatePath is the relative path to Apple's root
+	// certificate, used by policies without roots if not empty.
+	//
+	// Deprecated: Apple Root CA - G3 is embedded in the package, other roots
+	// can be trusted with VerificationPolicy.Roots.
+	AppleRootCertificatePath = ""
 
 	// TransactionTimeWindow is the window of time, in minutes, where
-	// transactions can fit to limit replay attacks
+	// transactions can fit to limit replay attacks. It is the default
+	// VerificationPolicy.PastWindow.
 	TransactionTimeWindow = 5 * time.Minute
 )
 
 // PublicKeyHash returns the hash of the public key used in the token after
-// checking the message's signature. This is useful for selecting the
-// appropriate processing key for merchants/PSPs that may have many.
+// checking the message's signature with the default policy. This is useful for
+// selecting the appropriate processing key for merchants/PSPs that may have
+// many.
 func (t PKPaymentToken) PublicKeyHash() ([]byte, error) {
-	if err := t.verifySignature(); err != nil {
+	if err := t.verifySignature(context.Background(), DefaultVerificationPolicy()); err != nil {
 		return nil, errors.Wrap(err, "invalid token signature")
 	}
 	return t.PaymentData.Header.PublicKeyHash, nil
@@ -106,11 +114,11 @@ func (t PKPaymentToken) PublicKeyHash() ([]byte, error) {
 // SetTransactionTime sets the time the merchant received the token. This
 // is useful to protect against replay attacks. By default this value is set to
 // time.Now(), when the token is decrypted.
-// It may be useful to change the transaction time window (see the global
-// variable TransactionTimeWindow)
+// It may be useful to change the transaction time window (see
+// VerificationPolicy)
 func (t *PKPaymentToken) SetTransactionTime(transactionTime time.Time) error {
 	if t == nil {
-		return errors.New("nil token")
+		return newError(CodeMalformedToken, errors.New("nil token"))
 	}
 
 	t.transactionTime = transactionTime
@@ -118,15 +126,15 @@ func (t *PKPaymentToken) SetTransactionTime(transactionTime time.Time) error {
 }
 
 // checkVersion verifies if the token's version of the encryption protocol is
-// supported. We support EC_v1 and RSA_v1.
+// supported. EC_v1, RSA_v1 and the registered schemes are supported.
 func (t PKPaymentToken) checkVersion() error {
-	if version(t.PaymentData.Version) == vEC_v1 {
-		return nil
-	}
-	if version(t.PaymentData.Version) == vRSA_v1 {
-		return nil
-	}
-	return errors.Errorf("unsupported version %s", t.PaymentData.Version)
+	_, err := lookupScheme(t.PaymentData.Version)
+	return err
+}
+
+// Currency returns the currency of CurrencyCode, if known
+func (t Token) Currency() (Currency, bool) {
+	return LookupCurrency(t.CurrencyCode)
 }
 
 // String implements fmt.Stringer for version
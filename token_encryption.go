@@ -1,88 +1,173 @@
 package applepay
 
 import (
+	"context"
+	"crypto"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ecdh"
 	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
-	"math/big"
 
 	"github.com/pkg/errors"
 )
 
-// DecryptResponse calls DecryptToken(r.Token)
-func (m Merchant) DecryptResponse(r *Response) (*Token, error) {
-	return m.DecryptToken(&r.Token)
+// DecryptResponse calls DecryptToken(r.Token, options...)
+func (m Merchant) DecryptResponse(r *Response, options ...DecryptOption) (*Token, error) {
+	return m.DecryptToken(&r.Token, options...)
 }
 
-// DecryptToken decrypts an Apple Pay token
-func (m Merchant) DecryptToken(t *PKPaymentToken) (*Token, error) {
-	if m.processingCertificate == nil {
-		return nil, errors.New("nil processing certificate")
+// DecryptOrderResponse decrypts the token of r, and checks that it pays
+// amount in currency for the order identified by reference. See
+// ExpectedOrder.
+func (m Merchant) DecryptOrderResponse(r *Response, amount, currency,
+	reference string, options ...DecryptOption) (*Token, error) {
+
+	options = append([]DecryptOption{
+		ExpectedOrder(amount, currency, reference),
+	}, options...)
+	return m.DecryptResponse(r, options...)
+}
+
+// DecryptToken calls DecryptTokenContext(context.Background(), t, options...)
+func (m Merchant) DecryptToken(t *PKPaymentToken, options ...DecryptOption) (*Token, error) {
+	return m.DecryptTokenContext(context.Background(), t, options...)
+}
+
+// DecryptTokenContext decrypts an Apple Pay token. options add checks to the
+// token, once its signature is verified. The revocation statuses of the
+// signing certificates are fetched until ctx is done.
+func (m Merchant) DecryptTokenContext(ctx context.Context, t *PKPaymentToken,
+	options ...DecryptOption) (*Token, error) {
+
+	checks, err := newDecryptOptions(options)
+	if err != nil {
+		return nil, err
+	}
+
+	kp := m.keys()
+	if len(kp.processingKeys) == 0 {
+		return nil, newError(
+			CodeMissingCertificate,
+			errors.New("nil processing certificate"),
+		)
 	}
 	// Verify the signature before anything
-	if err := t.verifySignature(); err != nil {
+	if err := t.verifySignature(ctx, m.policy()); err != nil {
 		return nil, errors.Wrap(err, "invalid token signature")
 	}
+	if err := checks.verify(t); err != nil {
+		return nil, err
+	}
 
-	var key []byte
-	var err error
-	switch version(t.PaymentData.Version) {
-	case vEC_v1:
-		// Compute the encryption key for EC-based tokens
-		key, err = m.computeEncryptionKey(t)
-	case vRSA_v1:
-		// Decrypt the encryption key for RSA-based tokens
-		key, err = m.unwrapEncryptionKey(t)
+	// Select the processing key the token was encrypted for
+	processingKey, err := kp.processingKey(t)
+	if err != nil {
+		return nil, err
 	}
+
+	// The version was checked with the signature
+	scheme, err := lookupScheme(t.PaymentData.Version)
 	if err != nil {
-		return nil, errors.Wrap(err, "error retrieving the encryption key")
+		return nil, err
+	}
+	key, err := scheme.EncryptionKey(processingKey, t, m.identifierHash())
+	if err != nil {
+		return nil, errors.Wrap(
+			withDefaultCode(CodeDecryptionFailed, err),
+			"error retrieving the encryption key",
+		)
 	}
 
 	// Decrypt the token
-	plaintextToken, err := t.decrypt(key)
+	plaintextToken, err := scheme.Decrypt(key, t)
 	if err != nil {
-		return nil, errors.Wrap(err, "error decrypting the token")
+		return nil, errors.Wrap(
+			withDefaultCode(CodeDecryptionFailed, err),
+			"error decrypting the token",
+		)
 	}
 
 	// Parse the token
 	parsedToken := &Token{}
-	json.Unmarshal(plaintextToken, parsedToken)
+	if err := json.Unmarshal(plaintextToken, parsedToken); err != nil {
+		return nil, newError(
+			CodeMalformedToken,
+			errors.Wrap(err, "error parsing the decrypted token"),
+		)
+	}
+
+	if err := checks.verifyToken(parsedToken); err != nil {
+		return nil, err
+	}
+
+	// Only the first submission of a transaction is accepted. It is recorded
+	// last, so that tokens failing for other reasons may be submitted again.
+	if err := m.checkReplay(t); err != nil {
+		return nil, err
+	}
 
 	return parsedToken, nil
 }
 
+// processingKey returns the key of the processing certificate whose public key
+// hash matches the one in the token's header
+func (kp *keyPairs) processingKey(t *PKPaymentToken) (KeyProvider, error) {
+	keyHash := t.PaymentData.Header.PublicKeyHash
+	key, ok := kp.processingKeys[string(keyHash)]
+	if !ok {
+		return nil, newError(CodeKeyMismatch, errors.Errorf(
+			"no processing certificate matches the public key hash %s",
+			base64.StdEncoding.EncodeToString(keyHash),
+		))
+	}
+	return key, nil
+}
+
 // EC
 
 // computeEncryptionKey uses the token's ephemeral EC key, the processing
-// private key, and the merchant ID to compute the encryption key
+// private key, and the merchant ID hash to compute the encryption key
 // It is only used for the EC_v1 format
-func (m Merchant) computeEncryptionKey(t *PKPaymentToken) ([]byte, error) {
+func computeEncryptionKey(key KeyProvider, t *PKPaymentToken,
+	merchantIDHash []byte) ([]byte, error) {
+
 	// Load the required keys
 	pub, err := t.ephemeralPublicKey()
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to parse the public key")
+		return nil, newError(
+			CodeMalformedToken,
+			errors.Wrap(err, "unable to parse the public key"),
+		)
 	}
-	priv, ok := m.processingCertificate.PrivateKey.(*ecdsa.PrivateKey)
-	if !ok {
-		return nil, errors.New("non-elliptic processing private key")
+	if _, ok := key.Public().(*ecdsa.PublicKey); !ok {
+		return nil, newError(
+			CodeKeyMismatch,
+			errors.New("non-elliptic processing private key"),
+		)
 	}
 
 	// Generate the shared secret
-	sharedSecret := ecdheSharedSecret(pub, priv)
+	sharedSecret, err := key.ECDH(pub)
+	if err != nil {
+		return nil, newError(
+			CodeDecryptionFailed,
+			errors.Wrap(err, "error computing the shared secret"),
+		)
+	}
 
 	// Final key derivation from the shared secret and the hash of the merchant ID
-	key := deriveEncryptionKey(sharedSecret, m.identifierHash())
-
-	return key, nil
+	return deriveEncryptionKey(sharedSecret, merchantIDHash), nil
 }
 
 // ephemeralPublicKey parsed the ephemeral public key in a PKPaymentToken
-func (t PKPaymentToken) ephemeralPublicKey() (*ecdsa.PublicKey, error) {
+// Keys which are not P-256 points, or are off the curve, are rejected
+func (t PKPaymentToken) ephemeralPublicKey() (*ecdh.PublicKey, error) {
 	// Parse the ephemeral public key
 	pubI, err := x509.ParsePKIXPublicKey(
 		t.PaymentData.Header.EphemeralPublicKey,
@@ -90,25 +175,35 @@ func (t PKPaymentToken) ephemeralPublicKey() (*ecdsa.PublicKey, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "error parsing the public key")
 	}
-	pub, ok := pubI.(*ecdsa.PublicKey)
+	ecdsaPub, ok := pubI.(*ecdsa.PublicKey)
 	if !ok {
 		return nil, errors.New("invalid EC public key")
 	}
+	pub, err := ecdsaPub.ECDH()
+	if err != nil || pub.Curve() != ecdh.P256() {
+		return nil, errors.New("invalid EC public key")
+	}
 	return pub, nil
 }
 
 // ecdheSharedSecret computes the shared secret between an EC public key and a
 // EC private key, according to RFC5903 Section 9
-func ecdheSharedSecret(pub *ecdsa.PublicKey, priv *ecdsa.PrivateKey) *big.Int {
-	z, _ := priv.Curve.ScalarMult(pub.X, pub.Y, priv.D.Bytes())
-	return z
+// The secret is always as long as the field size, 32 bytes for P-256
+func ecdheSharedSecret(pub *ecdh.PublicKey,
+	priv *ecdh.PrivateKey) ([]byte, error) {
+
+	if pub.Curve() != priv.Curve() {
+		return nil, errors.New("mismatched elliptic curves")
+	}
+	// crypto/ecdh rejects the point at infinity
+	return priv.ECDH(pub)
 }
 
 // deriveEncryptionKey derives the symmetric encryption key of the token payload
 // from a ECDHE shared secret and a hash of the merchant ID
 // It uses the function described in NIST SP 800-56A, section 5.8.1
 // See https://developer.apple.com/library/content/documentation/PassKit/Reference/PaymentTokenJSON/PaymentTokenJSON.html#//apple_ref/doc/uid/TP40014929-CH8-SW2
-func deriveEncryptionKey(sharedSecret *big.Int, merchantIDHash []byte) []byte {
+func deriveEncryptionKey(sharedSecret, merchantIDHash []byte) []byte {
 	// Only one round of the function is required
 	counter := []byte{0, 0, 0, 1}
 	// Apple-defined KDF parameters
@@ -119,7 +214,7 @@ func deriveEncryptionKey(sharedSecret *big.Int, merchantIDHash []byte) []byte {
 	// SHA256( counter || sharedSecret || algorithm || partyU || partyV )
 	h := sha256.New()
 	h.Write(counter)
-	h.Write(sharedSecret.Bytes())
+	h.Write(sharedSecret)
 	h.Write(kdfAlgorithm)
 	h.Write(kdfPartyU)
 	h.Write(kdfPartyV)
@@ -132,24 +227,36 @@ func deriveEncryptionKey(sharedSecret *big.Int, merchantIDHash []byte) []byte {
 // unwrapEncryptionKey uses the merchant's RSA processing key to decrypt the
 // encryption key stored in the token
 // It is only used for the RSA_v1 format
-func (m Merchant) unwrapEncryptionKey(t *PKPaymentToken) ([]byte, error) {
-	priv, ok := m.processingCertificate.PrivateKey.(*rsa.PrivateKey)
-	if !ok {
-		return nil, errors.New("processing key is not RSA")
+func unwrapEncryptionKey(key KeyProvider, t *PKPaymentToken) ([]byte, error) {
+
+	if _, ok := key.Public().(*rsa.PublicKey); !ok {
+		return nil, newError(
+			CodeKeyMismatch,
+			errors.New("processing key is not RSA"),
+		)
 	}
 
 	cipherText := t.PaymentData.Header.WrappedKey
 	if cipherText == nil {
-		return nil, errors.New("empty key ciphertext")
+		return nil, newError(
+			CodeMalformedToken,
+			errors.New("empty key ciphertext"),
+		)
 	}
 
-	hash := sha256.New()
-	key, err := rsa.DecryptOAEP(hash, rand.Reader, priv, cipherText, nil)
+	symmetricKey, err := key.Decrypt(
+		rand.Reader,
+		cipherText,
+		&rsa.OAEPOptions{Hash: crypto.SHA256},
+	)
 	if err != nil {
-		return nil, errors.Wrap(err, "error decrypting the key")
+		return nil, newError(
+			CodeDecryptionFailed,
+			errors.Wrap(err, "error decrypting the key"),
+		)
 	}
 
-	return key, nil
+	return symmetricKey, nil
 }
 
 // AES
@@ -1,6 +1,7 @@
 package applepay
 
 import (
+	"crypto/ecdh"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
@@ -10,6 +11,7 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"math"
 	"math/big"
 	"os"
@@ -23,6 +25,15 @@ func init() {
 	TransactionTimeWindow = time.Duration(math.MaxInt64)
 }
 
+// firstProcessingKey returns any of the merchant's processing keys, for tests
+// with a single one
+func firstProcessingKey(m *Merchant) KeyProvider {
+	for _, key := range m.keys().processingKeys {
+		return key
+	}
+	return nil
+}
+
 func TestDecryptResponse(t *testing.T) {
 	if _, err := os.Stat("tests/certs/cert-merchant.crt"); os.IsNotExist(err) {
 		t.Skip()
@@ -51,7 +62,7 @@ func TestDecryptResponse(t *testing.T) {
 			ApplicationPrimaryAccountNumber: "4417083031500965",
 			ApplicationExpirationDate:       "221130",
 			CurrencyCode:                    "978",
-			TransactionAmount:               1,
+			TransactionAmount:               NewAmount(1),
 			DeviceManufacturerIdentifier:    "040010030273",
 			PaymentDataType:                 "3DSecure",
 			PaymentData: struct {
@@ -122,14 +133,15 @@ func TestDecryptToken(t *testing.T) {
 
 		Convey("err is correct", func() {
 			So(err.Error(), ShouldStartWith, "invalid token signature")
+			So(errors.Is(err, ErrInvalidSignature), ShouldBeTrue)
 		})
 	})
 
 	Convey("Key computation errors are caught", t, func() {
-		m2 := &Merchant{
-			merchantCertificate:   mEC.merchantCertificate,
-			processingCertificate: mEC.merchantCertificate,
-		}
+		m2 := &Merchant{}
+		m2.storeKeys(&keyPairs{
+			merchantCertificate: mEC.keys().merchantCertificate,
+		})
 
 		res, err := m2.DecryptToken(ecToken)
 
@@ -139,14 +151,13 @@ func TestDecryptToken(t *testing.T) {
 
 		Convey("err is correct", func() {
 			So(err.Error(), ShouldStartWith, "nil processing certificate")
+			So(errors.Is(err, ErrMissingCertificate), ShouldBeTrue)
 		})
 	})
 
 	Convey("Decryption errors are caught", t, func() {
-		m2 := &Merchant{
-			merchantCertificate:   mEC.merchantCertificate,
-			processingCertificate: mEC.processingCertificate,
-		}
+		m2 := &Merchant{}
+		m2.storeKeys(mEC.keys())
 
 		res, err := m2.DecryptToken(ecToken)
 
@@ -156,6 +167,7 @@ func TestDecryptToken(t *testing.T) {
 
 		Convey("err is correct", func() {
 			So(err.Error(), ShouldStartWith, "error decrypting the token")
+			So(errors.Is(err, ErrDecryptionFailed), ShouldBeTrue)
 		})
 	})
 
@@ -165,7 +177,7 @@ func TestDecryptToken(t *testing.T) {
 			ApplicationPrimaryAccountNumber: "4417083031500965",
 			ApplicationExpirationDate:       "221130",
 			CurrencyCode:                    "978",
-			TransactionAmount:               1,
+			TransactionAmount:               NewAmount(1),
 			DeviceManufacturerIdentifier:    "040010030273",
 			PaymentDataType:                 "3DSecure",
 			PaymentData: struct {
@@ -194,7 +206,7 @@ func TestDecryptToken(t *testing.T) {
 			ApplicationPrimaryAccountNumber: "4417083031500965",
 			ApplicationExpirationDate:       "221130",
 			CurrencyCode:                    "978",
-			TransactionAmount:               1,
+			TransactionAmount:               NewAmount(1),
 			DeviceManufacturerIdentifier:    "040010030273",
 			PaymentDataType:                 "3DSecure",
 			PaymentData: struct {
@@ -240,7 +252,7 @@ func TestComputeEncryptionKey(t *testing.T) {
 		t := &PKPaymentToken{}
 		t.PaymentData.Header.EphemeralPublicKey = []byte{}
 
-		key, err := m.computeEncryptionKey(t)
+		key, err := computeEncryptionKey(firstProcessingKey(m), t, m.identifierHash())
 
 		Convey("key is nil", func() {
 			So(key, ShouldBeNil)
@@ -248,24 +260,18 @@ func TestComputeEncryptionKey(t *testing.T) {
 
 		Convey("err is correct", func() {
 			So(err.Error(), ShouldStartWith, "unable to parse the public key")
+			So(errors.Is(err, ErrMalformedToken), ShouldBeTrue)
 		})
 	})
 
 	Convey("Non-elliptic processing keys are rejected", t, func() {
-		m2 := &Merchant{
-			merchantCertificate: m.merchantCertificate,
-		}
-		tpl := &x509.Certificate{SerialNumber: big.NewInt(0)}
 		mKey, _ := rsa.GenerateKey(rand.Reader, 2048)
-		mCertB, _ := x509.CreateCertificate(rand.Reader, tpl, tpl, &mKey.PublicKey, mKey)
-		m2.processingCertificate = &tls.Certificate{
-			Certificate: [][]byte{mCertB},
-		}
+		provider, _ := NewMemoryKeyProvider(mKey)
 
 		t := &PKPaymentToken{}
 		t.PaymentData.Header.EphemeralPublicKey, _ = base64.StdEncoding.DecodeString("MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAEH5hMm7QXtTZBVHqIEg4PZveYt0vkmO1SsIWthxzl8NMBfhtPiUDkvgAKoUAOsTu2WqZxoJqccEX3GwWk4fIEjw==")
 
-		key, err := m2.computeEncryptionKey(t)
+		key, err := computeEncryptionKey(provider, t, nil)
 
 		Convey("key is nil", func() {
 			So(key, ShouldBeNil)
@@ -273,6 +279,7 @@ func TestComputeEncryptionKey(t *testing.T) {
 
 		Convey("err is correct", func() {
 			So(err.Error(), ShouldEqual, "non-elliptic processing private key")
+			So(errors.Is(err, ErrKeyMismatch), ShouldBeTrue)
 		})
 	})
 
@@ -280,7 +287,7 @@ func TestComputeEncryptionKey(t *testing.T) {
 		t := &PKPaymentToken{}
 		t.PaymentData.Header.EphemeralPublicKey, _ = base64.StdEncoding.DecodeString("MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAEH5hMm7QXtTZBVHqIEg4PZveYt0vkmO1SsIWthxzl8NMBfhtPiUDkvgAKoUAOsTu2WqZxoJqccEX3GwWk4fIEjw==")
 
-		key, err := m.computeEncryptionKey(t)
+		key, err := computeEncryptionKey(firstProcessingKey(m), t, m.identifierHash())
 
 		Convey("key is correct", func() {
 			So(key, ShouldResemble, []byte{10, 130, 215, 130, 147, 201, 145, 236, 211, 219, 140, 70, 140, 203, 236, 23, 105, 85, 123, 243, 184, 255, 101, 171, 112, 2, 191, 86, 112, 139, 154, 187})
@@ -310,6 +317,38 @@ func TestEphemeralPublicKey(t *testing.T) {
 		})
 	})
 
+	Convey("Points off the curve", t, func() {
+		key, _ := base64.StdEncoding.DecodeString("MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAEqTV0E3dFQ2fg9QbIQ1a8sGMHav6UicUjo5nyWnO4kBAWxOGTUauID6L48yjKSk6nJDJU6pYNZXDyTyHalW+zjA==")
+		key[len(key)-1] ^= 1
+		t := &PKPaymentToken{}
+		t.PaymentData.Header.EphemeralPublicKey = key
+
+		pub, err := t.ephemeralPublicKey()
+
+		Convey("Public key should be nil", func() {
+			So(pub, ShouldBeNil)
+		})
+		Convey("Error should not be nil", func() {
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Point at infinity", t, func() {
+		// SubjectPublicKeyInfo of the P-256 identity point, encoded as 0x00
+		key, _ := hex.DecodeString("3019301306072a8648ce3d020106082a8648ce3d03010703020000")
+		t := &PKPaymentToken{}
+		t.PaymentData.Header.EphemeralPublicKey = key
+
+		pub, err := t.ephemeralPublicKey()
+
+		Convey("Public key should be nil", func() {
+			So(pub, ShouldBeNil)
+		})
+		Convey("Error should not be nil", func() {
+			So(err, ShouldNotBeNil)
+		})
+	})
+
 	Convey("RSA key", t, func() {
 		key, _ := base64.StdEncoding.DecodeString("MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEA0Jeh+BjAxKfPtzI/qN2YSHag0NXgZl6F7E+p3HNknYneVNfiqRlqjoO1nW1u72nmCPQuyrT3AXd6npqBABTLsadMQoEwU2dzgLI94KRU1bAhZ3gij+ibfxJvRW22YXnD4KaBmC3LDhB2AZWiEQgN9GEuWQo1G/T77F0+Y1ww0wxGNYdud7LYEi5inGQwydizbcGrJPhnZ4LZx7cSZ3BZzX23ckJZ9vTQHpHGEzNAKLUzQpST0L0xUsugkjcjZNYoAgKo0TrR8yJ7FykAD5rVzQShVLsoP///36eiZQjVXsr988lhAEqtdC6GCR70WwlP5mHLBarWG1BODiqflMLOeQIDAQAB")
 		t := &PKPaymentToken{
@@ -349,23 +388,80 @@ func TestEphemeralPublicKey(t *testing.T) {
 }
 
 func TestECDHESharedSecret(t *testing.T) {
-	Convey("Generic test", t, func() {
-		So(
-			ecdheSharedSecret(
-				&ecdsa.PublicKey{
-					X: big.NewInt(3),
-					Y: big.NewInt(2),
-				},
-				&ecdsa.PrivateKey{
-					PublicKey: ecdsa.PublicKey{
-						Curve: elliptic.P256(),
-					},
-					D: big.NewInt(2),
-				},
-			),
-			ShouldResemble,
-			big.NewInt(30),
+	vectors := []struct {
+		name, priv, pub, secret string
+	}{
+		{
+			name:   "Secrets are 32 bytes long",
+			priv:   "87ff5890ab95dfbb457a82af49c0fe8df8a8595fc5e96571bff384645aa377f8",
+			pub:    "04f4a2b7a64d46535ae13b79cba3ebb55828e4651bac2cd019f37dbecf764f7ff69947407e45794d5b3dc298573955cf8813a3b364d90583df0ba7751a18db52bd",
+			secret: "46ba78e366adbe80b447ed783d83abd1598eb715412a3ae35ad4d21ae23a7e67",
+		},
+		{
+			name:   "Leading zeros are kept",
+			priv:   "ec18cac25577ad0cd58ee31661e0d527ccfbbf7a5e1aafebf4c98af266a8b1be",
+			pub:    "04daa8ab75490028a5b3835c60910604a82c73fe31b97808ab892926f423f097aa90bad880f2c1f007a99f8d513e9de2c3dc543983b031083e1d4beaa3d0fafa48",
+			secret: "00c35c8a895c8b3e50e6854a5f2464fbc23c105aed2aceb82acddada3d3eab74",
+		},
+	}
+	for _, v := range vectors {
+		v := v
+		Convey(v.name, t, func() {
+			privBytes, _ := hex.DecodeString(v.priv)
+			pubBytes, _ := hex.DecodeString(v.pub)
+			priv, _ := ecdh.P256().NewPrivateKey(privBytes)
+			pub, _ := ecdh.P256().NewPublicKey(pubBytes)
+
+			secret, err := ecdheSharedSecret(pub, priv)
+
+			Convey("secret should be correct", func() {
+				So(hex.EncodeToString(secret), ShouldEqual, v.secret)
+			})
+
+			Convey("err should be nil", func() {
+				So(err, ShouldBeNil)
+			})
+		})
+	}
+
+	Convey("Mismatched curves are rejected", t, func() {
+		priv, _ := ecdh.P256().GenerateKey(rand.Reader)
+		other, _ := ecdh.P384().GenerateKey(rand.Reader)
+
+		_, err := ecdheSharedSecret(other.PublicKey(), priv)
+
+		So(err.Error(), ShouldEqual, "mismatched elliptic curves")
+	})
+
+	Convey("Leading zeros are used to compute the encryption key", t, func() {
+		// Processing key and ephemeral public key of the leading zero vector
+		privBytes, _ := hex.DecodeString(vectors[1].priv)
+		pubBytes, _ := hex.DecodeString(vectors[1].pub)
+		x, y := elliptic.P256().ScalarBaseMult(privBytes)
+		provider, _ := NewMemoryKeyProvider(&ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y},
+			D:         new(big.Int).SetBytes(privBytes),
+		})
+		x, y = elliptic.Unmarshal(elliptic.P256(), pubBytes)
+		token := &PKPaymentToken{}
+		token.PaymentData.Header.EphemeralPublicKey, _ = x509.MarshalPKIXPublicKey(
+			&ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y},
 		)
+		m := &Merchant{identifier: "merchant.com.processout.test"}
+
+		key, err := computeEncryptionKey(provider, token, m.identifierHash())
+
+		Convey("key should be correct", func() {
+			So(
+				hex.EncodeToString(key),
+				ShouldEqual,
+				"590969d1c399ad3159db7f18aa23eea67320dd3ee8c3a49b29d512db86967153",
+			)
+		})
+
+		Convey("err should be nil", func() {
+			So(err, ShouldBeNil)
+		})
 	})
 }
 
@@ -373,7 +469,7 @@ func TestDeriveEncryptionKey(t *testing.T) {
 	Convey("Arbitrary numbers should give a correct result", t, func() {
 		So(
 			hex.EncodeToString(
-				deriveEncryptionKey(big.NewInt(0), []byte{0}),
+				deriveEncryptionKey([]byte{}, []byte{0}),
 			),
 			ShouldEqual,
 			"b50fb7efdb1ce4b7036e9dc0531ebb9d0101c4bcc57aba5a9f3c39fb5cdfafa6",
@@ -403,16 +499,13 @@ func TestUnwrapEncryptionKey(t *testing.T) {
 	token.PaymentData.Header.WrappedKey, _ = base64.StdEncoding.DecodeString("A6Y4H4Gv9HsQP+UB6lclGiraxCjB3tU/i60On/eTIK2zLvvF+DkrclAgAD0TN+Tpwo5+WB7adRbRYAZ7v15o4RarSg8Up8CWHo+FKcbVTGi0++sjweiP4uCbh6Bp886z8koT6yM+WPq9V505jVeiigA4Ip36GvFgHw3sqHfSIpOjYbeay9yJ9c8lXmasucJjceRjUUS+ZbaYtBYIxii0NvwsMGomztJsFglb2jVpAOt3YXaGIwVr/ss8FBLZdqYAXC+/oz4XcX7zh3cpoNo/qcVnyikdz84WaCBuaWBgRgQGL2ISFrAO531sJK/jkqyZRKzO5DYzXbRFRju7boHCMQ==")
 
 	Convey("Non-RSA private key does not work", t, func() {
-		m2 := &Merchant{
-			merchantCertificate: m.merchantCertificate,
-		}
 		processingCertificate, _ := tls.LoadX509KeyPair(
 			"tests/certs/cert-processing.crt",
 			"tests/certs/cert-processing-key.pem",
 		)
-		m2.processingCertificate = &processingCertificate
+		key, _ := NewMemoryKeyProvider(processingCertificate.PrivateKey)
 
-		res, err := m2.unwrapEncryptionKey(token)
+		res, err := unwrapEncryptionKey(key, token)
 
 		Convey("key is nil", func() {
 			So(res, ShouldBeNil)
@@ -420,12 +513,13 @@ func TestUnwrapEncryptionKey(t *testing.T) {
 
 		Convey("err is correct", func() {
 			So(err.Error(), ShouldStartWith, "processing key is not RSA")
+			So(errors.Is(err, ErrKeyMismatch), ShouldBeTrue)
 		})
 	})
 
 	Convey("Empty ciphertext is rejected", t, func() {
 		token2 := &PKPaymentToken{}
-		res, err := m.unwrapEncryptionKey(token2)
+		res, err := unwrapEncryptionKey(firstProcessingKey(m), token2)
 
 		Convey("key is nil", func() {
 			So(res, ShouldBeNil)
@@ -433,6 +527,7 @@ func TestUnwrapEncryptionKey(t *testing.T) {
 
 		Convey("err is correct", func() {
 			So(err.Error(), ShouldStartWith, "empty key ciphertext")
+			So(errors.Is(err, ErrMalformedToken), ShouldBeTrue)
 		})
 	})
 
@@ -444,7 +539,7 @@ func TestUnwrapEncryptionKey(t *testing.T) {
 				},
 			},
 		}
-		res, err := m.unwrapEncryptionKey(token2)
+		res, err := unwrapEncryptionKey(firstProcessingKey(m), token2)
 
 		Convey("key is nil", func() {
 			So(res, ShouldBeNil)
@@ -452,11 +547,12 @@ func TestUnwrapEncryptionKey(t *testing.T) {
 
 		Convey("err is correct", func() {
 			So(err.Error(), ShouldStartWith, "error decrypting the key")
+			So(errors.Is(err, ErrDecryptionFailed), ShouldBeTrue)
 		})
 	})
 
 	Convey("Correct parameters result in a correctly unwrapped key", t, func() {
-		res, err := m.unwrapEncryptionKey(token)
+		res, err := unwrapEncryptionKey(firstProcessingKey(m), token)
 		expectedKey := []byte{218, 13, 57, 122, 254, 44, 223, 66, 71, 49, 130, 77, 249, 104, 7, 236}
 
 		Convey("key is correct", func() {
@@ -527,3 +623,28 @@ func TestDecrypt(t *testing.T) {
 		})
 	})
 }
+
+func TestDecryptTokenKeyMismatch(t *testing.T) {
+	tokenJSON, _ := os.ReadFile("tests/token.json")
+	token := &PKPaymentToken{}
+	json.Unmarshal(tokenJSON, token)
+
+	Convey("Tokens encrypted for another processing key are rejected", t, func() {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		m, _ := New(
+			"merchant.com.processout.test",
+			ProcessingCertificate(testCertificate("merchant.com.processout.test", key)),
+		)
+
+		res, err := m.DecryptToken(token)
+
+		Convey("token is nil", func() {
+			So(res, ShouldBeNil)
+		})
+
+		Convey("err is correct", func() {
+			So(err.Error(), ShouldStartWith, "no processing certificate matches the public key hash")
+			So(errors.Is(err, ErrKeyMismatch), ShouldBeTrue)
+		})
+	})
+}
@@ -2,8 +2,9 @@ package applepay
 
 import (
 	"bytes"
+	"context"
 	"crypto/x509"
-	"encoding/hex"
+	"encoding/asn1"
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
@@ -19,9 +20,11 @@ var (
 )
 
 // verifySignature checks the signature of the token, partially using OpenSSL
-// due to Go's lack of support for PKCS7.
+// due to Go's lack of support for PKCS7. Revocation statuses are fetched
+// until ctx is done.
 // See https://developer.apple.com/library/content/documentation/PassKit/Reference/PaymentTokenJSON/PaymentTokenJSON.html#//apple_ref/doc/uid/TP40014929-CH8-SW2
-func (t *PKPaymentToken) verifySignature() error {
+func (t *PKPaymentToken) verifySignature(ctx context.Context,
+	policy VerificationPolicy) error {
 
 	// verify the version EC_v1 or RSA_v1
 	if err := t.checkVersion(); err != nil {
@@ -31,42 +34,66 @@ func (t *PKPaymentToken) verifySignature() error {
 	// parse p7
 	p7, err := pkcs7.Parse(t.PaymentData.Signature)
 	if err != nil {
-		return fmt.Errorf("cannot parse the signature: %s", err.Error())
+		return newError(
+			CodeInvalidSignature,
+			fmt.Errorf("cannot parse the signature: %s", err.Error()),
+		)
 	}
 
-	// load Apple Root CA - G3 root certificate
-	root, err := loadRootCertificate(AppleRootCertificatePath)
+	// load the trusted roots, Apple Root CA - G3 by default
+	roots, err := policy.roots()
 	if err != nil {
-		return errors.Wrap(err, "error loading the root certificate")
+		return newError(
+			CodeInvalidConfiguration,
+			errors.Wrap(err, "error loading the root certificate"),
+		)
 	}
 
-	// the certificate list should contain leaf and inter
-	if len(p7.Certificates) != 2 {
-		return errors.New("the len of certificates is less than 2")
+	// Locate leaf and inter by their marker OIDs, whatever their order
+	leaf, inter, err := policy.signingCertificates(p7)
+	if err != nil {
+		return newError(CodeUntrustedChain, err)
 	}
 
-	// Load
-	leaf := p7.Certificates[0]
-	inter := p7.Certificates[1]
+	// The chain is verified at the time of the signature, as certificates
+	// may expire between the signing and the reception of a token
+	signingTime, err := extractSigningTime(p7)
+	if err != nil {
+		return newError(CodeInvalidSignature, err)
+	}
 
 	// Ensure that the certificates contain the correct custom OIDs: 1.2.840.113635.100.6.29 for the leaf certificate and 1.2.840.113635.100.6.2.14 for the intermediate CA. The value for these marker OIDs doesn’t matter, only their presence.
 	// Ensure that there’s a valid X.509 chain of trust from the signature to the root CA. Specifically, ensure that the signature was created using the private key that corresponds to the leaf certificate, that the leaf certificate is signed by the intermediate CA, and that the intermediate CA is signed by the Apple Root CA - G3.
-	if err := verifyCertificates(root, inter, leaf); err != nil {
-		return errors.Wrap(err, "error when verifying the certificates")
+	chain, err := policy.verifyCertificates(roots, inter, leaf, signingTime)
+	if err != nil {
+		return withDefaultCode(
+			CodeUntrustedChain,
+			errors.Wrap(err, "error when verifying the certificates"),
+		)
 	}
 
 	// Validate the token’s signature. For ECC (EC_v1), ensure that the signature is a valid Ellyptical Curve Digital Signature Algorithm (ECDSA) signature (ecdsa-with-SHA256 1.2.840.10045.4.3.2) of the concatenated values of the ephemeralPublicKey, data, transactionId, and applicationData keys. For RSA (RSA_v1), ensure that the signature is a valid RSA signature (RSA-with-SHA256 1.2.840.113549.1.1.11) of the concatenated values of the wrappedKey, data, transactionId, and applicationData keys.
-	if err := t.verifyPKCS7Signature(p7); err != nil {
-		return errors.Wrap(err, "error when verifying the pkcs7 signature")
+	if err := t.verifyPKCS7Signature(p7, leaf); err != nil {
+		return errors.Wrap(
+			withDefaultCode(CodeInvalidSignature, err),
+			"error when verifying the pkcs7 signature",
+		)
 	}
 
-	if err := t.verifySigningTime(p7); err != nil {
+	if err := t.verifySigningTime(p7, policy); err != nil {
 		return errors.Wrap(
-			err,
+			withDefaultCode(CodeInvalidSignature, err),
 			"rejected signing time delta (possible replay attack)",
 		)
 	}
 
+	// Revocations are checked last, at the current time, so that only the
+	// tokens signed by the leaf trigger requests to the responders, and
+	// tokens signed before a revocation are rejected too
+	if err := policy.Revocation.checkChain(ctx, chain, policy.Now()); err != nil {
+		return errors.Wrap(err, "error when verifying the certificates")
+	}
+
 	return nil
 }
 
@@ -76,6 +103,11 @@ func loadRootCertificate(path string) (*x509.Certificate, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "error reading the root certificate")
 	}
+	return parseRootCertificate(rootPEMBytes)
+}
+
+// parseRootCertificate parses a PEM-encoded root certificate
+func parseRootCertificate(rootPEMBytes []byte) (*x509.Certificate, error) {
 	rootPEM, rest := pem.Decode(rootPEMBytes)
 	if rootPEM == nil {
 		return nil, errors.New("error decoding the root certificate")
@@ -96,80 +128,256 @@ func loadRootCertificate(path string) (*x509.Certificate, error) {
 }
 
 // verifyCertificates checks the validity of the certificate chain used for
-// signing the token, and verifies the chain of trust from root to leaf
-func verifyCertificates(root, inter, leaf *x509.Certificate) error {
+// signing the token at signingTime, verifies the chain of trust from one of
+// the roots to leaf, and returns it. Verified chains are cached, their
+// revocation status is left to the caller.
+func (p VerificationPolicy) verifyCertificates(roots *x509.CertPool,
+	inter, leaf *x509.Certificate,
+	signingTime time.Time) ([]*x509.Certificate, error) {
+
+	key := p.newChainKey(roots, inter, leaf)
+	if chain, ok := p.ChainCache.get(key, signingTime, p.Now()); ok {
+		return chain, nil
+	}
+	chain, err := p.verifyChain(roots, inter, leaf, signingTime)
+	if err != nil {
+		return nil, err
+	}
+	p.ChainCache.add(key, chain)
+	return chain, nil
+}
+
+// verifyChain verifies the chain of trust from one of the roots to leaf at
+// signingTime, and returns it
+func (p VerificationPolicy) verifyChain(roots *x509.CertPool,
+	inter, leaf *x509.Certificate,
+	signingTime time.Time) ([]*x509.Certificate, error) {
+
 	// Ensure the certificates contain the correct OIDs
-	if _, err := extractExtension(inter, interCertificateOID); err != nil {
-		return errors.Wrap(err, "invalid intermediate cert Apple extension")
+	if _, err := extractExtension(inter, p.IntermediateCertificateOID); err != nil {
+		return nil, errors.Wrap(err, "invalid intermediate cert Apple extension")
 	}
-	if _, err := extractExtension(leaf, leafCertificateOID); err != nil {
-		return errors.Wrap(err, "invalid leaf cert Apple extension")
+	if _, err := extractExtension(leaf, p.LeafCertificateOID); err != nil {
+		return nil, errors.Wrap(err, "invalid leaf cert Apple extension")
 	}
 
-	// Verify the chain of trust
-	if err := inter.CheckSignatureFrom(root); err != nil {
-		return errors.Wrap(err, "intermediate cert is not trusted by root")
+	// Check the constraints of each certificate first, to report which one
+	// is broken
+	if err := checkValidityAt(inter, "intermediate", signingTime); err != nil {
+		return nil, err
+	}
+	if err := checkValidityAt(leaf, "leaf", signingTime); err != nil {
+		return nil, err
+	}
+	if !inter.BasicConstraintsValid || !inter.IsCA {
+		return nil, errors.New("intermediate cert is not a CA")
+	}
+	if inter.KeyUsage != 0 && inter.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return nil, errors.New("intermediate cert key usage does not allow signing certificates")
+	}
+	if leaf.IsCA {
+		return nil, errors.New("leaf cert should not be a CA")
+	}
+	if leaf.KeyUsage&x509.KeyUsageDigitalSignature == 0 {
+		return nil, errors.New("leaf cert key usage does not allow digital signatures")
 	}
 	if err := leaf.CheckSignatureFrom(inter); err != nil {
-		return errors.Wrap(err, "leaf cert is not trusted by intermediate cert")
+		return nil, errors.Wrap(err, "leaf cert is not trusted by intermediate cert")
 	}
 
+	// Verify the whole chain of trust, including the path length and
+	// critical extensions
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(inter)
+	chains, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   signingTime,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	switch err.(type) {
+	case nil:
+		return chains[0], nil
+	case x509.UnknownAuthorityError:
+		return nil, errors.Wrap(err, "intermediate cert is not trusted by root")
+	default:
+		return nil, errors.Wrap(err, "invalid certificate chain")
+	}
+}
+
+// checkValidityAt checks that signingTime is within the validity period of
+// cert, named name in errors
+func checkValidityAt(cert *x509.Certificate, name string, signingTime time.Time) error {
+	if signingTime.Before(cert.NotBefore) || signingTime.After(cert.NotAfter) {
+		return errors.Errorf(
+			"%s cert is not valid at the signing time %s (valid from %s to %s)",
+			name,
+			signingTime.UTC().Format(time.RFC3339),
+			cert.NotBefore.UTC().Format(time.RFC3339),
+			cert.NotAfter.UTC().Format(time.RFC3339),
+		)
+	}
 	return nil
 }
 
-func (t PKPaymentToken) verifyPKCS7Signature(p7 *pkcs7.PKCS7) error {
+// signingCertificates returns the leaf and intermediate certificates of the
+// signature, identified by the marker OIDs of the policy. Other certificates
+// are ignored.
+func (p VerificationPolicy) signingCertificates(p7 *pkcs7.PKCS7) (leaf,
+	inter *x509.Certificate, err error) {
+
+	for _, cert := range p7.Certificates {
+		_, leafErr := extractExtension(cert, p.LeafCertificateOID)
+		_, interErr := extractExtension(cert, p.IntermediateCertificateOID)
+		switch {
+		case leafErr == nil && interErr == nil:
+			return nil, nil, errors.Errorf(
+				"certificate %s has both the leaf and intermediate marker OIDs",
+				cert.Subject.CommonName,
+			)
+		case leafErr == nil:
+			if leaf != nil {
+				return nil, nil, errors.New("multiple leaf certificates")
+			}
+			leaf = cert
+		case interErr == nil:
+			if inter != nil {
+				return nil, nil, errors.New("multiple intermediate certificates")
+			}
+			inter = cert
+		}
+	}
+
+	if leaf == nil {
+		return nil, nil, errors.Errorf("no leaf certificate with the marker OID %s", p.LeafCertificateOID)
+	}
+	if inter == nil {
+		return nil, nil, errors.Errorf("no intermediate certificate with the marker OID %s", p.IntermediateCertificateOID)
+	}
+	return leaf, inter, nil
+}
+
+// verifyPKCS7Signature checks that the signature was made by leaf over the
+// data defined by the token's scheme
+func (t PKPaymentToken) verifyPKCS7Signature(p7 *pkcs7.PKCS7,
+	leaf *x509.Certificate) error {
+
+	scheme, err := lookupScheme(t.PaymentData.Version)
+	if err != nil {
+		return err
+	}
+	if err := verifySigner(p7, leaf); err != nil {
+		return err
+	}
+	if err := verifySignatureAlgorithm(p7, scheme.SignatureAlgorithm()); err != nil {
+		return err
+	}
+
 	// we assigned the signed data to the p7 content because it could be detached in the previous steps
-	p7.Content = t.signedData()
+	p7.Content = scheme.SignedData(&t)
 	return p7.Verify()
 }
 
-// signedData returns the data signed by the client's Secure Element as defined
-// in Apple's documentation: https://developer.apple.com/library/content/documentation/PassKit/Reference/PaymentTokenJSON/PaymentTokenJSON.html#//apple_ref/doc/uid/TP40014929-CH8-SW2
-func (t PKPaymentToken) signedData() []byte {
-	signed := bytes.NewBuffer(nil)
+// verifySigner checks that the signature has a single signer, identified as
+// leaf, which signed data content
+func verifySigner(p7 *pkcs7.PKCS7, leaf *x509.Certificate) error {
+	if len(p7.Signers) != 1 {
+		return errors.Errorf("expected exactly one signer, got %d", len(p7.Signers))
+	}
 
-	switch version(t.PaymentData.Version) {
-	case vEC_v1:
-		signed.Write(t.PaymentData.Header.EphemeralPublicKey)
-	case vRSA_v1:
-		signed.Write(t.PaymentData.Header.WrappedKey)
+	signer := p7.Signers[0].IssuerAndSerialNumber
+	if signer.SerialNumber == nil || signer.SerialNumber.Cmp(leaf.SerialNumber) != 0 ||
+		!bytes.Equal(signer.IssuerName.FullBytes, leaf.RawIssuer) {
+
+		return errors.New("the signer does not match the leaf certificate")
 	}
 
-	signed.Write(t.PaymentData.Data)
-	trIDHex, _ := hex.DecodeString(t.PaymentData.Header.TransactionID)
-	signed.Write(trIDHex)
-	appDataHex, _ := hex.DecodeString(t.PaymentData.Header.ApplicationData)
-	signed.Write(appDataHex)
-	return signed.Bytes()
+	var contentType asn1.ObjectIdentifier
+	if err := p7.UnmarshalSignedAttribute(pkcs7.OIDAttributeContentType, &contentType); err != nil {
+		return errors.Wrap(err, "error reading the content type")
+	}
+	if !contentType.Equal(pkcs7.OIDData) {
+		return errors.Errorf("unexpected content type %s", contentType)
+	}
+	return nil
+}
+
+// verifySignatureAlgorithm checks that the token was signed with the algorithm
+// expected by its scheme. RSA signers may give the rsaEncryption key algorithm
+// instead of the signature algorithm, as the digest is given separately.
+func verifySignatureAlgorithm(p7 *pkcs7.PKCS7,
+	algorithm x509.SignatureAlgorithm) error {
+
+	expected, ok := signatureAlgorithms[algorithm]
+	if !ok {
+		return errors.Errorf("unsupported signature algorithm %s", algorithm)
+	}
+	for _, signer := range p7.Signers {
+		signature := signer.DigestEncryptionAlgorithm.Algorithm
+		if !signer.DigestAlgorithm.Algorithm.Equal(expected.digest) ||
+			!(signature.Equal(expected.signature) ||
+				expected.key != nil && signature.Equal(expected.key)) {
+
+			return errors.Errorf(
+				"unexpected signature algorithm %s with digest %s, expected %s",
+				signer.DigestEncryptionAlgorithm.Algorithm,
+				signer.DigestAlgorithm.Algorithm,
+				algorithm,
+			)
+		}
+	}
+	return nil
+}
+
+// signedData returns the data signed by the client's Secure Element, as
+// defined by the token's scheme
+func (t PKPaymentToken) signedData() []byte {
+	scheme, err := lookupScheme(t.PaymentData.Version)
+	if err != nil {
+		return nil
+	}
+	return scheme.SignedData(&t)
 }
 
 // verifySigningTime checks that the time of signing of the token is before the
 // transaction was received, and that the gap between the two is not too
-// significant. It uses the variable TransactionTimeWindow as a limit.
-func (t PKPaymentToken) verifySigningTime(p7 *pkcs7.PKCS7) error {
-	transactionTime := time.Now()
-	if !t.transactionTime.IsZero() {
-		transactionTime = t.transactionTime
-	}
+// significant. It uses the windows of the policy as limits.
+func (t PKPaymentToken) verifySigningTime(p7 *pkcs7.PKCS7,
+	policy VerificationPolicy) error {
 
-	signedTime := time.Time{}
-	if err := p7.UnmarshalSignedAttribute(pkcs7.OIDAttributeSigningTime, &signedTime); err != nil {
+	transactionTime := t.receptionTime(policy)
+	signedTime, err := extractSigningTime(p7)
+	if err != nil {
 		return err
 	}
 
-	// Check that both times are separated by less than TransactionTimeWindow
+	// Check that both times are separated by less than the allowed windows
 	delta := transactionTime.Sub(signedTime)
-	if delta < -time.Second {
-		return errors.Errorf(
-			"the transaction occured before the signing (%s difference)",
-			delta.String(),
-		)
-	}
-	if delta > TransactionTimeWindow {
-		return errors.Errorf(
-			"the transaction occured after the allowed time window (%s)",
-			delta.String(),
-		)
+	if delta < -policy.FutureSkew || delta > policy.PastWindow {
+		return &SigningTimeError{
+			SigningTime:     signedTime,
+			TransactionTime: transactionTime,
+			Window:          policy.PastWindow,
+		}
 	}
 	return nil
 }
+
+// receptionTime returns the time the token was received at, set with
+// SetTransactionTime or given by the clock of the policy
+func (t PKPaymentToken) receptionTime(policy VerificationPolicy) time.Time {
+	if !t.transactionTime.IsZero() {
+		return t.transactionTime
+	}
+	return policy.Now()
+}
+
+// extractSigningTime returns the signing time attribute of the signature
+func extractSigningTime(p7 *pkcs7.PKCS7) (time.Time, error) {
+	signingTime := time.Time{}
+	err := p7.UnmarshalSignedAttribute(pkcs7.OIDAttributeSigningTime, &signingTime)
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "error reading the signing time")
+	}
+	return signingTime, nil
+}
@@ -1,6 +1,7 @@
 package applepay
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
@@ -13,6 +14,7 @@ import (
 	"math/big"
 	"os"
 	"testing"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
 	"github.com/stretchr/testify/require"
@@ -26,7 +28,7 @@ func TestVerifySignature(t *testing.T) {
 				Version: "invalid version",
 			},
 		}
-		err := token.verifySignature()
+		err := token.verifySignature(context.Background(), DefaultVerificationPolicy())
 
 		So(err.Error(), ShouldStartWith, "invalid version")
 	})
@@ -37,7 +39,7 @@ func TestVerifySignature(t *testing.T) {
 		token := &PKPaymentToken{}
 		json.Unmarshal([]byte(`{"transactionIdentifier":"D60E5B29DAAF960C9837D15F1E968E1BB3AD124FE7FA4F85482D7D53789C273F","paymentMethod":{"network":"Visa","type":"debit","displayName":"Visa 3595"},"paymentData":{"version":"EC_v1","header":{"transactionId":"d60e5b29daaf960c9837d15f1e968e1bb3ad124fe7fa4f85482d7d53789c273f","publicKeyHash":"hErQTIkV+XDB8kVuVvYI+1PUv/iIJPuFg2QF/+z1NIo=","ephemeralPublicKey":"MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAEH5hMm7QXtTZBVHqIEg4PZveYt0vkmO1SsIWthxzl8NMBfhtPiUDkvgAKoUAOsTu2WqZxoJqccEX3GwWk4fIEjw=="},"signature":"MIAGCSqGSIb3DQEHAqCAMIACAQExDzANBglghkgBZQMEAgEFADCABgkqhkiG9w0BBwEAAKCAMIID4jCCA4igAwIBAgIIJEPyqAad9XcwCgYIKoZIzj0EAwIwejEuMCwGA1UEAwwlQXBwbGUgQXBwbGljYXRpb24gSW50ZWdyYXRpb24gQ0EgLSBHMzEmMCQGA1UECwwdQXBwbGUgQ2VydGlmaWNhdGlvbiBBdXRob3JpdHkxEzARBgNVBAoMCkFwcGxlIEluYy4xCzAJBgNVBAYTAlVTMB4XDTE0MDkyNTIyMDYxMVoXDTE5MDkyNDIyMDYxMVowXzElMCMGA1UEAwwcZWNjLXNtcC1icm9rZXItc2lnbl9VQzQtUFJPRDEUMBIGA1UECwwLaU9TIFN5c3RlbXMxEzARBgNVBAoMCkFwcGxlIEluYy4xCzAJBgNVBAYTAlVTMFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAEwhV37evWx7Ihj2jdcJChIY3HsL1vLCg9hGCV2Ur0pUEbg0IO2BHzQH6DMx8cVMP36zIg1rrV1O/0komJPnwPE6OCAhEwggINMEUGCCsGAQUFBwEBBDkwNzA1BggrBgEFBQcwAYYpaHR0cDovL29jc3AuYXBwbGUuY29tL29jc3AwNC1hcHBsZWFpY2EzMDEwHQYDVR0OBBYEFJRX22/VdIGGiYl2L35XhQfnm1gkMAwGA1UdEwEB/wQCMAAwHwYDVR0jBBgwFoAUI/JJxE+T5O8n5sT2KGw/orv9LkswggEdBgNVHSAEggEUMIIBEDCCAQwGCSqGSIb3Y2QFATCB/jCBwwYIKwYBBQUHAgIwgbYMgbNSZWxpYW5jZSBvbiB0aGlzIGNlcnRpZmljYXRlIGJ5IGFueSBwYXJ0eSBhc3N1bWVzIGFjY2VwdGFuY2Ugb2YgdGhlIHRoZW4gYXBwbGljYWJsZSBzdGFuZGFyZCB0ZXJtcyBhbmQgY29uZGl0aW9ucyBvZiB1c2UsIGNlcnRpZmljYXRlIHBvbGljeSBhbmQgY2VydGlmaWNhdGlvbiBwcmFjdGljZSBzdGF0ZW1lbnRzLjA2BggrBgEFBQcCARYqaHR0cDovL3d3dy5hcHBsZS5jb20vY2VydGlmaWNhdGVhdXRob3JpdHkvMDQGA1UdHwQtMCswKaAnoCWGI2h0dHA6Ly9jcmwuYXBwbGUuY29tL2FwcGxlYWljYTMuY3JsMA4GA1UdDwEB/wQEAwIHgDAPBgkqhkiG92NkBh0EAgUAMAoGCCqGSM49BAMCA0gAMEUCIHKKnw+Soyq5mXQr1V62c0BXKpaHodYu9TWXEPUWPpbpAiEAkTecfW6+W5l0r0ADfzTCPq2YtbS39w01XIayqBNy8bEwggLuMIICdaADAgECAghJbS+/OpjalzAKBggqhkjOPQQDAjBnMRswGQYDVQQDDBJBcHBsZSBSb290IENBIC0gRzMxJjAkBgNVBAsMHUFwcGxlIENlcnRpZmljYXRpb24gQXV0aG9yaXR5MRMwEQYDVQQKDApBcHBsZSBJbmMuMQswCQYDVQQGEwJVUzAeFw0xNDA1MDYyMzQ2MzBaFw0yOTA1MDYyMzQ2MzBaMHoxLjAsBgNVBAMMJUFwcGxlIEFwcGxpY2F0aW9uIEludGVncmF0aW9uIENBIC0gRzMxJjAkBgNVBAsMHUFwcGxlIENlcnRpZmljYXRpb24gQXV0aG9yaXR5MRMwEQYDVQQKDApBcHBsZSBJbmMuMQswCQYDVQQGEwJVUzBZMBMGByqGSM49AgEGCCqGSM49AwEHA0IABPAXEYQZ12SF1RpeJYEHduiAou/ee65N4I38S5PhM1bVZls1riLQl3YNIk57ugj9dhfOiMt2u2ZwvsjoKYT/VEWjgfcwgfQwRgYIKwYBBQUHAQEEOjA4MDYGCCsGAQUFBzABhipodHRwOi8vb2NzcC5hcHBsZS5jb20vb2NzcDA0LWFwcGxlcm9vdGNhZzMwHQYDVR0OBBYEFCPyScRPk+TvJ+bE9ihsP6K7/S5LMA8GA1UdEwEB/wQFMAMBAf8wHwYDVR0jBBgwFoAUu7DeoVgziJqkipnevr3rr9rLJKswNwYDVR0fBDAwLjAsoCqgKIYmaHR0cDovL2NybC5hcHBsZS5jb20vYXBwbGVyb290Y2FnMy5jcmwwDgYDVR0PAQH/BAQDAgEGMBAGCiqGSIb3Y2QGAg4EAgUAMAoGCCqGSM49BAMCA2cAMGQCMDrPcoNRFpmxhvs1w1bKYr/0F+3ZD3VNoo6+8ZyBXkK3ifiY95tZn5jVQQ2PnenC/gIwMi3VRCGwowV3bF3zODuQZ/0XfCwhbZZPxnJpghJvVPh6fRuZy5sJiSFhBpkPCZIdAAAxggGLMIIBhwIBATCBhjB6MS4wLAYDVQQDDCVBcHBsZSBBcHBsaWNhdGlvbiBJbnRlZ3JhdGlvbiBDQSAtIEczMSYwJAYDVQQLDB1BcHBsZSBDZXJ0aWZpY2F0aW9uIEF1dGhvcml0eTETMBEGA1UECgwKQXBwbGUgSW5jLjELMAkGA1UEBhMCVVMCCCRD8qgGnfV3MA0GCWCGSAFlAwQCAQUAoIGVMBgGCSqGSIb3DQEJAzELBgkqhkiG9w0BBwEwHAYJKoZIhvcNAQkFMQ8XDTE3MDIwMTE4NDUwNlowKgYJKoZIhvcNAQk0MR0wGzANBglghkgBZQMEAgEFAKEKBggqhkjOPQQDAjAvBgkqhkiG9w0BCQQxIgQglCIj48n0VuU/n1ZcRRQGtOUg3PoSbmRT4t6T7AwHieswCgYIKoZIzj0EAwIERjBEAiBARLdtQbAkukYzQy2sf4RKI5fZTliIsZjzR6rhSkFJWQIgGr++I+0XiSFAxs/QRGJuMOM+UnuKQea28cwVPd1mHZsAAAAAAAA=","data":"qMvuwnxckj/BzZgR7bR75QqCB+CmEo8AYPJDZl+oD/eZgzcvHB1UfwXdyOIjQk1NX0whfwPZoh6Xfkxvb6g0F9Y/dTtJW4E5aD39NDlaZD5C8XOyDlx27IXCOc5vkEyfV4z1T15wsmYKRl0K+BcmaLbuYEmCQGTwq4Z1LVLhlDpkbtdrqr7WuBH6mIToV4AV+zlTfKj67uLRpmhqBLox14hFkVl3Il15Oq6PnYP2f+padZudUrkjWOPR8pNepPF52EL/mUNadKs3NjqG9uJLl2ELY1A+MESosJ6zoSpKuBBF8FxvaJQgDCJS2yeOut+r8okbh06xVMjNPLC7dGyGW2a6OdpsMGc5+nsP9bs3V6NIosYDCoszEBVFFFjjnYSJhdlER1i6lGE6RTjSUnPGMSb4aknjrDRN/4AJz4Q="}}`), token)
 
-		err := token.verifySignature()
+		err := token.verifySignature(context.Background(), DefaultVerificationPolicy())
 
 		So(err, ShouldBeNil)
 	})
@@ -141,7 +143,7 @@ func TestLoadRootCertificate(t *testing.T) {
 	})
 
 	Convey("Apple's actual root certificate is loaded properly", t, func() {
-		cert, err := loadRootCertificate(AppleRootCertificatePath)
+		cert, err := loadRootCertificate("AppleRootCA-G3.crt")
 
 		Convey("cert is not nil", func() {
 			So(cert, ShouldNotBeNil)
@@ -154,10 +156,13 @@ func TestLoadRootCertificate(t *testing.T) {
 }
 
 func TestVerifyCertificates(t *testing.T) {
-	appleRoot, _ := loadRootCertificate(AppleRootCertificatePath)
-
+	notBefore := time.Now().Add(-time.Hour)
+	notAfter := notBefore.Add(24 * time.Hour)
+	signingTime := notBefore.Add(time.Minute)
 	rootTpl := &x509.Certificate{
 		SerialNumber:          big.NewInt(0),
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
 		KeyUsage:              x509.KeyUsageCertSign,
 		IsCA:                  true,
 		BasicConstraintsValid: true,
@@ -165,10 +170,14 @@ func TestVerifyCertificates(t *testing.T) {
 	rootKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	testRootBytes, _ := x509.CreateCertificate(rand.Reader, rootTpl, rootTpl, &rootKey.PublicKey, rootKey)
 	testRoot, _ := x509.ParseCertificate(testRootBytes)
+	testRoots := x509.NewCertPool()
+	testRoots.AddCert(testRoot)
 
 	Convey("Missing extension in intermediate certificate produces an error", t, func() {
 		interTpl := &x509.Certificate{
 			SerialNumber:          big.NewInt(0),
+			NotBefore:             notBefore,
+			NotAfter:              notAfter,
 			IsCA:                  true,
 			BasicConstraintsValid: true,
 		}
@@ -177,6 +186,9 @@ func TestVerifyCertificates(t *testing.T) {
 		inter, _ := x509.ParseCertificate(interBytes)
 		leafTpl := &x509.Certificate{
 			SerialNumber: big.NewInt(0),
+			NotBefore:    notBefore,
+			NotAfter:     notAfter,
+			KeyUsage:     x509.KeyUsageDigitalSignature,
 			ExtraExtensions: []pkix.Extension{
 				{
 					Id:    leafCertificateOID,
@@ -188,7 +200,7 @@ func TestVerifyCertificates(t *testing.T) {
 		leafBytes, _ := x509.CreateCertificate(rand.Reader, leafTpl, inter, &leafKey.PublicKey, interKey)
 		leaf, _ := x509.ParseCertificate(leafBytes)
 
-		err := verifyCertificates(testRoot, inter, leaf)
+		_, err := DefaultVerificationPolicy().verifyCertificates(testRoots, inter, leaf, signingTime)
 
 		So(err.Error(), ShouldStartWith, "invalid intermediate cert Apple extension")
 	})
@@ -196,6 +208,8 @@ func TestVerifyCertificates(t *testing.T) {
 	Convey("Missing extension in leaf certificate produces an error", t, func() {
 		interTpl := &x509.Certificate{
 			SerialNumber: big.NewInt(0),
+			NotBefore:    notBefore,
+			NotAfter:     notAfter,
 			ExtraExtensions: []pkix.Extension{
 				{
 					Id:    interCertificateOID,
@@ -210,12 +224,15 @@ func TestVerifyCertificates(t *testing.T) {
 		inter, _ := x509.ParseCertificate(interBytes)
 		leafTpl := &x509.Certificate{
 			SerialNumber: big.NewInt(0),
+			NotBefore:    notBefore,
+			NotAfter:     notAfter,
+			KeyUsage:     x509.KeyUsageDigitalSignature,
 		}
 		leafKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 		leafBytes, _ := x509.CreateCertificate(rand.Reader, leafTpl, inter, &leafKey.PublicKey, interKey)
 		leaf, _ := x509.ParseCertificate(leafBytes)
 
-		err := verifyCertificates(testRoot, inter, leaf)
+		_, err := DefaultVerificationPolicy().verifyCertificates(testRoots, inter, leaf, signingTime)
 
 		So(err.Error(), ShouldStartWith, "invalid leaf cert Apple extension")
 	})
@@ -223,6 +240,8 @@ func TestVerifyCertificates(t *testing.T) {
 	Convey("Untrusted intermediate certificates are rejected", t, func() {
 		interTpl := &x509.Certificate{
 			SerialNumber: big.NewInt(0),
+			NotBefore:    notBefore,
+			NotAfter:     notAfter,
 			ExtraExtensions: []pkix.Extension{
 				{
 					Id:    interCertificateOID,
@@ -237,6 +256,9 @@ func TestVerifyCertificates(t *testing.T) {
 		inter, _ := x509.ParseCertificate(interBytes)
 		leafTpl := &x509.Certificate{
 			SerialNumber: big.NewInt(0),
+			NotBefore:    notBefore,
+			NotAfter:     notAfter,
+			KeyUsage:     x509.KeyUsageDigitalSignature,
 			ExtraExtensions: []pkix.Extension{
 				{
 					Id:    leafCertificateOID,
@@ -248,7 +270,7 @@ func TestVerifyCertificates(t *testing.T) {
 		leafBytes, _ := x509.CreateCertificate(rand.Reader, leafTpl, inter, &leafKey.PublicKey, interKey)
 		leaf, _ := x509.ParseCertificate(leafBytes)
 
-		err := verifyCertificates(testRoot, inter, leaf)
+		_, err := DefaultVerificationPolicy().verifyCertificates(testRoots, inter, leaf, signingTime)
 
 		So(err.Error(), ShouldStartWith, "intermediate cert is not trusted by root")
 	})
@@ -256,6 +278,8 @@ func TestVerifyCertificates(t *testing.T) {
 	Convey("Untrusted leaf certificates are rejected", t, func() {
 		interTpl := &x509.Certificate{
 			SerialNumber: big.NewInt(0),
+			NotBefore:    notBefore,
+			NotAfter:     notAfter,
 			ExtraExtensions: []pkix.Extension{
 				{
 					Id:    interCertificateOID,
@@ -270,6 +294,9 @@ func TestVerifyCertificates(t *testing.T) {
 		inter, _ := x509.ParseCertificate(interBytes)
 		leafTpl := &x509.Certificate{
 			SerialNumber: big.NewInt(0),
+			NotBefore:    notBefore,
+			NotAfter:     notAfter,
+			KeyUsage:     x509.KeyUsageDigitalSignature,
 			ExtraExtensions: []pkix.Extension{
 				{
 					Id:    leafCertificateOID,
@@ -281,7 +308,7 @@ func TestVerifyCertificates(t *testing.T) {
 		leafBytes, _ := x509.CreateCertificate(rand.Reader, leafTpl, leafTpl, &leafKey.PublicKey, leafKey)
 		leaf, _ := x509.ParseCertificate(leafBytes)
 
-		err := verifyCertificates(testRoot, inter, leaf)
+		_, err := DefaultVerificationPolicy().verifyCertificates(testRoots, inter, leaf, signingTime)
 
 		So(err.Error(), ShouldStartWith, "leaf cert is not trusted by intermediate cert")
 	})
@@ -296,9 +323,127 @@ func TestVerifyCertificates(t *testing.T) {
 
 		inter, leaf := p7.Certificates[1], p7.Certificates[0]
 
-		err = verifyCertificates(appleRoot, inter, leaf)
+		_, err = DefaultVerificationPolicy().verifyCertificates(AppleRoots(), inter, leaf, testTokenSigningTime)
+		So(err, ShouldBeNil)
+
+		_, err = DefaultVerificationPolicy().verifyCertificates(AppleRoots(), inter, leaf, leaf.NotAfter.Add(time.Second))
+		So(err.Error(), ShouldStartWith, "leaf cert is not valid at the signing time 2019-09-24T22:06:12Z")
+	})
+
+	// newChain creates an intermediate and a leaf certificate signed by
+	// testRoot, modified by the given functions
+	newChain := func(editInter, editLeaf func(*x509.Certificate)) (*x509.Certificate, *x509.Certificate) {
+		interTpl := &x509.Certificate{
+			SerialNumber: big.NewInt(0),
+			NotBefore:    notBefore,
+			NotAfter:     notAfter,
+			ExtraExtensions: []pkix.Extension{
+				{
+					Id:    interCertificateOID,
+					Value: []byte("test"),
+				},
+			},
+			KeyUsage:              x509.KeyUsageCertSign,
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+		}
+		editInter(interTpl)
+		interKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		interBytes, _ := x509.CreateCertificate(rand.Reader, interTpl, testRoot, &interKey.PublicKey, rootKey)
+		inter, _ := x509.ParseCertificate(interBytes)
+		leafTpl := &x509.Certificate{
+			SerialNumber: big.NewInt(0),
+			NotBefore:    notBefore,
+			NotAfter:     notAfter,
+			ExtraExtensions: []pkix.Extension{
+				{
+					Id:    leafCertificateOID,
+					Value: []byte("test"),
+				},
+			},
+			KeyUsage: x509.KeyUsageDigitalSignature,
+		}
+		editLeaf(leafTpl)
+		leafKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		leafBytes, _ := x509.CreateCertificate(rand.Reader, leafTpl, inter, &leafKey.PublicKey, interKey)
+		leaf, _ := x509.ParseCertificate(leafBytes)
+		return inter, leaf
+	}
+	unchanged := func(*x509.Certificate) {}
+
+	Convey("Certificates are verified at the signing time", t, func() {
+		inter, leaf := newChain(unchanged, unchanged)
 
+		_, err := DefaultVerificationPolicy().verifyCertificates(testRoots, inter, leaf, signingTime)
 		So(err, ShouldBeNil)
+
+		_, err = DefaultVerificationPolicy().verifyCertificates(testRoots, inter, leaf, notBefore.Add(-time.Minute))
+		So(err.Error(), ShouldStartWith, "intermediate cert is not valid at the signing time")
+	})
+
+	Convey("Expired leaf certificates are rejected", t, func() {
+		inter, leaf := newChain(unchanged, func(c *x509.Certificate) {
+			c.NotAfter = notBefore
+		})
+
+		_, err := DefaultVerificationPolicy().verifyCertificates(testRoots, inter, leaf, signingTime)
+
+		So(err.Error(), ShouldStartWith, "leaf cert is not valid at the signing time")
+	})
+
+	Convey("Intermediate certificates must be CAs", t, func() {
+		inter, leaf := newChain(func(c *x509.Certificate) {
+			c.IsCA = false
+		}, unchanged)
+
+		_, err := DefaultVerificationPolicy().verifyCertificates(testRoots, inter, leaf, signingTime)
+
+		So(err.Error(), ShouldEqual, "intermediate cert is not a CA")
+	})
+
+	Convey("Intermediate certificates must be allowed to sign certificates", t, func() {
+		inter, leaf := newChain(func(c *x509.Certificate) {
+			c.KeyUsage = x509.KeyUsageDigitalSignature
+		}, unchanged)
+
+		_, err := DefaultVerificationPolicy().verifyCertificates(testRoots, inter, leaf, signingTime)
+
+		So(err.Error(), ShouldEqual, "intermediate cert key usage does not allow signing certificates")
+	})
+
+	Convey("Leaf certificates must be allowed to sign data", t, func() {
+		inter, leaf := newChain(unchanged, func(c *x509.Certificate) {
+			c.KeyUsage = x509.KeyUsageKeyEncipherment
+		})
+
+		_, err := DefaultVerificationPolicy().verifyCertificates(testRoots, inter, leaf, signingTime)
+
+		So(err.Error(), ShouldEqual, "leaf cert key usage does not allow digital signatures")
+	})
+
+	Convey("Leaf certificates cannot be CAs", t, func() {
+		inter, leaf := newChain(unchanged, func(c *x509.Certificate) {
+			c.IsCA = true
+			c.BasicConstraintsValid = true
+		})
+
+		_, err := DefaultVerificationPolicy().verifyCertificates(testRoots, inter, leaf, signingTime)
+
+		So(err.Error(), ShouldEqual, "leaf cert should not be a CA")
+	})
+
+	Convey("Path length constraints are enforced", t, func() {
+		constrainedTpl := *rootTpl
+		constrainedTpl.MaxPathLenZero = true
+		constrainedBytes, _ := x509.CreateCertificate(rand.Reader, &constrainedTpl, &constrainedTpl, &rootKey.PublicKey, rootKey)
+		constrained, _ := x509.ParseCertificate(constrainedBytes)
+		roots := x509.NewCertPool()
+		roots.AddCert(constrained)
+		inter, leaf := newChain(unchanged, unchanged)
+
+		_, err := DefaultVerificationPolicy().verifyCertificates(roots, inter, leaf, signingTime)
+
+		So(err.Error(), ShouldStartWith, "invalid certificate chain")
 	})
 }
 
@@ -337,3 +482,129 @@ func TestSignedData(t *testing.T) {
 		So(res, ShouldResemble, []byte("wrapped_key-data-transaction_id-application_data"))
 	})
 }
+
+// newSigningChain creates self-signed intermediate and leaf certificates with
+// Apple's marker OIDs
+func newSigningChain() (leaf, inter *x509.Certificate, leafKey, interKey *ecdsa.PrivateKey) {
+	interKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	interTpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "inter"},
+		NotAfter:              time.Now().Add(time.Hour),
+		ExtraExtensions:       []pkix.Extension{{Id: interCertificateOID, Value: []byte{5, 0}}},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	interBytes, _ := x509.CreateCertificate(rand.Reader, interTpl, interTpl, &interKey.PublicKey, interKey)
+	inter, _ = x509.ParseCertificate(interBytes)
+
+	leafKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	leafTpl := &x509.Certificate{
+		SerialNumber:    big.NewInt(2),
+		Subject:         pkix.Name{CommonName: "leaf"},
+		NotAfter:        time.Now().Add(time.Hour),
+		ExtraExtensions: []pkix.Extension{{Id: leafCertificateOID, Value: []byte{5, 0}}},
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+	}
+	leafBytes, _ := x509.CreateCertificate(rand.Reader, leafTpl, inter, &leafKey.PublicKey, interKey)
+	leaf, _ = x509.ParseCertificate(leafBytes)
+	return leaf, inter, leafKey, interKey
+}
+
+func TestSigningCertificates(t *testing.T) {
+	leaf, inter, _, _ := newSigningChain()
+	policy := DefaultVerificationPolicy()
+
+	Convey("Certificates are located by their marker OIDs", t, func() {
+		l, i, err := policy.signingCertificates(&pkcs7.PKCS7{
+			Certificates: []*x509.Certificate{inter, leaf},
+		})
+
+		So(err, ShouldBeNil)
+		So(l, ShouldEqual, leaf)
+		So(i, ShouldEqual, inter)
+	})
+
+	Convey("Additional certificates are ignored", t, func() {
+		other, _, _, _ := newSigningChain()
+		l, _, err := policy.signingCertificates(&pkcs7.PKCS7{
+			Certificates: []*x509.Certificate{leaf, inter, appleRootCertificate(t)},
+		})
+
+		So(err, ShouldBeNil)
+		So(l, ShouldEqual, leaf)
+
+		_, _, err = policy.signingCertificates(&pkcs7.PKCS7{
+			Certificates: []*x509.Certificate{leaf, inter, other},
+		})
+		So(err.Error(), ShouldEqual, "multiple leaf certificates")
+	})
+
+	Convey("Missing certificates are rejected", t, func() {
+		_, _, err := policy.signingCertificates(&pkcs7.PKCS7{
+			Certificates: []*x509.Certificate{leaf},
+		})
+
+		So(err.Error(), ShouldEqual, "no intermediate certificate with the marker OID 1.2.840.113635.100.6.2.14")
+	})
+}
+
+func TestVerifySigner(t *testing.T) {
+	leaf, inter, leafKey, interKey := newSigningChain()
+
+	// sign creates a detached signature of data by each of the signers
+	sign := func(signers ...func(sd *pkcs7.SignedData)) *pkcs7.PKCS7 {
+		sd, _ := pkcs7.NewSignedData([]byte("data"))
+		sd.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+		for _, signer := range signers {
+			signer(sd)
+		}
+		sd.Detach()
+		der, err := sd.Finish()
+		So(err, ShouldBeNil)
+		p7, err := pkcs7.Parse(der)
+		So(err, ShouldBeNil)
+		return p7
+	}
+	byLeaf := func(sd *pkcs7.SignedData) {
+		So(sd.AddSignerChain(leaf, leafKey, []*x509.Certificate{inter}, pkcs7.SignerInfoConfig{}), ShouldBeNil)
+	}
+	byInter := func(sd *pkcs7.SignedData) {
+		So(sd.AddSigner(inter, interKey, pkcs7.SignerInfoConfig{}), ShouldBeNil)
+		sd.AddCertificate(leaf)
+	}
+
+	Convey("Signatures by the leaf certificate are accepted", t, func() {
+		So(verifySigner(sign(byLeaf), leaf), ShouldBeNil)
+	})
+
+	Convey("Signatures by other certificates are rejected", t, func() {
+		p7 := sign(byInter)
+
+		So(verifySigner(p7, leaf).Error(), ShouldEqual, "the signer does not match the leaf certificate")
+	})
+
+	Convey("Signatures must have exactly one signer", t, func() {
+		So(verifySigner(sign(byLeaf, byInter), leaf).Error(), ShouldEqual, "expected exactly one signer, got 2")
+		So(verifySigner(sign(), leaf).Error(), ShouldEqual, "expected exactly one signer, got 0")
+	})
+
+	Convey("Tokens are rejected if their signer is not the leaf", t, func() {
+		tokenJSON, _ := os.ReadFile("tests/token.json")
+		token := &PKPaymentToken{}
+		json.Unmarshal(tokenJSON, token)
+		p7, _ := pkcs7.Parse(token.PaymentData.Signature)
+		leaf, inter, err := DefaultVerificationPolicy().signingCertificates(p7)
+		So(err, ShouldBeNil)
+
+		So(token.verifyPKCS7Signature(p7, leaf), ShouldBeNil)
+		So(token.verifyPKCS7Signature(p7, inter).Error(), ShouldEqual, "the signer does not match the leaf certificate")
+	})
+}
+
+// appleRootCertificate returns the embedded root certificate
+func appleRootCertificate(t *testing.T) *x509.Certificate {
+	root, err := parseRootCertificate(appleRootCertificatePEM)
+	require.NoError(t, err)
+	return root
+}
@@ -0,0 +1,120 @@
+package applepay
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
+type (
+	// transportConfig configures the transport of the requests made to Apple
+	transportConfig struct {
+		// proxy selects the egress proxy, from the environment if nil
+		proxy func(*http.Request) (*url.URL, error)
+		// dialContext opens the connections, with a net.Dialer if nil
+		dialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+		// tlsMinVersion is the minimum TLS version, TLS 1.2 if zero
+		tlsMinVersion uint16
+		// roundTripper replaces the pooled transport if not nil
+		roundTripper http.RoundTripper
+	}
+)
+
+// MerchantProxy sends the requests made to Apple through the proxy at
+// proxyURL, instead of the proxy of the environment. A nil URL disables
+// proxies.
+func MerchantProxy(proxyURL *url.URL) func(*Merchant) error {
+	return func(m *Merchant) error {
+		m.transportConfig.proxy = http.ProxyURL(proxyURL)
+		return nil
+	}
+}
+
+// MerchantDialer opens the connections of the requests made to Apple with
+// dial, e.g. the DialContext method of a net.Dialer
+func MerchantDialer(dial func(ctx context.Context, network,
+	addr string) (net.Conn, error)) func(*Merchant) error {
+
+	return func(m *Merchant) error {
+		if dial == nil {
+			return newError(CodeInvalidConfiguration, errors.New("nil dialer"))
+		}
+		m.transportConfig.dialContext = dial
+		return nil
+	}
+}
+
+// MerchantTLSMinVersion sets the minimum TLS version of the requests made to
+// Apple, tls.VersionTLS12 by default
+func MerchantTLSMinVersion(version uint16) func(*Merchant) error {
+	return func(m *Merchant) error {
+		if version != tls.VersionTLS12 && version != tls.VersionTLS13 {
+			return newError(
+				CodeInvalidConfiguration,
+				errors.Errorf("unsupported TLS version %#04x", version),
+			)
+		}
+		m.transportConfig.tlsMinVersion = version
+		return nil
+	}
+}
+
+// MerchantRoundTripper sends the requests made to Apple with rt instead of
+// the pooled transport of the merchant. rt must authenticate with the
+// Merchant Identity Certificate, e.g. using TLSClientConfig; the proxy,
+// dialer and TLS options are ignored.
+func MerchantRoundTripper(rt http.RoundTripper) func(*Merchant) error {
+	return func(m *Merchant) error {
+		if rt == nil {
+			return newError(
+				CodeInvalidConfiguration,
+				errors.New("nil round tripper"),
+			)
+		}
+		m.transportConfig.roundTripper = rt
+		return nil
+	}
+}
+
+// TLSClientConfig returns a TLS configuration authenticating with the current
+// Merchant Identity Certificate of the merchant, including after reloads
+func (m Merchant) TLSClientConfig() *tls.Config {
+	minVersion := m.transportConfig.tlsMinVersion
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
+	}
+	keyPairs := m.keyPairs
+	return &tls.Config{
+		MinVersion: minVersion,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert := Merchant{keyPairs: keyPairs}.keys().merchantCertificate
+			if cert == nil {
+				// No certificate is sent
+				return &tls.Certificate{}, nil
+			}
+			return cert, nil
+		},
+	}
+}
+
+// newTransport returns the transport of the requests made to Apple, kept for
+// the lifetime of the merchant to reuse connections
+func (m Merchant) newTransport() http.RoundTripper {
+	if m.transportConfig.roundTripper != nil {
+		return m.transportConfig.roundTripper
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = m.TLSClientConfig()
+	t.ForceAttemptHTTP2 = true
+	if m.transportConfig.proxy != nil {
+		t.Proxy = m.transportConfig.proxy
+	}
+	if m.transportConfig.dialContext != nil {
+		t.DialContext = m.transportConfig.dialContext
+	}
+	return t
+}
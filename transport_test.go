@@ -0,0 +1,153 @@
+package applepay
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// roundTripperFunc is an http.RoundTripper calling itself
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestTransportOptions(t *testing.T) {
+	Convey("The pooled transport is configured by the options", t, func() {
+		proxyURL, _ := url.Parse("http://proxy.example.com:3128")
+		dialer := &net.Dialer{}
+		m, err := New(
+			"merchant.com.processout.test",
+			MerchantProxy(proxyURL),
+			MerchantDialer(dialer.DialContext),
+			MerchantTLSMinVersion(tls.VersionTLS13),
+		)
+		So(err, ShouldBeNil)
+
+		transport := m.transport.(*http.Transport)
+		proxy, err := transport.Proxy(&http.Request{URL: &url.URL{Scheme: "https", Host: "apple-pay-gateway.apple.com"}})
+		So(err, ShouldBeNil)
+		So(proxy, ShouldResemble, proxyURL)
+		So(transport.DialContext, ShouldNotBeNil)
+		So(transport.TLSClientConfig.MinVersion, ShouldEqual, tls.VersionTLS13)
+		So(transport.ForceAttemptHTTP2, ShouldBeTrue)
+	})
+
+	Convey("TLS 1.2 is the default minimum version", t, func() {
+		m, _ := New("merchant.com.processout.test")
+
+		So(m.TLSClientConfig().MinVersion, ShouldEqual, tls.VersionTLS12)
+	})
+
+	Convey("Invalid options are rejected", t, func() {
+		for _, option := range []func(*Merchant) error{
+			MerchantDialer(nil),
+			MerchantTLSMinVersion(tls.VersionTLS11),
+			MerchantRoundTripper(nil),
+		} {
+			_, err := New("merchant.com.processout.test", option)
+			So(errors.Is(err, ErrInvalidConfiguration), ShouldBeTrue)
+		}
+	})
+}
+
+func TestStartSessionContext(t *testing.T) {
+	merchantID := "merchant.com.processout.test"
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	cert := testCertificate(merchantID, key)
+	sessionURL := "https://apple-pay-gateway.apple.com/paymentservices/paymentSession"
+	validSession := `{"epochTimestamp":1700000000000,"expiresAt":4102444800000,"merchantSessionIdentifier":"SSH1","nonce":"abcd","signature":"3080"}`
+
+	Convey("Requests are sent with the caller's round tripper and context", t, func() {
+		type contextKey struct{}
+		var requestValue interface{}
+		m, _ := New(
+			merchantID,
+			MerchantCertificate(cert),
+			MerchantRoundTripper(roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				requestValue = r.Context().Value(contextKey{})
+				return sessionResponse(http.StatusOK, validSession), nil
+			})),
+		)
+
+		ctx := context.WithValue(context.Background(), contextKey{}, "value")
+		session, err := m.StartSessionContext(ctx, sessionURL)
+
+		So(err, ShouldBeNil)
+		So(session.MerchantSessionIdentifier, ShouldEqual, "SSH1")
+		So(requestValue, ShouldEqual, "value")
+	})
+
+	Convey("Cancelled requests are stopped", t, func() {
+		m, _ := New(
+			merchantID,
+			MerchantCertificate(cert),
+			MerchantRoundTripper(roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				<-r.Context().Done()
+				return nil, r.Context().Err()
+			})),
+		)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err := m.SessionContext(ctx, sessionURL)
+
+		So(errors.Is(err, ErrGateway), ShouldBeTrue)
+		So(errors.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+	})
+
+	Convey("Connections to Apple are authenticated and reused", t, func() {
+		var connections, authenticated int32
+		server := httptest.NewUnstartedServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if len(r.TLS.PeerCertificates) > 0 {
+					atomic.AddInt32(&authenticated, 1)
+				}
+				w.Write([]byte(validSession))
+			},
+		))
+		server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+		server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				atomic.AddInt32(&connections, 1)
+			}
+		}
+		server.StartTLS()
+		defer server.Close()
+
+		// Apple's gateway is reached through the test server
+		dialer := &net.Dialer{}
+		m, _ := New(
+			merchantID,
+			MerchantCertificate(cert),
+			MerchantDialer(func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, server.Listener.Addr().String())
+			}),
+		)
+		roots := x509.NewCertPool()
+		roots.AddCert(server.Certificate())
+		config := m.transport.(*http.Transport).TLSClientConfig
+		config.RootCAs = roots
+		config.ServerName = "example.com"
+
+		for i := 0; i < 2; i++ {
+			_, err := m.StartSessionContext(context.Background(), sessionURL)
+			So(err, ShouldBeNil)
+		}
+		So(atomic.LoadInt32(&authenticated), ShouldEqual, 2)
+		So(atomic.LoadInt32(&connections), ShouldEqual, 1)
+	})
+}
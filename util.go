@@ -1,6 +1,8 @@
 package applepay
 
 import (
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/asn1"
@@ -66,6 +68,31 @@ func extractMerchantHash(cert tls.Certificate) ([]byte, error) {
 	return []byte(merchantIDString), nil
 }
 
+// parseLeaf parses the leaf certificate of a certificate chain
+func parseLeaf(cert tls.Certificate) (*x509.Certificate, error) {
+	if cert.Certificate == nil {
+		return nil, errors.New("nil certificate")
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, errors.Wrap(err, "certificate parsing error")
+	}
+	return leaf, nil
+}
+
+// publicKeyHash returns the SHA-256 hash of the X.509-encoded public key of a
+// certificate, as found in the publicKeyHash field of tokens' headers
+func publicKeyHash(cert tls.Certificate) ([]byte, error) {
+	leaf, err := parseLeaf(cert)
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	return h[:], nil
+}
+
 // extractExtension returns the value of a certificate extension if it exists
 func extractExtension(cert *x509.Certificate, oid asn1.ObjectIdentifier) (
 	[]byte, error) {
@@ -143,3 +170,14 @@ func checkValidity(cert tls.Certificate) error {
 
 	return nil
 }
+
+// withDefaultTimeout returns ctx if it has a deadline, and a context canceled
+// after timeout otherwise
+func withDefaultTimeout(ctx context.Context,
+	timeout time.Duration) (context.Context, context.CancelFunc) {
+
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}